@@ -0,0 +1,178 @@
+package imageproxy
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"image/gif"
+)
+
+// maxAnimationPixels is the largest total number of pixels of the frames of
+// animations converted from gifs, which are all held in memory to be encoded.
+// Frames beyond it are dropped, keeping at least the first.
+var maxAnimationPixels = 1 << 26
+
+// gifFrame returns frame n, numbered from 1, of the gif img as it is
+// displayed, on top of the frames before it.  n is limited to the frames of
+// img, and frame 1 is returned for n less than 1.
+func gifFrame(img []byte, n int) (image.Image, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(img))
+	if err != nil {
+		return nil, err
+	}
+	if n < 1 {
+		n = 1
+	}
+	if n > len(g.Image) {
+		n = len(g.Image)
+	}
+
+	canvas := image.NewNRGBA(gifBounds(g))
+	for i := 0; i < n-1; i++ {
+		disposeGIFFrame(canvas, g, i, nil)
+	}
+	frame := g.Image[n-1]
+	draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+	return canvas, nil
+}
+
+// gifBounds returns the bounds of the logical screen of g, which holds all of
+// its frames.
+func gifBounds(g *gif.GIF) image.Rectangle {
+	b := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	for _, frame := range g.Image {
+		b = b.Union(frame.Bounds())
+	}
+	return b
+}
+
+// disposeGIFFrame draws frame i of g onto canvas, which holds the frames
+// before it, and then disposes of it as the next frame expects.  If shown is
+// not nil, it is called with the canvas as the frame is displayed, before
+// disposal.
+func disposeGIFFrame(canvas *image.NRGBA, g *gif.GIF, i int, shown func(*image.NRGBA)) {
+	frame := g.Image[i]
+	var disposal byte
+	if i < len(g.Disposal) {
+		disposal = g.Disposal[i]
+	}
+
+	var previous *image.NRGBA
+	if disposal == gif.DisposalPrevious {
+		previous = image.NewNRGBA(canvas.Bounds())
+		copy(previous.Pix, canvas.Pix)
+	}
+	draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+	if shown != nil {
+		shown(canvas)
+	}
+
+	switch disposal {
+	case gif.DisposalBackground:
+		draw.Draw(canvas, frame.Bounds(), image.Transparent, image.ZP, draw.Src)
+	case gif.DisposalPrevious:
+		copy(canvas.Pix, previous.Pix)
+	}
+}
+
+// truncateGIF returns the gif img cut to at most maxFrames frames and to the
+// frames starting within maxDuration seconds.  Zero values set no limit, and
+// the first frame is always kept.
+func truncateGIF(img []byte, maxFrames int, maxDuration float64) ([]byte, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(img))
+	if err != nil {
+		return nil, err
+	}
+
+	n := gifFrameCount(g, maxFrames, maxDuration)
+	if n == len(g.Image) {
+		return img, nil
+	}
+
+	g.Image = g.Image[:n]
+	g.Delay = g.Delay[:n]
+	if len(g.Disposal) > n {
+		g.Disposal = g.Disposal[:n]
+	}
+	buf := new(bytes.Buffer)
+	if err := gif.EncodeAll(buf, g); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// gifFrameCount returns the number of frames of g kept by the limits of
+// truncateGIF.
+func gifFrameCount(g *gif.GIF, maxFrames int, maxDuration float64) int {
+	n := len(g.Image)
+	if maxFrames > 0 && n > maxFrames {
+		n = maxFrames
+	}
+	if maxDuration > 0 {
+		// delays are in hundredths of a second
+		var elapsed int
+		for i := 0; i < n; i++ {
+			if i > 0 && float64(elapsed)/100 >= maxDuration {
+				return i
+			}
+			elapsed += g.Delay[i]
+		}
+	}
+	return n
+}
+
+// gifFrames returns the frames of the gif img as they are displayed, limited
+// like truncateGIF and to maxAnimationPixels, with fn applied to each.  Their
+// delays are returned in milliseconds, along with the number of times the
+// animation is played, 0 meaning forever.
+func gifFrames(img []byte, maxFrames int, maxDuration float64, fn func(image.Image) image.Image) (frames []image.Image, delays []int, loopCount int, err error) {
+	g, err := gif.DecodeAll(bytes.NewReader(img))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	n := gifFrameCount(g, maxFrames, maxDuration)
+	canvas := image.NewNRGBA(gifBounds(g))
+	if size := len(canvas.Pix) / 4; size > 0 && n > maxAnimationPixels/size {
+		n = maxAnimationPixels / size
+		if n < 1 {
+			n = 1
+		}
+	}
+
+	// fn may change the size of the frames, so the pixels are counted again
+	var pixels int
+	for i := 0; i < n; i++ {
+		var frame image.Image
+		disposeGIFFrame(canvas, g, i, func(canvas *image.NRGBA) {
+			m := image.NewNRGBA(canvas.Bounds())
+			copy(m.Pix, canvas.Pix)
+			frame = fn(m)
+		})
+		pixels += frame.Bounds().Dx() * frame.Bounds().Dy()
+		if i > 0 && pixels > maxAnimationPixels {
+			break
+		}
+		frames = append(frames, frame)
+		delays = append(delays, gifDelay(g.Delay[i]))
+	}
+
+	// gif loop counts are the number of repeats, with -1 for none
+	switch {
+	case g.LoopCount < 0:
+		loopCount = 1
+	case g.LoopCount > 0:
+		loopCount = g.LoopCount + 1
+	}
+	return frames, delays, loopCount, nil
+}
+
+// gifDelay returns the gif frame delay d, in hundredths of a second, in
+// milliseconds.  Like browsers, delays under 20 milliseconds are taken as 100
+// milliseconds.
+func gifDelay(d int) int {
+	if d < 2 {
+		return 100
+	}
+	return d * 10
+}
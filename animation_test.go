@@ -0,0 +1,263 @@
+package imageproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"reflect"
+	"testing"
+)
+
+// newGIF returns an animated gif of a black 4x1 frame followed by a white
+// pixel at x=1, restored to the previous frame afterwards, and a white pixel
+// at x=2, cleared afterwards.
+func newGIF() []byte {
+	palette := color.Palette{color.Black, color.White}
+	frames := []*image.Paletted{
+		image.NewPaletted(image.Rect(0, 0, 4, 1), palette),
+		image.NewPaletted(image.Rect(1, 0, 2, 1), palette),
+		image.NewPaletted(image.Rect(2, 0, 3, 1), palette),
+	}
+	frames[1].Pix[0] = 1
+	frames[2].Pix[0] = 1
+
+	buf := new(bytes.Buffer)
+	gif.EncodeAll(buf, &gif.GIF{
+		Image:     frames,
+		Delay:     []int{10, 50, 10},
+		Disposal:  []byte{gif.DisposalNone, gif.DisposalPrevious, gif.DisposalBackground},
+		LoopCount: 3,
+	})
+	return buf.Bytes()
+}
+
+// grays returns the gray levels of the pixels of the first row of m.
+func grays(m image.Image) []uint8 {
+	var g []uint8
+	for x := m.Bounds().Min.X; x < m.Bounds().Max.X; x++ {
+		g = append(g, color.GrayModel.Convert(m.At(x, m.Bounds().Min.Y)).(color.Gray).Y)
+	}
+	return g
+}
+
+func TestGIFFrame(t *testing.T) {
+	img := newGIF()
+	tests := []struct {
+		n    int
+		want []uint8
+	}{
+		{0, []uint8{0, 0, 0, 0}},
+		{1, []uint8{0, 0, 0, 0}},
+		{2, []uint8{0, 255, 0, 0}},
+		{3, []uint8{0, 0, 255, 0}},
+		{4, []uint8{0, 0, 255, 0}},
+	}
+	for _, tt := range tests {
+		m, err := gifFrame(img, tt.n)
+		if err != nil {
+			t.Errorf("gifFrame(%d) returned error: %v", tt.n, err)
+			continue
+		}
+		if got := grays(m); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("gifFrame(%d) returned %v, want %v", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestTruncateGIF(t *testing.T) {
+	img := newGIF()
+	tests := []struct {
+		maxFrames   int
+		maxDuration float64
+		frames      int
+	}{
+		{0, 0, 3},
+		{2, 0, 2},
+		{1, 0, 1},
+		{0, 0.5, 2},
+		{0, 0.05, 1},
+		{0, 1, 3},
+	}
+	for _, tt := range tests {
+		b, err := truncateGIF(img, tt.maxFrames, tt.maxDuration)
+		if err != nil {
+			t.Errorf("truncateGIF(%d, %v) returned error: %v", tt.maxFrames, tt.maxDuration, err)
+			continue
+		}
+		g, err := gif.DecodeAll(bytes.NewReader(b))
+		if err != nil {
+			t.Errorf("error decoding truncateGIF(%d, %v) output: %v", tt.maxFrames, tt.maxDuration, err)
+			continue
+		}
+		if len(g.Image) != tt.frames || len(g.Delay) != tt.frames {
+			t.Errorf("truncateGIF(%d, %v) returned %d frames, want %d", tt.maxFrames, tt.maxDuration, len(g.Image), tt.frames)
+		}
+		if tt.frames > 1 && g.LoopCount != 3 {
+			t.Errorf("truncateGIF(%d, %v) returned loop count %d, want 3", tt.maxFrames, tt.maxDuration, g.LoopCount)
+		}
+	}
+}
+
+func TestGIFFrames(t *testing.T) {
+	img := newGIF()
+	var calls int
+	fn := func(m image.Image) image.Image {
+		calls++
+		return m
+	}
+	frames, delays, loopCount, err := gifFrames(img, 0, 0, fn)
+	if err != nil {
+		t.Fatalf("gifFrames returned error: %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("gifFrames called fn %d times, want 3", calls)
+	}
+	want := [][]uint8{{0, 0, 0, 0}, {0, 255, 0, 0}, {0, 0, 255, 0}}
+	var got [][]uint8
+	for _, m := range frames {
+		got = append(got, grays(m))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("gifFrames returned frames %v, want %v", got, want)
+	}
+	if want := []int{100, 500, 100}; !reflect.DeepEqual(delays, want) {
+		t.Errorf("gifFrames returned delays %v, want %v", delays, want)
+	}
+	if loopCount != 4 {
+		t.Errorf("gifFrames returned loop count %d, want 4", loopCount)
+	}
+
+	frames, delays, _, err = gifFrames(img, 0, 0.5, fn)
+	if err != nil {
+		t.Fatalf("gifFrames returned error: %v", err)
+	}
+	if len(frames) != 2 || len(delays) != 2 {
+		t.Errorf("gifFrames with max duration returned %d frames, want 2", len(frames))
+	}
+
+	// frames are limited to a number of pixels, before and after fn
+	defer func(n int) { maxAnimationPixels = n }(maxAnimationPixels)
+	maxAnimationPixels = 8
+	frames, _, _, _ = gifFrames(img, 0, 0, fn)
+	if len(frames) != 2 {
+		t.Errorf("gifFrames with 8 pixels returned %d frames, want 2", len(frames))
+	}
+	maxAnimationPixels = 1
+	frames, _, _, _ = gifFrames(img, 0, 0, fn)
+	if len(frames) != 1 {
+		t.Errorf("gifFrames with 1 pixel returned %d frames, want 1", len(frames))
+	}
+	maxAnimationPixels = 12
+	frames, _, _, _ = gifFrames(img, 0, 0, func(m image.Image) image.Image {
+		return image.NewNRGBA(image.Rect(0, 0, 8, 1))
+	})
+	if len(frames) != 1 {
+		t.Errorf("gifFrames with 12 pixels of 8 pixel frames returned %d frames, want 1", len(frames))
+	}
+}
+
+func TestGIFDelay(t *testing.T) {
+	for _, tt := range []struct{ d, want int }{
+		{0, 100},
+		{1, 100},
+		{2, 20},
+		{10, 100},
+		{50, 500},
+	} {
+		if got := gifDelay(tt.d); got != tt.want {
+			t.Errorf("gifDelay(%d) returned %d, want %d", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestTransform_GIFAnimations(t *testing.T) {
+	img := newGIF()
+
+	// animated webp has a frame chunk per frame, and the loop count in
+	// the ANIM chunk
+	out, err := Transform(img, Options{Format: "webp", Width: 8, ScaleUp: true})
+	if err != nil {
+		t.Fatalf("Transform returned error: %v", err)
+	}
+	if n := bytes.Count(out, []byte("ANMF")); n != 3 {
+		t.Errorf("Transform to webp returned %d frames, want 3", n)
+	}
+	if i := bytes.Index(out, []byte("ANIM")); i < 0 {
+		t.Errorf("Transform to webp returned no ANIM chunk")
+	} else if n := binary.LittleEndian.Uint16(out[i+12:]); n != 4 {
+		t.Errorf("Transform to webp returned loop count %d, want 4", n)
+	}
+
+	// animated png shows the first frame to other decoders
+	out, err = Transform(img, Options{Format: "apng", Width: 8, ScaleUp: true, MaxFrames: 2})
+	if err != nil {
+		t.Fatalf("Transform returned error: %v", err)
+	}
+	if n := bytes.Count(out, []byte("fcTL")); n != 2 {
+		t.Errorf("Transform to apng returned %d frames, want 2", n)
+	}
+	m, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("error decoding transformed apng: %v", err)
+	}
+	if got := m.Bounds().Size(); got != image.Pt(8, 2) {
+		t.Errorf("Transform to apng returned size %v, want 8x2", got)
+	}
+
+	// a single frame is still a still
+	out, err = Transform(img, Options{Format: "apng", Frame: 2})
+	if err != nil {
+		t.Fatalf("Transform returned error: %v", err)
+	}
+	if bytes.Contains(out, []byte("acTL")) {
+		t.Errorf("Transform to apng with frame returned an animation")
+	}
+}
+
+func TestTransform_GIFStills(t *testing.T) {
+	img := newGIF()
+
+	// a single frame is a still gif
+	out, err := Transform(img, Options{Frame: 2})
+	if err != nil {
+		t.Fatalf("Transform returned error: %v", err)
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("error decoding transformed gif: %v", err)
+	}
+	if len(g.Image) != 1 {
+		t.Errorf("Transform with frame returned %d frames, want 1", len(g.Image))
+	} else if got, want := grays(g.Image[0]), []uint8{0, 255, 0, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Transform with frame returned %v, want %v", got, want)
+	}
+
+	// other formats are stills as well
+	out, err = Transform(img, Options{Format: "png", Frame: 3})
+	if err != nil {
+		t.Fatalf("Transform returned error: %v", err)
+	}
+	m, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("error decoding transformed png: %v", err)
+	}
+	if got, want := grays(m), []uint8{0, 0, 255, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Transform to png returned %v, want %v", got, want)
+	}
+
+	// animations are cut to the limits
+	out, err = Transform(img, Options{MaxFrames: 2})
+	if err != nil {
+		t.Fatalf("Transform returned error: %v", err)
+	}
+	g, err = gif.DecodeAll(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("error decoding transformed gif: %v", err)
+	}
+	if len(g.Image) != 2 {
+		t.Errorf("Transform with max frames returned %d frames, want 2", len(g.Image))
+	}
+}
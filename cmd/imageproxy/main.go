@@ -36,6 +36,8 @@ var baseURLConfURL = flag.String("baseURLConfURL", "", "location of json object
 var cache tieredCache
 var signatureKey = flag.String("signatureKey", "", "HMAC key used in calculating request signatures")
 var scaleUp = flag.Bool("scaleUp", false, "allow images to scale beyond their original dimensions")
+var clientHints = flag.Bool("clientHints", false, "size images using client hint request headers")
+var fontDir = flag.String("fontDir", "", "directory of TrueType fonts for text drawn on images")
 var timeout = flag.Duration("timeout", 0, "time limit for requests served by this proxy")
 var verbose = flag.Bool("verbose", false, "print verbose logging messages")
 var version = flag.Bool("version", false, "Deprecated: this flag does nothing")
@@ -108,8 +110,18 @@ func main() {
 
 	}
 
+	if *fontDir != "" {
+		if err := p.LoadFonts(*fontDir); err != nil {
+			logger.Fatalw("Could not load fonts",
+				"fontDir", *fontDir,
+				"error", err.Error(),
+			)
+		}
+	}
+
 	p.Timeout = *timeout
 	p.ScaleUp = *scaleUp
+	p.ClientHints = *clientHints
 
 	server := &http.Server{
 		Addr:    *addr,
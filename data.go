@@ -1,22 +1,33 @@
 package imageproxy
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
+
+	"github.com/richiefi/imageproxy/third_party/jpeg"
 )
 
 const (
 	optFit             = "fit"
+	optFitModePrefix   = "fit-"
 	optFlipVertical    = "fv"
 	optFlipHorizontal  = "fh"
 	optFormatJPEG      = "jpeg"
 	optFormatPNG       = "png"
 	optFormatTIFF      = "tiff"
+	optFormatWebP      = "webp"
+	optFormatAPNG      = "apng"
+	optFormatAuto      = "auto"
+	optAcceptWebP      = "acceptwebp"
+	optLossless        = "lossless"
 	optRotatePrefix    = "r"
 	optQualityPrefix   = "q"
 	optSignaturePrefix = "s"
@@ -27,6 +38,156 @@ const (
 	optCropWidth       = "cw"
 	optCropHeight      = "ch"
 	optSmartCrop       = "sc"
+	optDPRPrefix       = "dpr"
+	optFocalX          = "fpx"
+	optFocalY          = "fpy"
+	optFocalZoom       = "fpz"
+	optCropModePrefix  = "crop-"
+	optBackground      = "bg"
+	optFilterPrefix    = "filter-"
+	optBlurPrefix      = "blur"
+	optSharpenPrefix   = "sharp"
+	optUnsharpAmount   = "usma"
+	optUnsharpRadius   = "usmr"
+	optUnsharpThresh   = "usmt"
+	optBrightness      = "bri"
+	optContrast        = "con"
+	optSaturation      = "sat"
+	optHue             = "hue"
+	optGamma           = "gam"
+	optExposure        = "exp"
+	optMono            = "mono"
+	optSepia           = "sepia"
+	optInvert          = "invert"
+	optDuotone         = "duotone"
+	optPixelate        = "px"
+	optMarkPrefix      = "mark-"
+	optMarkPosPrefix   = "markpos-"
+	optMarkScale       = "markscale"
+	optMarkAlpha       = "markalpha"
+	optMarkPad         = "markpad"
+	optTextPrefix      = "txt-"
+	optTextSize        = "txtsize"
+	optTextColor       = "txtcolor"
+	optTextFontPrefix  = "txtfont-"
+	optTextAlignPrefix = "txtalign-"
+	optTextPad         = "txtpad"
+	optTextShadow      = "txtshadow"
+	optMaskEllipse     = "maskellipse"
+	optMaskPrefix      = "mask-"
+	optCornerRadius    = "corner"
+	optTrimPrefix      = "trim"
+	optTrimTolerance   = "trimtol"
+	optBorderPrefix    = "border"
+	optBorderRadius    = "borderradius"
+	optBorderOutside   = "borderout"
+	optAspectRatio     = "ar"
+	optMaxWidth        = "maxw"
+	optMaxHeight       = "maxh"
+	optMinWidth        = "minw"
+	optMinHeight       = "minh"
+	optMaxBytes        = "maxbytes"
+	optChromaPrefix    = "chroma"
+	optBaseline        = "baseline"
+	optNoOptimize      = "noopt"
+	optNoTrellis       = "notrellis"
+	optJPEGQuantPrefix = "jquant-"
+	optColors          = "colors"
+	optDither          = "dither"
+	optPNGLevelPrefix  = "pnglevel-"
+	optPNGOptimize     = "pngopt"
+	optFrame           = "frame"
+	optMaxFrames       = "maxframes"
+	optMaxDuration     = "maxdur"
+)
+
+// Fit modes, which decide how an image is resized to a width and a height.
+const (
+	fitClip  = "clip"  // fit inside, scaling up only if allowed
+	fitCrop  = "crop"  // fill and crop, scaling up only if allowed
+	fitScale = "scale" // stretch, ignoring the aspect ratio
+	fitMax   = "max"   // fit inside, never scaling up
+	fitMin   = "min"   // fill and crop, never scaling up
+	fitFill  = "fill"  // fit inside and pad to the exact size
+)
+
+// Crop modes other than anchors.
+const (
+	cropEntropy = "entropy"
+)
+
+// monoGray is the monochrome effect that turns images to grayscale, rather
+// than tinting them with a color.
+const monoGray = "gray"
+
+// Text options: the largest font size in pixels, and the shadow color of
+// txt-shadow=true.
+const (
+	maxTextSize       = 1000
+	defaultTextShadow = "00000080"
+)
+
+// Limits of the stylization options.
+const (
+	maxSepia    = 100
+	maxPixelate = 100
+)
+
+// backgroundBlur is the background of padded images that uses a blurred copy
+// of the image instead of a color.
+const backgroundBlur = "blur"
+
+// maskEllipse is the mask that cuts images to the ellipse inscribed in them,
+// rather than to the alpha of a mask image.
+const maskEllipse = "ellipse"
+
+// trimAuto is the trim mode that removes borders of the color of the top left
+// pixel, rather than of a given color.
+const trimAuto = "auto"
+
+// maxTrimTolerance is the largest difference of a color channel, in levels,
+// from the border color of trimmed pixels.
+const maxTrimTolerance = 255
+
+// Border options: the widest border in pixels, and the border color when none
+// is given.
+const (
+	maxBorderWidth     = 1000
+	defaultBorderColor = "000000ff"
+)
+
+// Limits of the blur and sharpen options.
+const (
+	maxBlur             = 100
+	maxSharpen          = 100
+	maxUnsharpAmount    = 500
+	maxUnsharpRadius    = 100
+	maxUnsharpThreshold = 255
+)
+
+// Limits of the color adjustment options.  Brightness, contrast and
+// saturation range from -100 to 100.
+const (
+	maxColorAdjustment = 100
+	maxHue             = 360
+	maxGamma           = 10
+	maxExposure        = 5
+)
+
+// Range of supported device pixel ratios.
+const (
+	minDPR = 1
+	maxDPR = 5
+)
+
+// maxDimension is the largest width or height, in pixels, of transformed
+// images, which is also the limit of the jpeg and webp formats.
+const maxDimension = 1 << 14
+
+// Range of supported aspect ratios.
+const (
+	minAspectRatio = 0.01
+	maxAspectRatio = 100
 )
 
 // URLError reports a malformed URL error.
@@ -47,13 +208,16 @@ type Options struct {
 	Width  float64 `json:"width"`
 	Height float64 `json:"height"`
 
-	// If true, resize the image to fit in the specified dimensions.  Image
-	// will not be cropped, and aspect ratio will be maintained.
-	Fit bool `json:"fit"`
+	// How to resize the image to the specified width and height: "clip",
+	// "crop", "scale", "max", "min" or "fill".  Empty means "crop".  The
+	// legacy "fit": true of default options is read as "clip", the mode of
+	// the boolean option it replaced.
+	FitMode string `json:"fit_mode"`
 
-	// Rotate image the specified degrees counter-clockwise.  Valid values
-	// are 90, 180, 270.
-	Rotate int `json:"rotate"`
+	// Rotate image the specified degrees counter-clockwise.  Angles other
+	// than multiples of 90 expand the image to fit, and fill the corners
+	// with Background.
+	Rotate float64 `json:"rotate"`
 
 	FlipVertical   bool `json:"flip_vertical"`
 	FlipHorizontal bool `json:"flip_horizontal"`
@@ -61,6 +225,11 @@ type Options struct {
 	// Quality of output image
 	Quality int `json:"quality"`
 
+	// Size budget of jpeg and lossy webp images in bytes.  The highest
+	// quality up to Quality that fits is used, and the image is shrunk if
+	// even low qualities do not fit.
+	MaxBytes int `json:"max_bytes"`
+
 	// HMAC Signature for signed requests.
 	Signature string `json:"signature"`
 
@@ -68,9 +237,60 @@ type Options struct {
 	// will always be overwritten by the value of Proxy.ScaleUp.
 	ScaleUp bool `json:"scale_up"`
 
-	// Desired image format. Valid values are "jpeg", "png", "tiff".
+	// Desired image format. Valid values are "jpeg", "png", "tiff", "webp",
+	// "apng" and "auto".  See NewRequest for how "auto" is negotiated.
 	Format string `json:"format"`
 
+	// Set by NewRequest for the "auto" format if the client accepts webp
+	// images, which are then used for all but gif sources.
+	AcceptWebP bool `json:"-"`
+
+	// Encode webp images losslessly.  Quality is ignored for lossless images.
+	Lossless bool `json:"lossless"`
+
+	// Chroma subsampling of jpeg images: "444", "422" or "420".  By default
+	// chroma is subsampled 4:2:0 only below quality 80.
+	Subsampling string `json:"subsampling"`
+
+	// Encode jpeg images as baseline rather than progressive jpegs.
+	Baseline bool `json:"baseline"`
+
+	// Skip optimizing the Huffman tables of jpeg images, which makes them
+	// faster to encode but larger.
+	NoOptimize bool `json:"no_optimize"`
+
+	// Turn off the trellis quantization of jpeg images.  Requires mozjpeg.
+	NoTrellis bool `json:"no_trellis"`
+
+	// Quantization table preset of jpeg images, by name: "annex-k", "flat",
+	// "ms-ssim", "imagemagick", "psnr-hvs", "klein", "watson", "ahumada" or
+	// "peterson".  Empty means the default of the library.  Requires mozjpeg.
+	JPEGQuant string `json:"jpeg_quant"`
+
+	// Number of colors, from 2 to 256, of the palette png images are
+	// quantized to, with Floyd-Steinberg dithering if Dither is set.  0
+	// keeps full color.
+	Colors int  `json:"colors"`
+	Dither bool `json:"dither"`
+
+	// Compression level of png images: "none", "fast", "default" or
+	// "best", the default.
+	PNGLevel string `json:"png_level"`
+
+	// Encode png images both with and without a palette, and keep the
+	// smaller.  Without Colors, the palette is only used for images that
+	// have at most 256 colors, so no colors are lost.
+	PNGOptimize bool `json:"png_optimize"`
+
+	// Frame of animated gifs, numbered from 1, to return as a still image.
+	// 0 keeps the animation.
+	Frame int `json:"frame"`
+
+	// Limits of the number of frames of animated gifs, and of the time in
+	// seconds by which the frames kept start.  0 sets no limit.
+	MaxFrames   int     `json:"max_frames"`
+	MaxDuration float64 `json:"max_duration"`
+
 	// Crop rectangle params
 	CropX      float64 `json:"crop_x"`
 	CropY      float64 `json:"crop_y"`
@@ -79,11 +299,196 @@ type Options struct {
 
 	// Automatically find good crop points based on image content.
 	SmartCrop bool `json:"smart_crop"`
+
+	// Trim uniform borders before cropping: "auto" for borders of the color
+	// of the top left pixel, or the border color as 8 hexadecimal digits in
+	// RGBA order.
+	Trim string `json:"trim"`
+
+	// Largest difference in levels of any color channel from the border
+	// color of pixels that are trimmed.
+	TrimTolerance float64 `json:"trim_tol"`
+
+	// Aspect ratio, width divided by height, that derives a missing width
+	// or height from the other.  Without either, the image is cropped to it.
+	AspectRatio float64 `json:"ar"`
+
+	// Limits of the output width and height in pixels, applied after any
+	// device pixel ratio regardless of the requested size.  The image is
+	// scaled to them keeping its aspect ratio, and maximums win over
+	// minimums.  Zero values set no limit.
+	MaxWidth  int `json:"max_w"`
+	MaxHeight int `json:"max_h"`
+	MinWidth  int `json:"min_w"`
+	MinHeight int `json:"min_h"`
+
+	// Device pixel ratio the image is displayed at.  Width, Height and crop
+	// values given in pixels are multiplied by it.  Valid values are from 1
+	// to 5, 0 means no ratio was requested.
+	DPR float64 `json:"dpr"`
+
+	// Focal point to keep in frame when cropping to fill the requested
+	// width and height, as fractions of the image width and height, if
+	// Focal is set.  Otherwise the center of the image is kept in frame.
+	// Focal is set by giving either coordinate.
+	Focal  bool    `json:"-"`
+	FocalX float64 `json:"fp_x"`
+	FocalY float64 `json:"fp_y"`
+
+	// Zoom factor around the focal point.  Values below 1 mean no zoom.
+	FocalZoom float64 `json:"fp_z"`
+
+	// How to crop the image when filling the requested width and height.
+	// Valid values are the anchors "top", "bottom", "left", "right",
+	// "top-left", "top-right", "bottom-left" and "bottom-right", and
+	// "entropy".
+	CropMode string `json:"crop_mode"`
+
+	// Background of padded images and of the corners of rotated images,
+	// either a color as 8 hexadecimal digits in RGBA order or "blur" (for
+	// padding only).  Empty means white for padding, and transparent for
+	// rotation when the output format supports it.
+	Background string `json:"bg"`
+
+	// Resampling filter used when resizing: "nearest", "box", "linear",
+	// "catmullrom", "lanczos" or "mitchell".  Empty means the default.
+	Filter string `json:"filter"`
+
+	// Standard deviation of a Gaussian blur applied after resizing.
+	Blur float64 `json:"blur"`
+
+	// Sharpen after resizing by an amount from 0 to 100, which is the same
+	// as an unsharp mask of that amount with radius 1 and threshold 0.
+	Sharpen float64 `json:"sharp"`
+
+	// Unsharp mask applied after resizing: amount in percent, radius as the
+	// standard deviation of the blur, and threshold in levels from 0 to
+	// 255.  Zero amount means no unsharp mask.
+	UnsharpAmount    float64 `json:"usm_amount"`
+	UnsharpRadius    float64 `json:"usm_radius"`
+	UnsharpThreshold float64 `json:"usm_threshold"`
+
+	// Color adjustments.  Brightness, contrast and saturation are
+	// percentages from -100 to 100, hue is a rotation in degrees from 0 to
+	// 360, gamma is a correction factor above 0 where 1 or 0 means no
+	// change, and exposure is in stops from -5 to 5.
+	Brightness float64 `json:"bri"`
+	Contrast   float64 `json:"con"`
+	Saturation float64 `json:"sat"`
+	Hue        float64 `json:"hue"`
+	Gamma      float64 `json:"gam"`
+	Exposure   float64 `json:"exp"`
+
+	// Monochrome effect: "gray" for grayscale, or a color as 8
+	// hexadecimal digits in RGBA order to tint the grayscale image with.
+	Mono string `json:"mono"`
+
+	// Strength of the sepia effect, from 0 to 100.
+	Sepia float64 `json:"sepia"`
+
+	// Invert the colors of the image.
+	Invert bool `json:"invert"`
+
+	// Duotone effect mapping shadows to DuotoneShadow and highlights to
+	// DuotoneHighlight, as 8 hexadecimal digits in RGBA order.  Both are
+	// empty for no duotone.
+	DuotoneShadow    string `json:"duotone_shadow"`
+	DuotoneHighlight string `json:"duotone_highlight"`
+
+	// Size of the blocks of a pixelated image, in pixels.
+	Pixelate int `json:"px"`
+
+	// Watermark composited onto the output.
+	Mark Mark `json:"mark"`
+
+	// Text drawn onto the output.
+	Text Text `json:"txt"`
+
+	// Mask of the output: "ellipse", or the absolute URL of an image whose
+	// alpha, or luminance if it is opaque, becomes the alpha of the output.
+	Mask string `json:"mask"`
+
+	// Radius of rounded corners in pixels, or as a fraction of the smaller
+	// output dimension if less than 1.
+	CornerRadius float64 `json:"corner_radius"`
+
+	// Border drawn around the output, with a width in pixels and a color as
+	// 8 hexadecimal digits in RGBA order.
+	BorderWidth int    `json:"border_width"`
+	BorderColor string `json:"border_color"`
+
+	// Radius of the outer corners of the border in pixels.  The image is
+	// transparent outside them.
+	BorderRadius float64 `json:"border_radius"`
+
+	// Draw the border outside the image, making it larger than requested,
+	// rather than over its edges.
+	BorderOutside bool `json:"border_outside"`
+}
+
+// Mark describes a watermark image composited onto the output image, after
+// all other transformations.
+type Mark struct {
+	// Absolute URL of the watermark image.  Empty means no watermark.
+	URL string `json:"url"`
+
+	// Position of the watermark: "center", or an anchor like those of
+	// Options.CropMode.  Empty means "bottom-right".
+	Pos string `json:"pos"`
+
+	// Width of the watermark as a fraction of the output width.  Zero
+	// means the natural size of the watermark.
+	Scale float64 `json:"scale"`
+
+	// Opacity of the watermark in percent.  Zero means opaque.
+	Alpha float64 `json:"alpha"`
+
+	// Distance of the watermark from the edges of the output, in pixels or
+	// as a fraction of the smaller output dimension.
+	Pad float64 `json:"pad"`
+}
+
+// Text describes a line of text drawn onto the output image, after all other
+// transformations but before the watermark.
+type Text struct {
+	// The text to draw.  Empty means no text.
+	Value string `json:"value"`
+
+	// Font size in pixels, or as a fraction of the output height if less
+	// than 1.  Zero means a tenth of the output height.  Text too wide for
+	// the image is made smaller to fit.
+	Size float64 `json:"size"`
+
+	// Text color as 8 hexadecimal digits in RGBA order.  Empty means white.
+	Color string `json:"color"`
+
+	// Name of the font, either a bundled font or one loaded from the font
+	// directory of the proxy.  Empty means the default font.
+	Font string `json:"font"`
+
+	// Position of the text, like Mark.Pos.  Empty means "bottom".
+	Align string `json:"align"`
+
+	// Distance of the text from the edges of the output, like Mark.Pad.
+	Pad float64 `json:"pad"`
+
+	// Color of a drop shadow behind the text, in the format of Color.
+	// Empty means no shadow.
+	Shadow string `json:"shadow"`
 }
 
 type SourceConfiguration struct {
 	BaseURL        *url.URL
 	DefaultOptions Options
+
+	// Mark, if its URL is set, is the watermark of every image of the
+	// prefix.  Request options cannot change or remove it.
+	Mark Mark
+
+	// MaxWidth and MaxHeight, if set, cap the output size of every image
+	// of the prefix in pixels.  Requests can only lower them.
+	MaxWidth  int
+	MaxHeight int
 }
 
 func (conf *SourceConfiguration) UnmarshalJSON(bytes []byte) error {
@@ -94,6 +499,9 @@ func (conf *SourceConfiguration) UnmarshalJSON(bytes []byte) error {
 	var confWithString struct {
 		BaseURL        string  `json:"base_url"`
 		DefaultOptions Options `json:"default_options"`
+		Mark           Mark    `json:"mark"`
+		MaxWidth       int     `json:"max_width"`
+		MaxHeight      int     `json:"max_height"`
 	}
 	err := json.Unmarshal(bytes, &confWithString)
 	if err != nil {
@@ -106,16 +514,52 @@ func (conf *SourceConfiguration) UnmarshalJSON(bytes []byte) error {
 
 	conf.BaseURL = baseURL
 	conf.DefaultOptions = confWithString.DefaultOptions
+	conf.Mark = confWithString.Mark
+	conf.MaxWidth = confWithString.MaxWidth
+	conf.MaxHeight = confWithString.MaxHeight
+	return nil
+}
+
+// UnmarshalJSON unmarshals options, setting the focal point if either of its
+// coordinates is given.  A missing coordinate is the center of the image.
+// The legacy "fit" key is accepted when "fit_mode" is not given.
+func (o *Options) UnmarshalJSON(b []byte) error {
+	// options has the fields of Options without this method
+	type options Options
+	var raw struct {
+		options
+		FocalX *float64 `json:"fp_x"`
+		FocalY *float64 `json:"fp_y"`
+		Fit    bool     `json:"fit"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	*o = Options(raw.options)
+	if raw.Fit && o.FitMode == "" {
+		o.FitMode = fitClip
+	}
+	if raw.FocalX != nil || raw.FocalY != nil {
+		o.Focal = true
+		o.FocalX, o.FocalY = 0.5, 0.5
+		if raw.FocalX != nil {
+			o.FocalX = *raw.FocalX
+		}
+		if raw.FocalY != nil {
+			o.FocalY = *raw.FocalY
+		}
+	}
 	return nil
 }
 
 func (o Options) String() string {
 	opts := []string{fmt.Sprintf("%v%s%v", o.Width, optSizeDelimiter, o.Height)}
-	if o.Fit {
-		opts = append(opts, optFit)
+	if o.FitMode != "" {
+		opts = append(opts, optFitModePrefix+o.FitMode)
 	}
 	if o.Rotate != 0 {
-		opts = append(opts, fmt.Sprintf("%s%d", string(optRotatePrefix), o.Rotate))
+		opts = append(opts, fmt.Sprintf("%s%v", string(optRotatePrefix), o.Rotate))
 	}
 	if o.FlipVertical {
 		opts = append(opts, optFlipVertical)
@@ -126,6 +570,9 @@ func (o Options) String() string {
 	if o.Quality != 0 {
 		opts = append(opts, fmt.Sprintf("%s%d", string(optQualityPrefix), o.Quality))
 	}
+	if o.MaxBytes != 0 {
+		opts = append(opts, fmt.Sprintf("%s%d", optMaxBytes, o.MaxBytes))
+	}
 	if o.Signature != "" {
 		opts = append(opts, fmt.Sprintf("%s%s", string(optSignaturePrefix), o.Signature))
 	}
@@ -135,6 +582,48 @@ func (o Options) String() string {
 	if o.Format != "" {
 		opts = append(opts, o.Format)
 	}
+	if o.AcceptWebP {
+		opts = append(opts, optAcceptWebP)
+	}
+	if o.Lossless {
+		opts = append(opts, optLossless)
+	}
+	if o.Subsampling != "" {
+		opts = append(opts, optChromaPrefix+o.Subsampling)
+	}
+	if o.Baseline {
+		opts = append(opts, optBaseline)
+	}
+	if o.NoOptimize {
+		opts = append(opts, optNoOptimize)
+	}
+	if o.NoTrellis {
+		opts = append(opts, optNoTrellis)
+	}
+	if o.JPEGQuant != "" {
+		opts = append(opts, optJPEGQuantPrefix+o.JPEGQuant)
+	}
+	if o.Colors != 0 {
+		opts = append(opts, fmt.Sprintf("%s%d", optColors, o.Colors))
+	}
+	if o.Dither {
+		opts = append(opts, optDither)
+	}
+	if o.PNGLevel != "" {
+		opts = append(opts, optPNGLevelPrefix+o.PNGLevel)
+	}
+	if o.PNGOptimize {
+		opts = append(opts, optPNGOptimize)
+	}
+	if o.Frame != 0 {
+		opts = append(opts, fmt.Sprintf("%s%d", optFrame, o.Frame))
+	}
+	if o.MaxFrames != 0 {
+		opts = append(opts, fmt.Sprintf("%s%d", optMaxFrames, o.MaxFrames))
+	}
+	if o.MaxDuration != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optMaxDuration, o.MaxDuration))
+	}
 	if o.CropX != 0 {
 		opts = append(opts, fmt.Sprintf("%s%v", string(optCropX), o.CropX))
 	}
@@ -150,15 +639,196 @@ func (o Options) String() string {
 	if o.SmartCrop {
 		opts = append(opts, optSmartCrop)
 	}
+	if o.Trim != "" {
+		opts = append(opts, optTrimPrefix+o.Trim)
+	}
+	if o.TrimTolerance != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optTrimTolerance, o.TrimTolerance))
+	}
+	if o.AspectRatio != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optAspectRatio, o.AspectRatio))
+	}
+	if o.MaxWidth != 0 {
+		opts = append(opts, fmt.Sprintf("%s%d", optMaxWidth, o.MaxWidth))
+	}
+	if o.MaxHeight != 0 {
+		opts = append(opts, fmt.Sprintf("%s%d", optMaxHeight, o.MaxHeight))
+	}
+	if o.MinWidth != 0 {
+		opts = append(opts, fmt.Sprintf("%s%d", optMinWidth, o.MinWidth))
+	}
+	if o.MinHeight != 0 {
+		opts = append(opts, fmt.Sprintf("%s%d", optMinHeight, o.MinHeight))
+	}
+	if o.DPR != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optDPRPrefix, o.DPR))
+	}
+	if o.Focal {
+		opts = append(opts, fmt.Sprintf("%s%v", optFocalX, o.FocalX))
+		opts = append(opts, fmt.Sprintf("%s%v", optFocalY, o.FocalY))
+	}
+	if o.FocalZoom != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optFocalZoom, o.FocalZoom))
+	}
+	if o.CropMode != "" {
+		opts = append(opts, optCropModePrefix+o.CropMode)
+	}
+	if o.Background != "" {
+		opts = append(opts, optBackground+o.Background)
+	}
+	if o.Filter != "" {
+		opts = append(opts, optFilterPrefix+o.Filter)
+	}
+	if o.Exposure != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optExposure, o.Exposure))
+	}
+	if o.Brightness != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optBrightness, o.Brightness))
+	}
+	if o.Contrast != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optContrast, o.Contrast))
+	}
+	if o.Gamma != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optGamma, o.Gamma))
+	}
+	if o.Saturation != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optSaturation, o.Saturation))
+	}
+	if o.Hue != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optHue, o.Hue))
+	}
+	if o.Mono != "" {
+		opts = append(opts, optMono+o.Mono)
+	}
+	if o.Sepia != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optSepia, o.Sepia))
+	}
+	if o.DuotoneShadow != "" {
+		opts = append(opts, optDuotone+o.DuotoneShadow+"-"+o.DuotoneHighlight)
+	}
+	if o.Invert {
+		opts = append(opts, optInvert)
+	}
+	if o.Pixelate > 1 {
+		opts = append(opts, fmt.Sprintf("%s%d", optPixelate, o.Pixelate))
+	}
+	if o.Blur != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optBlurPrefix, o.Blur))
+	}
+	if o.Sharpen != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optSharpenPrefix, o.Sharpen))
+	}
+	if o.UnsharpAmount != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optUnsharpAmount, o.UnsharpAmount))
+		opts = append(opts, fmt.Sprintf("%s%v", optUnsharpRadius, o.UnsharpRadius))
+		opts = append(opts, fmt.Sprintf("%s%v", optUnsharpThresh, o.UnsharpThreshold))
+	}
+	if o.Text.Value != "" {
+		// text may contain commas, which separate options
+		opts = append(opts, optTextPrefix+base64.RawURLEncoding.EncodeToString([]byte(o.Text.Value)))
+	}
+	if o.Text.Size != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optTextSize, o.Text.Size))
+	}
+	if o.Text.Color != "" {
+		opts = append(opts, optTextColor+o.Text.Color)
+	}
+	if o.Text.Font != "" {
+		opts = append(opts, optTextFontPrefix+o.Text.Font)
+	}
+	if o.Text.Align != "" {
+		opts = append(opts, optTextAlignPrefix+o.Text.Align)
+	}
+	if o.Text.Pad != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optTextPad, o.Text.Pad))
+	}
+	if o.Text.Shadow != "" {
+		opts = append(opts, optTextShadow+o.Text.Shadow)
+	}
+	if o.Mark.URL != "" {
+		// URLs may contain commas, which separate options
+		opts = append(opts, optMarkPrefix+base64.RawURLEncoding.EncodeToString([]byte(o.Mark.URL)))
+	}
+	if o.Mark.Pos != "" {
+		opts = append(opts, optMarkPosPrefix+o.Mark.Pos)
+	}
+	if o.Mark.Scale != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optMarkScale, o.Mark.Scale))
+	}
+	if o.Mark.Alpha != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optMarkAlpha, o.Mark.Alpha))
+	}
+	if o.Mark.Pad != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optMarkPad, o.Mark.Pad))
+	}
+	if o.Mask == maskEllipse {
+		opts = append(opts, optMaskEllipse)
+	} else if o.Mask != "" {
+		opts = append(opts, optMaskPrefix+base64.RawURLEncoding.EncodeToString([]byte(o.Mask)))
+	}
+	if o.CornerRadius != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optCornerRadius, o.CornerRadius))
+	}
+	if o.BorderWidth != 0 {
+		opts = append(opts, fmt.Sprintf("%s%d-%s", optBorderPrefix, o.BorderWidth, o.BorderColor))
+	}
+	if o.BorderRadius != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optBorderRadius, o.BorderRadius))
+	}
+	if o.BorderOutside {
+		opts = append(opts, optBorderOutside)
+	}
 	return strings.Join(opts, ",")
 }
 
 // transform returns whether o includes transformation options.  Some fields
 // are not transform related at all (like Signature), and others only apply in
-// the presence of other fields (like Fit).  A non-empty Format value is
+// the presence of other fields (like FitMode).  A non-empty Format value is
 // assumed to involve a transformation.
 func (o Options) transform() bool {
-	return o.Width != 0 || o.Height != 0 || o.Rotate != 0 || o.FlipHorizontal || o.FlipVertical || o.Quality != 0 || o.Format != "" || o.CropX != 0 || o.CropY != 0 || o.CropWidth != 0 || o.CropHeight != 0
+	return o.Width != 0 || o.Height != 0 || o.Rotate != 0 || o.FlipHorizontal || o.FlipVertical || o.Quality != 0 || o.Format != "" || o.CropX != 0 || o.CropY != 0 || o.CropWidth != 0 || o.CropHeight != 0 ||
+		o.Blur != 0 || o.Sharpen != 0 || o.UnsharpAmount != 0 ||
+		o.Brightness != 0 || o.Contrast != 0 || o.Saturation != 0 || o.Hue != 0 || o.Gamma != 0 || o.Exposure != 0 ||
+		o.Mono != "" || o.Sepia != 0 || o.Invert || o.DuotoneShadow != "" || o.Pixelate > 1 ||
+		o.Text.Value != "" || o.Mark.URL != "" || o.masked() || o.Trim != "" || o.BorderWidth != 0 ||
+		o.AspectRatio != 0 || o.MaxBytes != 0 || o.Subsampling != "" || o.Baseline || o.NoOptimize || o.NoTrellis || o.JPEGQuant != "" ||
+		o.Colors != 0 || o.PNGLevel != "" || o.PNGOptimize || o.Frame != 0 || o.MaxFrames != 0 || o.MaxDuration != 0 || o.MaxWidth != 0 || o.MaxHeight != 0 || o.MinWidth != 0 || o.MinHeight != 0
+}
+
+// masked returns whether o makes parts of the image transparent with a mask
+// or rounded corners, including those of a border.
+func (o Options) masked() bool {
+	return o.Mask != "" || o.CornerRadius > 0 || o.BorderWidth > 0 && o.BorderRadius > 0
+}
+
+// arbitraryRotation returns whether o rotates the image by an angle that is
+// not a multiple of 90 degrees.
+func (o Options) arbitraryRotation() bool {
+	return math.Mod(o.Rotate, 90) != 0
+}
+
+// validate reports combinations of options that cannot be honored.
+func (o Options) validate() error {
+	if o.arbitraryRotation() && o.Background == backgroundBlur {
+		return errors.New("bg=blur cannot fill the corners of rotated images")
+	}
+	if o.MinWidth > maxDimension || o.MinHeight > maxDimension || o.MaxWidth > maxDimension || o.MaxHeight > maxDimension {
+		return fmt.Errorf("size limits cannot exceed %d pixels", maxDimension)
+	}
+	if (o.NoTrellis || o.JPEGQuant != "") && !jpeg.ExtensionsSupported {
+		return errors.New("jpeg-trellis and jpeg-quant are not supported without mozjpeg")
+	}
+	if c, err := strconv.ParseUint(o.Background, 16, 32); err == nil && c&0xff != 0xff &&
+		o.Format == optFormatJPEG && (o.arbitraryRotation() || o.FitMode == fitFill) {
+		return errors.New("transparent bg is not supported in jpeg format")
+	}
+	return nil
+}
+
+// scaleUp returns whether the image may be resized larger than the original,
+// which the max and min fit modes never do.
+func (o Options) scaleUp() bool {
+	return o.ScaleUp && o.FitMode != fitMax && o.FitMode != fitMin
 }
 
 // ParseFormValues parses a url.Values to transformation options.
@@ -183,6 +853,36 @@ func (o Options) transform() bool {
 // crop width or height will be adjusted, preserving the specified cx and cy
 // values.  Rectangular crop is applied before any other transformations.
 //
+// Trim
+//
+// 	trim=auto
+// 	trim={color}
+// 	trim-tol={tolerance}
+//
+// The "trim" option removes uniform borders from the image before any other
+// crop, which then applies to the remaining content.  With "auto", the border
+// color is that of the top left pixel.  Pixels are part of the border while
+// no channel differs from the border color by more than the tolerance, from 0
+// to 255 levels (default: 0).  Fully transparent pixels match each other
+// regardless of their color.  Every frame of an animated GIF is trimmed by the
+// borders of its first frame.
+//
+// Crop Modes
+//
+// 	crop={anchor}
+// 	crop=entropy
+//
+// When the image is cropped to fill the requested width and height (see Size
+// and Cropping below), it is cropped around the center by default.  An anchor
+// keeps an edge or a corner of the image instead: "top", "bottom", "left",
+// "right", or a combination of a vertical and a horizontal edge like
+// "top,left".  Anchors take precedence over the focal point on their axis.
+// Unless mode=fit is also given, a crop mode selects cropping instead of the
+// default fit.
+//
+// The "entropy" mode keeps the part of the image with the most detail, by
+// repeatedly trimming whichever edge has the lower entropy.
+//
 // Smart Crop
 //
 // 	mode=smartcrop
@@ -191,6 +891,24 @@ func (o Options) transform() bool {
 // requested image width and height dimensions (see Size and Cropping below).
 // The smart crop option will override any requested rectangular crop.
 //
+// Focal Point
+//
+// 	fp-x={x}&fp-y={y}&fp-z={zoom}
+//
+// 	x    - horizontal position of the focal point, from 0 (left) to 1 (right)
+// 	y    - vertical position of the focal point, from 0 (top) to 1 (bottom)
+// 	zoom - zoom factor around the focal point, 1 or more (default: 1)
+//
+// When the image is cropped to fill the requested width and height (see Size
+// and Cropping below), the crop is centered on the focal point instead of the
+// center of the image, as far as the image edges allow.  Like crop anchors, a
+// focal point selects cropping when both width and height are given without a
+// fit mode, instead of the default "fit=clip", whether it is given in the
+// request or in the default options.  A coordinate that is omitted
+// defaults to the center.  Zooming never scales the image beyond its
+// original size, unless scaling up is allowed.  The focal point can also be
+// given in the default options of a prefix, as "fp_x", "fp_y" and "fp_z".
+//
 // Size and Cropping
 //
 //	width={width}&height={height}
@@ -204,9 +922,34 @@ func (o Options) transform() bool {
 //
 // If a single size is provided, it will override both width and height.
 //
+//	ar={width}:{height}
+//	ar={ratio}
+//
+// An aspect ratio, like "ar=16:9" or "ar=1.5", derives the height from the
+// width or the width from the height when only one is given, after any device
+// pixel ratio is applied.  The image is then cropped to the ratio, or resized to
+// fit or fill it with the corresponding fit modes.  Without either width or
+// height, the image is cropped to the ratio at the largest size that fits.
+// The ratio is ignored when both width and height are given.  Unless scaling
+// up is allowed, both dimensions are reduced by the same factor to fit the
+// image, like with "fit=min".
+//
+//	max-w={width}
+//	max-h={height}
+//	min-w={width}
+//	min-h={height}
+//
+// Size limits, in pixels, clamp the size the image is resized to, whatever
+// width, height or device pixel ratio was requested.  The image is scaled to
+// the limits keeping its aspect ratio, but not larger than the original for
+// the minimums unless scaling up is allowed.  Maximums win over minimums, and
+// apply to the output after rotation and outside borders.  Limits over 16384
+// pixels, the largest size images are output at, are rejected.
+//
 // Depending on the size options specified, an image may be cropped to fit the
 // requested size. In all cases, the original aspect ratio of the image will be
-// preserved; imageproxy will never stretch the original image.
+// preserved; imageproxy will never stretch the original image unless the
+// "fit=scale" option is given.
 //
 // When no explicit crop mode is specified, the following rules are followed:
 //
@@ -223,10 +966,180 @@ func (o Options) transform() bool {
 // option with only one of either width or height does the same thing as if
 // "fit" had not been specified.
 //
+// Fit Modes
+//
+// 	fit={mode}
+//
+// The "fit" option selects how an image is resized when both width and height
+// are given:
+//
+// 	clip  - fit within the box, the same as "mode=fit"
+// 	crop  - fill the box, cropping as needed
+// 	scale - stretch to the exact size, ignoring the aspect ratio
+// 	max   - like clip, but never larger than the original image
+// 	min   - like crop, but never larger than the original image
+// 	fill  - like clip, and then pad to the exact size
+//
+// Unless scaling up is allowed, no mode resizes an image larger than the
+// original, and a requested width or height larger than the image is reduced
+// to fit it.  The max and min modes never scale up, and min reduces both
+// dimensions by the same factor to keep the requested aspect ratio.  A fill
+// canvas is always the requested size, even if the image is smaller.  The
+// default mode is clip without "mode" or "fit" options, a crop anchor or a
+// focal point, in the request or the default options, and crop otherwise.
+//
+// The "fit=fill" option resizes the image to fit within the box, and then
+// pads it to exactly the specified size.  The padding is centered, and its
+// color is given with "bg={color}" as hexadecimal RGB or RGBA digits, with or
+// without a leading "#", like "bg=fff" or "bg=00000080".  White is used by
+// default.  The "bg=blur" option pads with a blurred copy of the image,
+// enlarged to fill the box, instead.
+//
+// Resampling Filter
+//
+// 	filter={name}
+//
+// The "filter" option selects the resampling filter used when resizing: one of
+// "nearest", "box", "linear", "catmullrom", "lanczos" and "mitchell".  Box is
+// fast and used by default; lanczos gives the sharpest results.
+//
+// Device Pixel Ratio
+//
+// The "dpr={ratio}" option multiplies the width and height, as well as crop
+// values given in pixels, by the device pixel ratio of the client.  Valid
+// ratios are from 1 to 5.  Unless scaling up is allowed, the ratio is lowered
+// as needed to fit the source image, and the ratio actually used is returned
+// in the Content-DPR response header.
+//
+// Color Adjustments
+//
+// 	bri={percentage}
+// 	con={percentage}
+// 	sat={percentage}
+// 	hue={degrees}
+// 	gam={gamma}
+// 	exp={stops}
+//
+// Brightness, contrast and saturation are changed by a percentage from -100
+// to 100, where "sat=-100" removes all color.  The "hue" option rotates hues
+// by -360 to 360 degrees.  The "gam" option applies a gamma correction, from
+// above 0 to 10, where values above 1 lighten the image.  The "exp" option
+// changes the exposure by -5 to 5 stops, doubling the light for every stop.
+//
+// Color adjustments are applied after the image is resized, in the order
+// exposure, brightness, contrast, gamma, saturation and hue.
+//
+// Effects
+//
+// 	mono={color}
+// 	sepia={amount}
+// 	duotone={shadow},{highlight}
+// 	invert=true
+// 	px={size}
+//
+// The "mono" option turns the image to grayscale with "mono=true", or tints it
+// with a single color given as hexadecimal RGB or RGBA digits, like the "bg"
+// option.  The "sepia" option applies a sepia tone of strength 0 to 100.  The
+// "duotone" option maps the shadows of the image to the first color and the
+// highlights to the second.  The "invert" option inverts all colors.  The "px"
+// option pixelates the image with square blocks of 2 to 100 pixels.
+//
+// Effects are applied after color adjustments in the order mono, sepia,
+// duotone, invert and px, and before blur and sharpen.  Like all other pixel
+// filters they come after cropping and resizing, and before padding,
+// rotation and flips, and are applied to each frame of animated GIFs.
+//
+// Blur and Sharpen
+//
+// 	blur={sigma}
+// 	sharp={amount}
+// 	usm={amount},{radius},{threshold}
+//
+// These filters are applied after the image is resized.  The "blur" option
+// applies a Gaussian blur with the standard deviation sigma, up to 100.  The
+// "usm" option applies an unsharp mask: amount is the strength in percent, up
+// to 500, radius is the standard deviation of the blur used, up to 100 and 1
+// by default, and only pixels that differ from the blurred ones by more than
+// threshold levels (0 to 255, 0 by default) are sharpened.  The "sharp"
+// option, from 0 to 100, is a shorthand for "usm={amount},1,0".
+//
+// Watermark
+//
+// 	mark={url}
+// 	mark-pos={position}
+// 	mark-scale={fraction}
+// 	mark-alpha={percentage}
+// 	mark-pad={padding}
+//
+// The "mark" option composites the image at url, which may be relative to the
+// remote image URL, onto the output after all other transformations but
+// masks.  The watermark is fetched and cached like other remote images, and its
+// host must be allowed like theirs.  Its position is "center" or an anchor like
+// "bottom,right", which is the default.  The "mark-scale" option sizes the
+// watermark to a fraction of the output width, "mark-alpha" sets its opacity
+// from 0 to 100, and "mark-pad" sets its distance from the edges in pixels or
+// as a fraction of the smaller output dimension.
+//
+// A prefix can force a watermark on all of its images, which requests cannot
+// change.
+//
+// Text
+//
+// 	txt={text}
+// 	txt-size={size}
+// 	txt-color={color}
+// 	txt-font={name}
+// 	txt-align={position}
+// 	txt-pad={padding}
+// 	txt-shadow={color}
+//
+// The "txt" option draws a line of text onto the output, before any watermark.
+// Its size is in pixels, or a fraction of the output height, which is also the
+// default of a tenth.  Text too wide for the image is made smaller to fit.  The
+// color defaults to white, and "txt-shadow" draws a drop shadow behind the text
+// in a color, or in translucent black if true.  Fonts are bundled or loaded
+// from the font directory of the proxy, by name.  The position and padding work
+// like those of the watermark, except that the default position is "bottom".
+//
+// Masks
+//
+// 	mask=ellipse
+// 	mask={url}
+// 	corner-radius={radius}
+//
+// Masks make parts of the output transparent, after all other transformations
+// including text and watermarks.  The "ellipse" mask keeps the ellipse
+// inscribed in the image, like a circle for square avatars.  A mask image at
+// url, which may be relative to the remote image URL and is fetched like a
+// watermark, is stretched to the output size and its alpha kept, or its
+// luminance if it is opaque.  The "corner-radius" option rounds the corners
+// with a radius in pixels, or as a fraction of the smaller output dimension.
+//
+// As jpeg images cannot be transparent, masked jpeg images are encoded as png,
+// unless an opaque "bg" color is given to fill the transparent areas with.
+//
+// Borders
+//
+// 	border={width},{color}
+// 	border-radius={radius}
+// 	border-outside=true
+//
+// The "border" option draws a border of a width in pixels around the output,
+// after text and watermarks but before masks.  The color defaults to black.
+// The border is drawn over the edges of the image, which keeps the requested
+// size, unless "border-outside" adds it around the image instead.  The
+// "border-radius" option rounds the outer corners of the border, and the image
+// is transparent outside them like with "corner-radius".
+//
 // Rotation and Flips
 //
-// The "r={degrees}" option will rotate the image the specified number of
-// degrees, counter-clockwise. Valid degrees values are 90, 180, and 270.
+// The "rotate={degrees}" option will rotate the image the specified number of
+// degrees, counter-clockwise.  Any angle can be given.  For angles other than
+// multiples of 90 the image is expanded to fit, and its corners are filled
+// with the "bg" color.  Without one, the corners are transparent, or white for
+// JPEG and GIF output.  Requests that combine such a rotation with "bg=blur",
+// or with a transparent color and "format=jpeg", are rejected.  JPEG images
+// with transparent corners and no explicit format are converted to PNG.
 //
 // The "flip=v" option will flip the image vertically. The "flip=h" option will flip
 // the image horizontally. Images are flipped after being rotated.
@@ -234,12 +1147,69 @@ func (o Options) transform() bool {
 // Quality
 //
 // The "quality={qualityPercentage}" option can be used to specify the quality of the
-// output file (JPEG only). If not specified, the default value of "95" is used.
+// output file (JPEG and WebP only). If not specified, the default value of "95" is
+// used for JPEG and "75" for WebP.
+//
+// The "max-bytes={size}" option sets a budget for the size of JPEG and lossy
+// WebP output in bytes.  The highest quality, up to the requested or default
+// one, that fits the budget is used, and the image is shrunk with the resize
+// filter when even low qualities do not fit.  The quality used is returned in
+// the Content-Quality response header.
 //
 // Format
 //
-// The "format=jpeg", "format=png", and "format=tiff"  options can be used to specify
-// the desired image format of the proxied image.
+// The "format=jpeg", "format=png", "format=tiff" and "format=webp" options can be
+// used to specify the desired image format of the proxied image.  The
+// "format=apng" option keeps animated GIFs animated as animated PNG, and
+// encodes other images as PNG.
+//
+// The "lossless=true" option encodes WebP images losslessly, ignoring quality.
+//
+// JPEG encoding is controlled with the following options:
+//
+//	subsampling={444|422|420} - chroma subsampling, also as "4:2:0"
+//	jpeg-mode={baseline|progressive} - progressive by default
+//	jpeg-optimize=false - skip optimizing Huffman tables
+//	jpeg-trellis=false - skip trellis quantization
+//	jpeg-quant={annex-k|flat|ms-ssim|imagemagick|psnr-hvs|klein|watson|ahumada|peterson}
+//	  - quantization table preset, imagemagick by default
+//
+// Without a subsampling option, chroma is subsampled 4:2:0 below quality 80
+// and not at all otherwise.  Graphics with saturated colors, like red text,
+// look best with "subsampling=444".  The trellis and quantization table
+// options are mozjpeg features, which need imageproxy built with the
+// "mozjpeg" build tag.  Without it, requests using them are rejected.
+//
+// PNG encoding is controlled with the following options:
+//
+//	colors={2-256} - quantize to a palette of that many colors
+//	dither=true - dither quantized images
+//	png-level={none|fast|default|best} - compression level, best by default
+//	png-optimize=true - use the smaller of the paletted and full color images
+//
+// Without "colors", "png-optimize" only uses a palette for images with at
+// most 256 colors, so it is lossless.
+//
+// The "format=auto" option picks the best format the client accepts, based on
+// the Accept header of the request.  gif sources stay GIF to keep their
+// animations.  Clients accepting "image/webp" get other images as WebP, and
+// other clients get images with transparency as PNG and everything else as
+// JPEG.
+//
+// Animated GIF
+//
+//	frame={n}
+//	max-frames={n}
+//	max-duration={seconds}
+//
+// The "frame" option returns frame n of an animated GIF, numbered from 1, as a
+// still image.  Animated GIFs converted with "format=webp" or "format=apng"
+// stay animated, keeping their frame timing and loop count, while other
+// formats are stills of the first frame.  Such animations are cut to 2^26
+// pixels of frames in total.  The "max-bytes" option does not apply to
+// animations.  The "max-frames" and "max-duration" options cut
+// animations to at most that many frames, and to the frames starting within
+// that many seconds.
 //
 // Signature
 //
@@ -262,6 +1232,10 @@ func (o Options) transform() bool {
 // 	size=100,flip=v,flip=h  - 100 pixels square, flipped horizontal and vertical
 // 	width=200,quality=60    - 200 pixels wide, proportional height, 60% quality
 // 	width=200,format=png    - 200 pixels wide, converted to PNG format
+// 	format=webp,lossless=1  - converted to lossless WebP format
+// 	width=200,dpr=2         - 400 pixels wide, for displaying 200 pixels wide at 2x
+// 	size=100,crop=top       - 100 pixels square, cropping from the bottom as needed
+// 	size=50,fit=fill,bg=000 - 50 pixels square, padded with black as needed
 // 	crop=0,0,100,100        - crop image to 100px square, starting at (0,0)
 // 	crop=10,20,100,200      - crop image starting at (10,20) is 100px wide and 200px tall
 func ParseFormValues(form url.Values, defaultOptions Options) Options {
@@ -269,6 +1243,7 @@ func ParseFormValues(form url.Values, defaultOptions Options) Options {
 	options := defaultOptions
 
 	modeSeen := false
+	focalXSeen, focalYSeen := false, false
 
 	for key, values := range form {
 		for _, value := range values {
@@ -276,11 +1251,25 @@ func ParseFormValues(form url.Values, defaultOptions Options) Options {
 			case "mode":
 				switch value {
 				case "fit":
-					options.Fit = true
+					options.FitMode = fitClip
 				case "smartcrop":
 					options.SmartCrop = true
 				}
 				modeSeen = true
+			case "fit":
+				switch value {
+				case fitClip, fitCrop, fitScale, fitMax, fitMin, fitFill:
+					options.FitMode = value
+					modeSeen = true
+				}
+			case "bg":
+				if bg, ok := parseBackground(value); ok {
+					options.Background = bg
+				}
+			case "filter":
+				if _, ok := resampleFilters[value]; ok {
+					options.Filter = value
+				}
 			case "flip":
 				switch value {
 				case "v":
@@ -296,16 +1285,227 @@ func ParseFormValues(form url.Values, defaultOptions Options) Options {
 					options.Format = optFormatPNG
 				case optFormatTIFF:
 					options.Format = optFormatTIFF
+				case optFormatWebP:
+					options.Format = optFormatWebP
+				case optFormatAPNG:
+					options.Format = optFormatAPNG
+				case optFormatAuto:
+					options.Format = optFormatAuto
+				}
+			case "lossless":
+				options.Lossless, _ = strconv.ParseBool(value)
+			case "subsampling":
+				if ss := strings.Replace(value, ":", "", -1); ss == "444" || ss == "422" || ss == "420" {
+					options.Subsampling = ss
+				}
+			case "jpeg-mode":
+				switch value {
+				case "baseline":
+					options.Baseline = true
+				case "progressive":
+					options.Baseline = false
+				}
+			case "jpeg-optimize":
+				if v, err := strconv.ParseBool(value); err == nil {
+					options.NoOptimize = !v
+				}
+			case "jpeg-trellis":
+				if v, err := strconv.ParseBool(value); err == nil {
+					options.NoTrellis = !v
+				}
+			case "jpeg-quant":
+				if _, ok := jpegQuantTables[value]; ok {
+					options.JPEGQuant = value
+				}
+			case "colors":
+				if n, err := strconv.Atoi(value); err == nil && n >= minColors && n <= maxColors {
+					options.Colors = n
+				}
+			case "dither":
+				options.Dither, _ = strconv.ParseBool(value)
+			case "png-level":
+				if _, ok := pngLevels[value]; ok {
+					options.PNGLevel = value
+				}
+			case "png-optimize":
+				options.PNGOptimize, _ = strconv.ParseBool(value)
+			case "frame":
+				if n, err := strconv.Atoi(value); err == nil && n >= 1 {
+					options.Frame = n
+				}
+			case "max-frames":
+				if n, err := strconv.Atoi(value); err == nil && n >= 1 {
+					options.MaxFrames = n
+				}
+			case "max-duration":
+				if d, err := strconv.ParseFloat(value, 64); err == nil && d > 0 && !math.IsInf(d, 0) {
+					options.MaxDuration = d
 				}
 			case "rotate":
-				options.Rotate, _ = strconv.Atoi(value)
+				if v, err := strconv.ParseFloat(value, 64); err == nil && !math.IsNaN(v) && !math.IsInf(v, 0) {
+					options.Rotate = v
+				}
+			case "bri":
+				if v, err := strconv.ParseFloat(value, 64); err == nil && math.Abs(v) <= maxColorAdjustment {
+					options.Brightness = v
+				}
+			case "con":
+				if v, err := strconv.ParseFloat(value, 64); err == nil && math.Abs(v) <= maxColorAdjustment {
+					options.Contrast = v
+				}
+			case "sat":
+				if v, err := strconv.ParseFloat(value, 64); err == nil && math.Abs(v) <= maxColorAdjustment {
+					options.Saturation = v
+				}
+			case "hue":
+				if v, err := strconv.ParseFloat(value, 64); err == nil && math.Abs(v) <= maxHue {
+					options.Hue = v - math.Floor(v/360)*360
+				}
+			case "gam":
+				if v, err := strconv.ParseFloat(value, 64); err == nil && v > 0 && v <= maxGamma {
+					options.Gamma = v
+				}
+			case "exp":
+				if v, err := strconv.ParseFloat(value, 64); err == nil && math.Abs(v) <= maxExposure {
+					options.Exposure = v
+				}
+			case "mono":
+				if gray, err := strconv.ParseBool(value); err == nil {
+					if gray {
+						options.Mono = monoGray
+					}
+				} else if c, ok := parseColor(value); ok {
+					options.Mono = c
+				}
+			case "sepia":
+				if v, err := strconv.ParseFloat(value, 64); err == nil && v > 0 && v <= maxSepia {
+					options.Sepia = v
+				}
+			case "duotone":
+				colors := strings.Split(value, ",")
+				if len(colors) == 2 {
+					shadow, ok1 := parseColor(colors[0])
+					highlight, ok2 := parseColor(colors[1])
+					if ok1 && ok2 {
+						options.DuotoneShadow = shadow
+						options.DuotoneHighlight = highlight
+					}
+				}
+			case "invert":
+				options.Invert, _ = strconv.ParseBool(value)
+			case "px":
+				// blocks of a pixel leave the image as it is
+				if v, err := strconv.Atoi(value); err == nil && v > 1 && v <= maxPixelate {
+					options.Pixelate = v
+				}
+			case "border":
+				if width, c, ok := parseBorder(value); ok {
+					options.BorderWidth, options.BorderColor = width, c
+				}
+			case "border-radius":
+				if v, err := strconv.ParseFloat(value, 64); err == nil && v > 0 {
+					options.BorderRadius = v
+				}
+			case "border-outside":
+				if outside, err := strconv.ParseBool(value); err == nil {
+					options.BorderOutside = outside
+				}
+			case "trim":
+				if trim, err := strconv.ParseBool(value); err == nil {
+					if trim {
+						options.Trim = trimAuto
+					}
+				} else if value == trimAuto {
+					options.Trim = trimAuto
+				} else if c, ok := parseColor(value); ok {
+					options.Trim = c
+				}
+			case "trim-tol":
+				if v, err := strconv.ParseFloat(value, 64); err == nil && v >= 0 && v <= maxTrimTolerance {
+					options.TrimTolerance = v
+				}
+			case "mask":
+				options.Mask = value
+			case "corner-radius":
+				if v, err := strconv.ParseFloat(value, 64); err == nil && v > 0 {
+					options.CornerRadius = v
+				}
+			case "txt":
+				options.Text.Value = value
+			case "txt-size":
+				if v, err := strconv.ParseFloat(value, 64); err == nil && v > 0 && v <= maxTextSize {
+					options.Text.Size = v
+				}
+			case "txt-color":
+				if c, ok := parseColor(value); ok {
+					options.Text.Color = c
+				}
+			case "txt-font":
+				if validFontName(value) {
+					options.Text.Font = strings.ToLower(value)
+				}
+			case "txt-align":
+				if pos, ok := parsePosition(value); ok {
+					options.Text.Align = pos
+				}
+			case "txt-pad":
+				if v, err := strconv.ParseFloat(value, 64); err == nil && v >= 0 {
+					options.Text.Pad = v
+				}
+			case "txt-shadow":
+				if shadow, err := strconv.ParseBool(value); err == nil {
+					if shadow {
+						options.Text.Shadow = defaultTextShadow
+					}
+				} else if c, ok := parseColor(value); ok {
+					options.Text.Shadow = c
+				}
+			case "mark":
+				options.Mark.URL = value
+			case "mark-pos":
+				if pos, ok := parsePosition(value); ok {
+					options.Mark.Pos = pos
+				}
+			case "mark-scale":
+				if v, err := strconv.ParseFloat(value, 64); err == nil && v > 0 && v <= 1 {
+					options.Mark.Scale = v
+				}
+			case "mark-alpha":
+				if v, err := strconv.ParseFloat(value, 64); err == nil && v > 0 && v <= 100 {
+					options.Mark.Alpha = v
+				}
+			case "mark-pad":
+				if v, err := strconv.ParseFloat(value, 64); err == nil && v >= 0 {
+					options.Mark.Pad = v
+				}
+			case "blur":
+				if v, err := strconv.ParseFloat(value, 64); err == nil && v > 0 && v <= maxBlur {
+					options.Blur = v
+				}
+			case "sharp":
+				if v, err := strconv.ParseFloat(value, 64); err == nil && v > 0 && v <= maxSharpen {
+					options.Sharpen = v
+				}
+			case "usm":
+				if amount, radius, threshold, ok := parseUnsharpMask(value); ok {
+					options.UnsharpAmount = amount
+					options.UnsharpRadius = radius
+					options.UnsharpThreshold = threshold
+				}
 			case "quality":
 				options.Quality, _ = strconv.Atoi(value)
+			case "max-bytes":
+				if n, err := strconv.Atoi(value); err == nil && n > 0 {
+					options.MaxBytes = n
+				}
 			case "signature":
 				options.Signature = value
 			case "crop":
 				cropValues := strings.Split(value, ",")
-				if len(cropValues) == 4 {
+				if mode, ok := parseCropMode(cropValues); ok {
+					options.CropMode = mode
+					modeSeen = true
+				} else if len(cropValues) == 4 {
 					options.CropX, _ = strconv.ParseFloat(cropValues[0], 64)
 					options.CropY, _ = strconv.ParseFloat(cropValues[1], 64)
 					options.CropWidth, _ = strconv.ParseFloat(cropValues[2], 64)
@@ -321,22 +1521,219 @@ func ParseFormValues(form url.Values, defaultOptions Options) Options {
 					options.Width = size
 					options.Height = size
 				}
+			case "ar":
+				if ar, ok := parseAspectRatio(value); ok {
+					options.AspectRatio = ar
+				}
+			case "max-w", "max-h", "min-w", "min-h":
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 0 {
+					break
+				}
+				switch key {
+				case "max-w":
+					options.MaxWidth = n
+				case "max-h":
+					options.MaxHeight = n
+				case "min-w":
+					options.MinWidth = n
+				case "min-h":
+					options.MinHeight = n
+				}
+			case "dpr":
+				dpr, err := strconv.ParseFloat(value, 64)
+				if err == nil && dpr >= minDPR && dpr <= maxDPR {
+					options.DPR = dpr
+				}
+			case "fp-x":
+				if x, err := strconv.ParseFloat(value, 64); err == nil && x >= 0 && x <= 1 {
+					options.Focal = true
+					options.FocalX = x
+					focalXSeen = true
+				}
+			case "fp-y":
+				if y, err := strconv.ParseFloat(value, 64); err == nil && y >= 0 && y <= 1 {
+					options.Focal = true
+					options.FocalY = y
+					focalYSeen = true
+				}
+			case "fp-z":
+				if z, err := strconv.ParseFloat(value, 64); err == nil && z >= 1 {
+					options.FocalZoom = z
+				}
 			}
 		}
 	}
 
 	/*
-		The transformation code doesn't currently do anything if Fit is true and either width or height is 0.
-		However, for libpixel compatibility Fit is supposed to be the default. Ask for Fit if no mode
-		was specified and width and height are positive.
+		For libpixel compatibility clip is supposed to be the default. Ask for clip if no mode,
+		crop anchor or focal point was specified, in the request or the default options, and
+		width and height are positive.
 	*/
-	if !modeSeen && options.Width > 0 && options.Height > 0 {
-		options.Fit = true
+	if !modeSeen && options.FitMode == "" && options.CropMode == "" && !options.Focal && options.Width > 0 && options.Height > 0 {
+		options.FitMode = fitClip
+	}
+
+	// A single focal point coordinate must not leave the other one at zero,
+	// which is an edge rather than the center.
+	if focalXSeen != focalYSeen && !defaultOptions.Focal {
+		if !focalXSeen {
+			options.FocalX = 0.5
+		}
+		if !focalYSeen {
+			options.FocalY = 0.5
+		}
 	}
 
 	return options
 }
 
+// parseCropMode returns the crop mode named by words, either an anchor like
+// "top" and "left", or "entropy".
+func parseCropMode(words []string) (string, bool) {
+	if len(words) == 1 && words[0] == cropEntropy {
+		return cropEntropy, true
+	}
+
+	var vertical, horizontal string
+	for _, word := range words {
+		switch word {
+		case "top", "bottom":
+			if vertical != "" {
+				return "", false
+			}
+			vertical = word
+		case "left", "right":
+			if horizontal != "" {
+				return "", false
+			}
+			horizontal = word
+		default:
+			return "", false
+		}
+	}
+
+	if vertical != "" && horizontal != "" {
+		return vertical + "-" + horizontal, true
+	}
+	return vertical + horizontal, true
+}
+
+// parseUnsharpMask returns the unsharp mask parameters in value, which has
+// an amount, optionally followed by a radius and a threshold.
+func parseUnsharpMask(value string) (amount, radius, threshold float64, ok bool) {
+	params := []float64{0, 1, 0}
+	limits := []float64{maxUnsharpAmount, maxUnsharpRadius, maxUnsharpThreshold}
+	parts := strings.Split(value, ",")
+	if len(parts) > len(params) {
+		return 0, 0, 0, false
+	}
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil || v < 0 || v > limits[i] {
+			return 0, 0, 0, false
+		}
+		params[i] = v
+	}
+	if params[0] == 0 || params[1] == 0 {
+		return 0, 0, 0, false
+	}
+	return params[0], params[1], params[2], true
+}
+
+// parsePosition returns the position of a watermark or text named by value,
+// either "center" or an anchor with its edges separated by commas or dashes.
+func parsePosition(value string) (string, bool) {
+	if value == "center" {
+		return value, true
+	}
+	pos, ok := parseCropMode(strings.Split(strings.Replace(value, "-", ",", -1), ","))
+	return pos, ok && pos != cropEntropy
+}
+
+// parseAspectRatio returns the aspect ratio in value, which is either a width
+// and a height separated by a colon or a single number.
+func parseAspectRatio(value string) (float64, bool) {
+	var ar float64
+	if parts := strings.Split(value, ":"); len(parts) == 2 {
+		w, errW := strconv.ParseFloat(parts[0], 64)
+		h, errH := strconv.ParseFloat(parts[1], 64)
+		if errW != nil || errH != nil || h <= 0 {
+			return 0, false
+		}
+		ar = w / h
+	} else {
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, false
+		}
+		ar = v
+	}
+	return ar, ar >= minAspectRatio && ar <= maxAspectRatio
+}
+
+// parseBorder returns the border width and color in value, which has a width
+// in pixels optionally followed by a color.
+func parseBorder(value string) (width int, c string, ok bool) {
+	parts := strings.SplitN(value, ",", 2)
+	width, err := strconv.Atoi(parts[0])
+	if err != nil || width <= 0 || width > maxBorderWidth {
+		return 0, "", false
+	}
+	if len(parts) == 1 {
+		return width, defaultBorderColor, true
+	}
+	c, ok = parseColor(parts[1])
+	return width, c, ok
+}
+
+// validFontName returns whether name can name a font, which consists of
+// letters, digits, dashes and underscores.
+func validFontName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseBackground returns the padding background named by value, normalized
+// to 8 lowercase hexadecimal digits for colors.
+func parseBackground(value string) (string, bool) {
+	if value == backgroundBlur {
+		return value, true
+	}
+	return parseColor(value)
+}
+
+// parseColor returns the color of 3, 4, 6 or 8 hexadecimal RGB or RGBA digits
+// in value, optionally prefixed with "#", normalized to 8 lowercase digits.
+func parseColor(value string) (string, bool) {
+	hex := strings.ToLower(strings.TrimPrefix(value, "#"))
+	if _, err := strconv.ParseUint(hex, 16, 32); err != nil {
+		return "", false
+	}
+	switch len(hex) {
+	case 3, 4:
+		var b []byte
+		for i := 0; i < len(hex); i++ {
+			b = append(b, hex[i], hex[i])
+		}
+		hex = string(b)
+	case 6, 8:
+	default:
+		return "", false
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	return hex, true
+}
+
 // ParseOptions is useful, although no longer exposed to the API
 func ParseOptions(str string) Options {
 	var options Options
@@ -345,21 +1742,205 @@ func ParseOptions(str string) Options {
 		switch {
 		case len(opt) == 0:
 			break
-		case opt == optFit:
-			options.Fit = true
+		case opt == optFit: // the fragment of clip before other fit modes
+			options.FitMode = fitClip
+		case strings.HasPrefix(opt, optFitModePrefix):
+			options.FitMode = strings.TrimPrefix(opt, optFitModePrefix)
 		case opt == optFlipVertical:
 			options.FlipVertical = true
 		case opt == optFlipHorizontal:
 			options.FlipHorizontal = true
 		case opt == optScaleUp: // this option is intentionally not documented above
 			options.ScaleUp = true
-		case opt == optFormatJPEG, opt == optFormatPNG, opt == optFormatTIFF:
+		case opt == optFormatJPEG, opt == optFormatPNG, opt == optFormatTIFF, opt == optFormatWebP, opt == optFormatAPNG, opt == optFormatAuto:
 			options.Format = opt
+		case opt == optAcceptWebP:
+			options.AcceptWebP = true
+		case opt == optLossless:
+			options.Lossless = true
 		case opt == optSmartCrop:
 			options.SmartCrop = true
+		case opt == optBaseline:
+			options.Baseline = true
+		case opt == optNoOptimize:
+			options.NoOptimize = true
+		case opt == optNoTrellis:
+			options.NoTrellis = true
+		case strings.HasPrefix(opt, optJPEGQuantPrefix):
+			options.JPEGQuant = strings.TrimPrefix(opt, optJPEGQuantPrefix)
+		case opt == optDither:
+			options.Dither = true
+		case opt == optPNGOptimize:
+			options.PNGOptimize = true
+		case strings.HasPrefix(opt, optPNGLevelPrefix):
+			options.PNGLevel = strings.TrimPrefix(opt, optPNGLevelPrefix)
+		case strings.HasPrefix(opt, optFrame):
+			value := strings.TrimPrefix(opt, optFrame)
+			options.Frame, _ = strconv.Atoi(value)
+		case strings.HasPrefix(opt, optMaxFrames):
+			value := strings.TrimPrefix(opt, optMaxFrames)
+			options.MaxFrames, _ = strconv.Atoi(value)
+		case strings.HasPrefix(opt, optMaxDuration):
+			value := strings.TrimPrefix(opt, optMaxDuration)
+			options.MaxDuration, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optColors):
+			value := strings.TrimPrefix(opt, optColors)
+			options.Colors, _ = strconv.Atoi(value)
+		case strings.HasPrefix(opt, optChromaPrefix):
+			options.Subsampling = strings.TrimPrefix(opt, optChromaPrefix)
+		case strings.HasPrefix(opt, optBrightness):
+			value := strings.TrimPrefix(opt, optBrightness)
+			options.Brightness, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optContrast):
+			value := strings.TrimPrefix(opt, optContrast)
+			options.Contrast, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optSaturation):
+			value := strings.TrimPrefix(opt, optSaturation)
+			options.Saturation, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optHue):
+			value := strings.TrimPrefix(opt, optHue)
+			options.Hue, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optGamma):
+			value := strings.TrimPrefix(opt, optGamma)
+			options.Gamma, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optExposure):
+			value := strings.TrimPrefix(opt, optExposure)
+			options.Exposure, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optBorderRadius):
+			value := strings.TrimPrefix(opt, optBorderRadius)
+			options.BorderRadius, _ = strconv.ParseFloat(value, 64)
+		case opt == optBorderOutside:
+			options.BorderOutside = true
+		case strings.HasPrefix(opt, optBorderPrefix):
+			value := strings.TrimPrefix(opt, optBorderPrefix)
+			if parts := strings.SplitN(value, "-", 2); len(parts) == 2 {
+				options.BorderWidth, _ = strconv.Atoi(parts[0])
+				options.BorderColor = parts[1]
+			}
+		case strings.HasPrefix(opt, optTrimTolerance):
+			value := strings.TrimPrefix(opt, optTrimTolerance)
+			options.TrimTolerance, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optTrimPrefix):
+			options.Trim = strings.TrimPrefix(opt, optTrimPrefix)
+		case opt == optMaskEllipse:
+			options.Mask = maskEllipse
+		case strings.HasPrefix(opt, optMaskPrefix):
+			value := strings.TrimPrefix(opt, optMaskPrefix)
+			if u, err := base64.RawURLEncoding.DecodeString(value); err == nil {
+				options.Mask = string(u)
+			}
+		case strings.HasPrefix(opt, optCornerRadius):
+			value := strings.TrimPrefix(opt, optCornerRadius)
+			options.CornerRadius, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optTextPrefix):
+			value := strings.TrimPrefix(opt, optTextPrefix)
+			if s, err := base64.RawURLEncoding.DecodeString(value); err == nil {
+				options.Text.Value = string(s)
+			}
+		case strings.HasPrefix(opt, optTextSize):
+			value := strings.TrimPrefix(opt, optTextSize)
+			options.Text.Size, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optTextColor):
+			options.Text.Color = strings.TrimPrefix(opt, optTextColor)
+		case strings.HasPrefix(opt, optTextFontPrefix):
+			options.Text.Font = strings.TrimPrefix(opt, optTextFontPrefix)
+		case strings.HasPrefix(opt, optTextAlignPrefix):
+			options.Text.Align = strings.TrimPrefix(opt, optTextAlignPrefix)
+		case strings.HasPrefix(opt, optTextPad):
+			value := strings.TrimPrefix(opt, optTextPad)
+			options.Text.Pad, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optTextShadow):
+			options.Text.Shadow = strings.TrimPrefix(opt, optTextShadow)
+		case strings.HasPrefix(opt, optMarkPrefix):
+			value := strings.TrimPrefix(opt, optMarkPrefix)
+			if u, err := base64.RawURLEncoding.DecodeString(value); err == nil {
+				options.Mark.URL = string(u)
+			}
+		case strings.HasPrefix(opt, optMarkPosPrefix):
+			options.Mark.Pos = strings.TrimPrefix(opt, optMarkPosPrefix)
+		case strings.HasPrefix(opt, optMarkScale):
+			value := strings.TrimPrefix(opt, optMarkScale)
+			options.Mark.Scale, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optMarkAlpha):
+			value := strings.TrimPrefix(opt, optMarkAlpha)
+			options.Mark.Alpha, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optMarkPad):
+			value := strings.TrimPrefix(opt, optMarkPad)
+			options.Mark.Pad, _ = strconv.ParseFloat(value, 64)
+		case opt == optInvert:
+			options.Invert = true
+		case strings.HasPrefix(opt, optMono):
+			options.Mono = strings.TrimPrefix(opt, optMono)
+		case strings.HasPrefix(opt, optSepia):
+			value := strings.TrimPrefix(opt, optSepia)
+			options.Sepia, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optDuotone):
+			colors := strings.Split(strings.TrimPrefix(opt, optDuotone), "-")
+			if len(colors) == 2 {
+				options.DuotoneShadow = colors[0]
+				options.DuotoneHighlight = colors[1]
+			}
+		case strings.HasPrefix(opt, optPixelate):
+			value := strings.TrimPrefix(opt, optPixelate)
+			if v, _ := strconv.Atoi(value); v > 1 {
+				options.Pixelate = v
+			}
+		case strings.HasPrefix(opt, optBlurPrefix):
+			value := strings.TrimPrefix(opt, optBlurPrefix)
+			options.Blur, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optSharpenPrefix):
+			value := strings.TrimPrefix(opt, optSharpenPrefix)
+			options.Sharpen, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optUnsharpAmount):
+			value := strings.TrimPrefix(opt, optUnsharpAmount)
+			options.UnsharpAmount, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optUnsharpRadius):
+			value := strings.TrimPrefix(opt, optUnsharpRadius)
+			options.UnsharpRadius, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optUnsharpThresh):
+			value := strings.TrimPrefix(opt, optUnsharpThresh)
+			options.UnsharpThreshold, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optFilterPrefix):
+			options.Filter = strings.TrimPrefix(opt, optFilterPrefix)
+		case strings.HasPrefix(opt, optBackground):
+			options.Background = strings.TrimPrefix(opt, optBackground)
+		case strings.HasPrefix(opt, optDPRPrefix):
+			value := strings.TrimPrefix(opt, optDPRPrefix)
+			options.DPR, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optAspectRatio):
+			value := strings.TrimPrefix(opt, optAspectRatio)
+			options.AspectRatio, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optMaxBytes):
+			value := strings.TrimPrefix(opt, optMaxBytes)
+			options.MaxBytes, _ = strconv.Atoi(value)
+		case strings.HasPrefix(opt, optMaxWidth):
+			value := strings.TrimPrefix(opt, optMaxWidth)
+			options.MaxWidth, _ = strconv.Atoi(value)
+		case strings.HasPrefix(opt, optMaxHeight):
+			value := strings.TrimPrefix(opt, optMaxHeight)
+			options.MaxHeight, _ = strconv.Atoi(value)
+		case strings.HasPrefix(opt, optMinWidth):
+			value := strings.TrimPrefix(opt, optMinWidth)
+			options.MinWidth, _ = strconv.Atoi(value)
+		case strings.HasPrefix(opt, optMinHeight):
+			value := strings.TrimPrefix(opt, optMinHeight)
+			options.MinHeight, _ = strconv.Atoi(value)
+		case strings.HasPrefix(opt, optCropModePrefix):
+			options.CropMode = strings.TrimPrefix(opt, optCropModePrefix)
+		case strings.HasPrefix(opt, optFocalX):
+			value := strings.TrimPrefix(opt, optFocalX)
+			options.Focal = true
+			options.FocalX, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optFocalY):
+			value := strings.TrimPrefix(opt, optFocalY)
+			options.Focal = true
+			options.FocalY, _ = strconv.ParseFloat(value, 64)
+		case strings.HasPrefix(opt, optFocalZoom):
+			value := strings.TrimPrefix(opt, optFocalZoom)
+			options.FocalZoom, _ = strconv.ParseFloat(value, 64)
 		case strings.HasPrefix(opt, optRotatePrefix):
 			value := strings.TrimPrefix(opt, optRotatePrefix)
-			options.Rotate, _ = strconv.Atoi(value)
+			options.Rotate, _ = strconv.ParseFloat(value, 64)
 		case strings.HasPrefix(opt, optQualityPrefix):
 			value := strings.TrimPrefix(opt, optQualityPrefix)
 			options.Quality, _ = strconv.Atoi(value)
@@ -409,13 +1990,72 @@ func StripOurOptions(rawQuery string) (string, error) {
 		case "mode":
 		case "flip":
 		case "format":
+		case "lossless":
+		case "subsampling":
+		case "jpeg-mode":
+		case "jpeg-optimize":
+		case "jpeg-trellis":
+		case "jpeg-quant":
+		case "colors":
+		case "dither":
+		case "png-level":
+		case "png-optimize":
+		case "frame":
+		case "max-frames":
+		case "max-duration":
 		case "rotate":
 		case "quality":
+		case "max-bytes":
 		case "signature":
 		case "crop":
 		case "width":
 		case "height":
 		case "size":
+		case "ar":
+		case "max-w":
+		case "max-h":
+		case "min-w":
+		case "min-h":
+		case "dpr":
+		case "fp-x":
+		case "fp-y":
+		case "fp-z":
+		case "fit":
+		case "bg":
+		case "filter":
+		case "blur":
+		case "sharp":
+		case "usm":
+		case "bri":
+		case "con":
+		case "sat":
+		case "hue":
+		case "gam":
+		case "exp":
+		case "mono":
+		case "sepia":
+		case "duotone":
+		case "invert":
+		case "px":
+		case "border":
+		case "border-radius":
+		case "border-outside":
+		case "trim":
+		case "trim-tol":
+		case "mask":
+		case "corner-radius":
+		case "txt":
+		case "txt-size":
+		case "txt-color":
+		case "txt-font":
+		case "txt-align":
+		case "txt-pad":
+		case "txt-shadow":
+		case "mark":
+		case "mark-pos":
+		case "mark-scale":
+		case "mark-alpha":
+		case "mark-pad":
 
 		// Do copy other values
 		default:
@@ -431,6 +2071,10 @@ type Request struct {
 	URL      *url.URL      // URL of the image to proxy
 	Options  Options       // Image transformation to perform
 	Original *http.Request // The original HTTP request
+
+	// Vary lists the headers of the original request that Options were
+	// derived from.
+	Vary []string
 }
 
 // String returns the request URL as a string, with r.Options encoded in the
@@ -454,6 +2098,14 @@ func (r Request) String() string {
 // 	http://localhost/100x200,r90/http://example.com/image.jpg?foo=bar
 // 	http://localhost//http://example.com/image.jpg
 // 	http://localhost/http://example.com/image.jpg
+//
+// If the "auto" format is requested, either in the query string or in the
+// default options of the matching prefix, it is negotiated here using the
+// Accept header of r.  The format stays "auto", which Transform resolves
+// depending on the image, and AcceptWebP is set for clients accepting
+// "image/webp".  Only formats that can be encoded are considered, so there is
+// no avif support.  The negotiation is part of the options, and thus of the
+// cache key.
 func NewRequest(r *http.Request, prefixesToConfigs map[string]*SourceConfiguration) (*Request, error) {
 	var err error
 	req := &Request{Original: r}
@@ -485,12 +2137,151 @@ func NewRequest(r *http.Request, prefixesToConfigs map[string]*SourceConfigurati
 		return nil, err
 	}
 	req.Options = ParseFormValues(r.Form, defaultOptions)
+	if config != nil && config.Mark.URL != "" {
+		req.Options.Mark = config.Mark
+	}
+	if config != nil {
+		req.Options.MaxWidth = capLimit(req.Options.MaxWidth, config.MaxWidth)
+		req.Options.MaxHeight = capLimit(req.Options.MaxHeight, config.MaxHeight)
+	}
+	if err := req.Options.validate(); err != nil {
+		return nil, URLError{err.Error(), r.URL}
+	}
+
+	if req.Options.Mark.URL != "" {
+		req.Options.Mark.URL, err = resolveResourceURL(req.URL, req.Options.Mark.URL)
+		if err != nil {
+			return nil, URLError{"watermark " + err.Error(), r.URL}
+		}
+	}
+	if req.Options.Mask != "" && req.Options.Mask != maskEllipse {
+		req.Options.Mask, err = resolveResourceURL(req.URL, req.Options.Mask)
+		if err != nil {
+			return nil, URLError{"mask " + err.Error(), r.URL}
+		}
+	}
+
+	if req.Options.Format == optFormatAuto {
+		req.Options.AcceptWebP = acceptsMediaType(r.Header.Get("Accept"), "image/webp")
+		req.Vary = append(req.Vary, "Accept")
+	}
 
 	req.URL.RawQuery = r.URL.RawQuery
 
 	return req, nil
 }
 
+// capLimit returns the smaller of the size limits n and limit, where zero
+// means no limit.
+func capLimit(n, limit int) int {
+	if limit > 0 && (n == 0 || n > limit) {
+		return limit
+	}
+	return n
+}
+
+// resolveResourceURL returns the absolute URL of ref, the URL of an image
+// used in transforming the remote image at base, like a watermark.
+func resolveResourceURL(base *url.URL, ref string) (string, error) {
+	u, err := base.Parse(ref)
+	if err != nil {
+		return "", errors.New("URL is malformed")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", errors.New("URL must have http or https scheme")
+	}
+	return u.String(), nil
+}
+
+// clientHints lists the client hint request headers read by
+// Request.applyClientHints.  Clients are asked to send them with the Accept-CH
+// response header.
+var clientHints = []string{"Sec-CH-DPR", "Sec-CH-Width", "Sec-CH-Viewport-Width"}
+
+// saveDataQuality is the highest output quality served to clients that ask
+// for reduced data usage with the Save-Data header.
+const saveDataQuality = 60
+
+// applyClientHints adjusts r.Options to the client hints sent with the
+// original request:
+//
+// - Sec-CH-DPR is used as the device pixel ratio, unless one was requested
+// explicitly.  It is clamped to the supported range.
+//
+// - Sec-CH-Width caps the width in physical pixels, scaling the height to
+// match.  If no size was requested, it is used as the width, and if only a
+// height was, as the maximum width.
+// Sec-CH-Viewport-Width, multiplied by the device pixel ratio, is used in its
+// absence.
+//
+// - "Save-Data: on" caps the quality at saveDataQuality.
+//
+// Percentage sizes are relative to the image, and are not affected.
+func (r *Request) applyClientHints() {
+	h := r.Original.Header
+	r.Vary = append(r.Vary, clientHints...)
+	r.Vary = append(r.Vary, "Save-Data")
+
+	o := &r.Options
+	if o.DPR == 0 {
+		if v, err := strconv.ParseFloat(h.Get("Sec-CH-DPR"), 64); err == nil && v > 0 {
+			o.DPR = math.Min(math.Max(v, minDPR), maxDPR)
+		}
+	}
+	dpr := o.DPR
+	if dpr == 0 {
+		dpr = 1
+	}
+
+	var maxWidth float64
+	if v, err := strconv.ParseFloat(h.Get("Sec-CH-Width"), 64); err == nil && v >= 1 {
+		maxWidth = math.Floor(v)
+	} else if v, err := strconv.ParseFloat(h.Get("Sec-CH-Viewport-Width"), 64); err == nil && v >= 1 {
+		maxWidth = math.Floor(v*dpr + 0.5)
+	}
+	// derived sizes are at least a pixel, since smaller ones would be
+	// percentages
+	if maxWidth > 0 {
+		switch {
+		case o.Width == 0 && o.Height == 0:
+			o.Width = math.Max(1, maxWidth/dpr)
+		case o.Width >= 1 && o.Width*dpr > maxWidth:
+			if o.Height >= 1 {
+				o.Height = math.Max(1, o.Height*maxWidth/(o.Width*dpr))
+			}
+			o.Width = math.Max(1, maxWidth/dpr)
+		case o.Width == 0 && o.Height >= 1:
+			// the width follows the image, so it is capped as a limit
+			o.MaxWidth = capLimit(o.MaxWidth, int(math.Min(maxWidth, maxDimension)))
+		}
+	}
+
+	if strings.EqualFold(h.Get("Save-Data"), "on") && (o.Quality == 0 || o.Quality > saveDataQuality) {
+		o.Quality = saveDataQuality
+	}
+}
+
+// acceptsMediaType returns whether the Accept header value accept explicitly
+// lists mediaType with a non-zero quality value.  Wildcards are ignored, since
+// browsers send them regardless of the image formats they support.
+func acceptsMediaType(accept, mediaType string) bool {
+	for _, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), mediaType) {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, _ = strconv.ParseFloat(param[len("q="):], 64)
+			}
+		}
+		return q > 0
+	}
+	return false
+}
+
 func buildFinalAbsoluteURL(prefixesToConfigs map[string]*SourceConfiguration, originalURL *url.URL) (*url.URL, error) {
 	path := originalURL.EscapedPath()[1:]
 
@@ -1,8 +1,10 @@
 package imageproxy
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/url"
+	"reflect"
 	"testing"
 )
 
@@ -18,21 +20,113 @@ func TestOptions_String(t *testing.T) {
 			"0x0",
 		},
 		{
-			Options{1, 2, true, 90, true, true, 80, "", false, "", 0, 0, 0, 0, false},
-			"1x2,fit,r90,fv,fh,q80",
+			Options{Width: 1, Height: 2, FitMode: "clip", Rotate: 90, FlipVertical: true, FlipHorizontal: true, Quality: 80},
+			"1x2,fit-clip,r90,fv,fh,q80",
 		},
 		{
-			Options{0.15, 1.3, false, 45, false, false, 95, "c0ffee", false, "png", 0, 0, 0, 0, false},
+			Options{Width: 0.15, Height: 1.3, Rotate: 45, Quality: 95, Signature: "c0ffee", Format: "png"},
 			"0.15x1.3,r45,q95,sc0ffee,png",
 		},
 		{
-			Options{0.15, 1.3, false, 45, false, false, 95, "c0ffee", false, "", 100, 200, 0, 0, false},
+			Options{Width: 0.15, Height: 1.3, Rotate: 45, Quality: 95, Signature: "c0ffee", CropX: 100, CropY: 200},
 			"0.15x1.3,r45,q95,sc0ffee,cx100,cy200",
 		},
 		{
-			Options{0.15, 1.3, false, 45, false, false, 95, "c0ffee", false, "png", 100, 200, 300, 400, false},
+			Options{Width: 0.15, Height: 1.3, Rotate: 45, Quality: 95, Signature: "c0ffee", Format: "png", CropX: 100, CropY: 200, CropWidth: 300, CropHeight: 400},
 			"0.15x1.3,r45,q95,sc0ffee,png,cx100,cy200,cw300,ch400",
 		},
+		{
+			Options{Width: 100, Format: "webp", Lossless: true},
+			"100x0,webp,lossless",
+		},
+		{
+			Options{Width: 100, DPR: 1.5},
+			"100x0,dpr1.5",
+		},
+		{
+			Options{Width: 100, Height: 100, Focal: true, FocalX: 0.25, FocalY: 0.75, FocalZoom: 2},
+			"100x100,fpx0.25,fpy0.75,fpz2",
+		},
+		{
+			Options{Width: 100, Height: 100, Focal: true},
+			"100x100,fpx0,fpy0",
+		},
+		{
+			Options{Width: 100, Height: 100, CropMode: "top-left"},
+			"100x100,crop-top-left",
+		},
+		{
+			Options{Width: 100, Height: 100, FitMode: "fill", Background: "ff000080"},
+			"100x100,fit-fill,bgff000080",
+		},
+		{
+			Options{Width: 100, Filter: "lanczos"},
+			"100x0,filter-lanczos",
+		},
+		{
+			Options{Blur: 2.5, Sharpen: 30, UnsharpAmount: 80, UnsharpRadius: 1.5, UnsharpThreshold: 4},
+			"0x0,blur2.5,sharp30,usma80,usmr1.5,usmt4",
+		},
+		{
+			Options{Brightness: 10, Contrast: -20, Saturation: 30, Hue: 90, Gamma: 2.2, Exposure: -1.5},
+			"0x0,exp-1.5,bri10,con-20,gam2.2,sat30,hue90",
+		},
+		{
+			Options{Mono: "gray", Sepia: 50, DuotoneShadow: "000000ff", DuotoneHighlight: "ff0000ff", Invert: true, Pixelate: 8},
+			"0x0,monogray,sepia50,duotone000000ff-ff0000ff,invert,px8",
+		},
+		{
+			Options{Width: 100, Mark: Mark{URL: "http://example.com/a,b.png", Pos: "top-left", Scale: 0.25, Alpha: 50, Pad: 10}},
+			"100x0,mark-aHR0cDovL2V4YW1wbGUuY29tL2EsYi5wbmc,markpos-top-left,markscale0.25,markalpha50,markpad10",
+		},
+		{
+			Options{Text: Text{Value: "SOLD OUT, sorry", Size: 0.2, Color: "ff0000ff", Font: "go-bold", Align: "center", Pad: 4, Shadow: "00000080"}},
+			"0x0,txt-U09MRCBPVVQsIHNvcnJ5,txtsize0.2,txtcolorff0000ff,txtfont-go-bold,txtalign-center,txtpad4,txtshadow00000080",
+		},
+		{
+			Options{Width: 100, Trim: "auto", TrimTolerance: 12},
+			"100x0,trimauto,trimtol12",
+		},
+		{
+			Options{Width: 100, AspectRatio: 1.5, DPR: 2},
+			"100x0,ar1.5,dpr2",
+		},
+		{
+			Options{Width: 100, Quality: 80, MaxBytes: 20000},
+			"100x0,q80,maxbytes20000",
+		},
+		{
+			Options{Subsampling: "444", Baseline: true, NoOptimize: true},
+			"0x0,chroma444,baseline,noopt",
+		},
+		{
+			Options{NoTrellis: true, JPEGQuant: "flat"},
+			"0x0,notrellis,jquant-flat",
+		},
+		{
+			Options{Format: "png", Colors: 64, Dither: true, PNGLevel: "fast", PNGOptimize: true},
+			"0x0,png,colors64,dither,pnglevel-fast,pngopt",
+		},
+		{
+			Options{Width: 100, Frame: 2, MaxFrames: 50, MaxDuration: 2.5},
+			"100x0,frame2,maxframes50,maxdur2.5",
+		},
+		{
+			Options{Width: 100, MaxWidth: 800, MaxHeight: 600, MinWidth: 50, MinHeight: 40},
+			"100x0,maxw800,maxh600,minw50,minh40",
+		},
+		{
+			Options{Width: 64, BorderWidth: 2, BorderColor: "ff0000ff", BorderRadius: 6, BorderOutside: true},
+			"64x0,border2-ff0000ff,borderradius6,borderout",
+		},
+		{
+			Options{Width: 64, Mask: "ellipse", CornerRadius: 0.25},
+			"64x0,maskellipse,corner0.25",
+		},
+		{
+			Options{Mask: "http://example.com/star.png", CornerRadius: 8},
+			"0x0,mask-aHR0cDovL2V4YW1wbGUuY29tL3N0YXIucG5n,corner8",
+		},
 	}
 
 	for i, tt := range tests {
@@ -42,6 +136,58 @@ func TestOptions_String(t *testing.T) {
 	}
 }
 
+func TestParseOptions(t *testing.T) {
+	tests := []struct {
+		String  string
+		Options Options
+	}{
+		{"", emptyOptions},
+		{"0x0", emptyOptions},
+		{"1x2,fit,r90,fv,fh,q80", Options{Width: 1, Height: 2, FitMode: "clip", Rotate: 90, FlipVertical: true, FlipHorizontal: true, Quality: 80}},
+		{"1x2,fit-clip", Options{Width: 1, Height: 2, FitMode: "clip"}},
+		{"1x2,fit-min", Options{Width: 1, Height: 2, FitMode: "min"}},
+		{"0.15x1.3,r45,q95,sc0ffee,png,cx100,cy200,cw300,ch400", Options{Width: 0.15, Height: 1.3, Rotate: 45, Quality: 95, Signature: "c0ffee", Format: "png", CropX: 100, CropY: 200, CropWidth: 300, CropHeight: 400}},
+		{"100x0,webp,lossless", Options{Width: 100, Format: "webp", Lossless: true}},
+		{"apng,maxframes10", Options{Format: "apng", MaxFrames: 10}},
+		{"100x0,auto", Options{Width: 100, Format: "auto"}},
+		{"100x0,auto,acceptwebp", Options{Width: 100, Format: "auto", AcceptWebP: true}},
+		{"100x0,dpr1.5", Options{Width: 100, DPR: 1.5}},
+		{"100x100,fpx0.25,fpy0.75,fpz2", Options{Width: 100, Height: 100, Focal: true, FocalX: 0.25, FocalY: 0.75, FocalZoom: 2}},
+		{"100x100,fpx0,fpy0", Options{Width: 100, Height: 100, Focal: true}},
+		{"100x100,crop-top-left", Options{Width: 100, Height: 100, CropMode: "top-left"}},
+		{"100x100,crop-entropy", Options{Width: 100, Height: 100, CropMode: "entropy"}},
+		{"100x100,fit-fill,bgff000080", Options{Width: 100, Height: 100, FitMode: "fill", Background: "ff000080"}},
+		{"100x0,filter-lanczos", Options{Width: 100, Filter: "lanczos"}},
+		{"r-12.5,bg00000000", Options{Rotate: -12.5, Background: "00000000"}},
+		{"0x0,exp-1.5,bri10,con-20,gam2.2,sat30,hue90", Options{Brightness: 10, Contrast: -20, Saturation: 30, Hue: 90, Gamma: 2.2, Exposure: -1.5}},
+		{"0x0,monogray,sepia50,duotone000000ff-ff0000ff,invert,px8", Options{Mono: "gray", Sepia: 50, DuotoneShadow: "000000ff", DuotoneHighlight: "ff0000ff", Invert: true, Pixelate: 8}},
+		{"0x0,monoff8000ff", Options{Mono: "ff8000ff"}},
+		{"0x0,px1", emptyOptions},
+		{"0x0,blur2.5,sharp30,usma80,usmr1.5,usmt4", Options{Blur: 2.5, Sharpen: 30, UnsharpAmount: 80, UnsharpRadius: 1.5, UnsharpThreshold: 4}},
+		{"100x100,fit-fill,bgblur", Options{Width: 100, Height: 100, FitMode: "fill", Background: "blur"}},
+		{"100x0,mark-aHR0cDovL2V4YW1wbGUuY29tL2EsYi5wbmc,markpos-top-left,markscale0.25,markalpha50,markpad10", Options{Width: 100, Mark: Mark{URL: "http://example.com/a,b.png", Pos: "top-left", Scale: 0.25, Alpha: 50, Pad: 10}}},
+		{"100x0,trimauto,trimtol12", Options{Width: 100, Trim: "auto", TrimTolerance: 12}},
+		{"0x0,trimffffff00", Options{Trim: "ffffff00"}},
+		{"100x0,ar1.5,dpr2", Options{Width: 100, AspectRatio: 1.5, DPR: 2}},
+		{"100x0,q80,maxbytes20000", Options{Width: 100, Quality: 80, MaxBytes: 20000}},
+		{"0x0,chroma444,baseline,noopt", Options{Subsampling: "444", Baseline: true, NoOptimize: true}},
+		{"0x0,notrellis,jquant-ms-ssim", Options{NoTrellis: true, JPEGQuant: "ms-ssim"}},
+		{"0x0,png,colors64,dither,pnglevel-fast,pngopt", Options{Format: "png", Colors: 64, Dither: true, PNGLevel: "fast", PNGOptimize: true}},
+		{"100x0,frame2,maxframes50,maxdur2.5", Options{Width: 100, Frame: 2, MaxFrames: 50, MaxDuration: 2.5}},
+		{"0.5x0,maxw800,maxh600,minw50,minh40", Options{Width: 0.5, MaxWidth: 800, MaxHeight: 600, MinWidth: 50, MinHeight: 40}},
+		{"64x0,border2-ff0000ff,borderradius6,borderout", Options{Width: 64, BorderWidth: 2, BorderColor: "ff0000ff", BorderRadius: 6, BorderOutside: true}},
+		{"64x0,maskellipse,corner0.25", Options{Width: 64, Mask: "ellipse", CornerRadius: 0.25}},
+		{"0x0,mask-aHR0cDovL2V4YW1wbGUuY29tL3N0YXIucG5n,corner8", Options{Mask: "http://example.com/star.png", CornerRadius: 8}},
+		{"0x0,txt-U09MRCBPVVQsIHNvcnJ5,txtsize0.2,txtcolorff0000ff,txtfont-go-bold,txtalign-center,txtpad4,txtshadow00000080", Options{Text: Text{Value: "SOLD OUT, sorry", Size: 0.2, Color: "ff0000ff", Font: "go-bold", Align: "center", Pad: 4, Shadow: "00000080"}}},
+	}
+
+	for _, tt := range tests {
+		if got, want := ParseOptions(tt.String), tt.Options; got != want {
+			t.Errorf("ParseOptions(%q) returned %#v, want %#v", tt.String, got, want)
+		}
+	}
+}
+
 func TestParseFormValues(t *testing.T) {
 	tests := []struct {
 		InputQS string
@@ -56,36 +202,229 @@ func TestParseFormValues(t *testing.T) {
 		// size variations
 		{"width=1", Options{Width: 1}},
 		{"height=1", Options{Height: 1}},
-		{"width=1&height=2", Options{Width: 1, Height: 2, Fit: true}},
+		{"width=1&height=2", Options{Width: 1, Height: 2, FitMode: "clip"}},
 		{"width=-1&height=-2", Options{Width: -1, Height: -2}},
-		{"width=0.1&height=0.2", Options{Width: 0.1, Height: 0.2, Fit: true}},
-		{"size=1", Options{Width: 1, Height: 1, Fit: true}},
-		{"size=0.1", Options{Width: 0.1, Height: 0.1, Fit: true}},
+		{"width=0.1&height=0.2", Options{Width: 0.1, Height: 0.2, FitMode: "clip"}},
+		{"size=1", Options{Width: 1, Height: 1, FitMode: "clip"}},
+		{"size=0.1", Options{Width: 0.1, Height: 0.1, FitMode: "clip"}},
+
+		// aspect ratios
+		{"width=160&ar=16:9", Options{Width: 160, AspectRatio: 16.0 / 9}},
+		{"ar=1.5", Options{AspectRatio: 1.5}},
+		{"ar=1:2", Options{AspectRatio: 0.5}},
+		{"ar=0:1", emptyOptions},
+		{"ar=1:0", emptyOptions},
+		{"ar=1:2:3", emptyOptions},
+		{"ar=wide", emptyOptions},
+		{"ar=1000", emptyOptions},
+
+		// size limits
+		{"width=0.5&max-w=800&min-h=100", Options{Width: 0.5, MaxWidth: 800, MinHeight: 100}},
+		{"max-h=600&min-w=50", Options{MaxHeight: 600, MinWidth: 50}},
+		{"max-w=-1", emptyOptions},
+		{"min-h=tall", emptyOptions},
+
+		// size budget
+		{"max-bytes=20000&quality=80", Options{Quality: 80, MaxBytes: 20000}},
+		{"max-bytes=0", emptyOptions},
+		{"max-bytes=20k", emptyOptions},
+
+		// png encoding
+		{"colors=16&dither=true&png-level=fast&png-optimize=true", Options{Colors: 16, Dither: true, PNGLevel: "fast", PNGOptimize: true}},
+		{"colors=1", emptyOptions},
+		{"colors=257", emptyOptions},
+		{"png-level=9", emptyOptions},
+
+		// animated gif
+		{"frame=1&max-frames=50&max-duration=2.5", Options{Frame: 1, MaxFrames: 50, MaxDuration: 2.5}},
+		{"frame=0", emptyOptions},
+		{"max-frames=0", emptyOptions},
+		{"max-duration=-1", emptyOptions},
 
 		// additional flags
-		{"mode=fit", Options{Fit: true}},
+		{"mode=fit", Options{FitMode: "clip"}},
 		{"rotate=90", Options{Rotate: 90}},
+		{"rotate=12.5", Options{Rotate: 12.5}},
+		{"rotate=-45&bg=000", Options{Rotate: -45, Background: "000000ff"}},
+		{"rotate=NaN", emptyOptions},
+		{"rotate=Inf", emptyOptions},
+		{"rotate=x", emptyOptions},
 		{"flip=v", Options{FlipVertical: true}},
 		{"flip=h", Options{FlipHorizontal: true}},
 		{"format=jpeg", Options{Format: "jpeg"}},
+		{"format=webp", Options{Format: "webp"}},
+		{"format=webp&lossless=true", Options{Format: "webp", Lossless: true}},
+		{"format=webp&lossless=0", Options{Format: "webp"}},
+		{"format=apng", Options{Format: "apng"}},
+		{"format=auto", Options{Format: "auto"}},
+		{"dpr=2", Options{DPR: 2}},
+		{"width=100&dpr=1.5", Options{Width: 100, DPR: 1.5}},
+		{"dpr=0.5", emptyOptions},
+		{"dpr=6", emptyOptions},
+		{"dpr=x", emptyOptions},
+
+		// focal point
+		{"fp-x=0.25&fp-y=0.75", Options{Focal: true, FocalX: 0.25, FocalY: 0.75}},
+		{"fp-x=0.25", Options{Focal: true, FocalX: 0.25, FocalY: 0.5}},
+		{"fp-y=0", Options{Focal: true, FocalX: 0.5}},
+		{"fp-x=0&fp-y=0", Options{Focal: true}},
+		{"size=100&fp-x=0.25", Options{Width: 100, Height: 100, Focal: true, FocalX: 0.25, FocalY: 0.5}},
+		{"size=100&fp-x=0.25&fit=clip", Options{Width: 100, Height: 100, Focal: true, FocalX: 0.25, FocalY: 0.5, FitMode: "clip"}},
+		{"fp-z=2", Options{FocalZoom: 2}},
+		{"fp-x=1.5&fp-y=-1&fp-z=0.5", emptyOptions},
+
+		// crop modes
+		{"crop=top", Options{CropMode: "top"}},
+		{"crop=right", Options{CropMode: "right"}},
+		{"crop=top,left", Options{CropMode: "top-left"}},
+		{"crop=right,bottom", Options{CropMode: "bottom-right"}},
+		{"crop=entropy", Options{CropMode: "entropy"}},
+		{"size=100&crop=bottom", Options{Width: 100, Height: 100, CropMode: "bottom"}},
+		{"size=100&crop=bottom&mode=fit", Options{Width: 100, Height: 100, FitMode: "clip", CropMode: "bottom"}},
+		{"crop=top,bottom", emptyOptions},
+		{"crop=entropy,left", emptyOptions},
+		{"crop=middle", emptyOptions},
+
+		// fit modes
+		{"size=100&fit=clip", Options{Width: 100, Height: 100, FitMode: "clip"}},
+		{"size=100&fit=crop", Options{Width: 100, Height: 100, FitMode: "crop"}},
+		{"size=100&fit=scale", Options{Width: 100, Height: 100, FitMode: "scale"}},
+		{"size=100&fit=max", Options{Width: 100, Height: 100, FitMode: "max"}},
+		{"size=100&fit=min", Options{Width: 100, Height: 100, FitMode: "min"}},
+		{"size=100&fit=bogus", Options{Width: 100, Height: 100, FitMode: "clip"}},
+		{"fit=max", Options{FitMode: "max"}},
+
+		// resampling filters
+		{"filter=nearest", Options{Filter: "nearest"}},
+		{"filter=box", Options{Filter: "box"}},
+		{"filter=linear", Options{Filter: "linear"}},
+		{"filter=catmullrom", Options{Filter: "catmullrom"}},
+		{"filter=lanczos", Options{Filter: "lanczos"}},
+		{"filter=mitchell", Options{Filter: "mitchell"}},
+		{"filter=hermite", emptyOptions},
+
+		// color adjustments
+		{"bri=10&con=-20&sat=-100", Options{Brightness: 10, Contrast: -20, Saturation: -100}},
+		{"bri=101", emptyOptions},
+		{"con=-101", emptyOptions},
+		{"sat=x", emptyOptions},
+		{"hue=90", Options{Hue: 90}},
+		{"hue=-90", Options{Hue: 270}},
+		{"hue=360", emptyOptions},
+		{"hue=361", emptyOptions},
+		{"gam=2.2", Options{Gamma: 2.2}},
+		{"gam=0", emptyOptions},
+		{"gam=11", emptyOptions},
+		{"exp=-1.5", Options{Exposure: -1.5}},
+		{"exp=6", emptyOptions},
+
+		// effects
+		{"mono=true", Options{Mono: "gray"}},
+		{"mono=1", Options{Mono: "gray"}},
+		{"mono=false", emptyOptions},
+		{"mono=f80", Options{Mono: "ff8800ff"}},
+		{"mono=pink", emptyOptions},
+		{"sepia=80", Options{Sepia: 80}},
+		{"sepia=0", emptyOptions},
+		{"sepia=101", emptyOptions},
+		{"duotone=000,FFFFFF80", Options{DuotoneShadow: "000000ff", DuotoneHighlight: "ffffff80"}},
+		{"duotone=000", emptyOptions},
+		{"duotone=000,fff,f00", emptyOptions},
+		{"duotone=000,xyz", emptyOptions},
+		{"invert=true", Options{Invert: true}},
+		{"invert=no", emptyOptions},
+		{"px=10", Options{Pixelate: 10}},
+		{"px=0", emptyOptions},
+		{"px=1", emptyOptions},
+		{"px=101", emptyOptions},
+		{"px=1.5", emptyOptions},
+
+		// text
+		{"txt=SOLD+OUT", Options{Text: Text{Value: "SOLD OUT"}}},
+		{"txt=%E2%82%AC9,99&txt-size=32&txt-color=f00&txt-font=Brand_Bold&txt-align=top-right&txt-pad=0.05", Options{Text: Text{Value: "€9,99", Size: 32, Color: "ff0000ff", Font: "brand_bold", Align: "top-right", Pad: 0.05}}},
+		{"txt=a&txt-shadow=true", Options{Text: Text{Value: "a", Shadow: "00000080"}}},
+		{"txt=a&txt-shadow=fff8", Options{Text: Text{Value: "a", Shadow: "ffffff88"}}},
+		{"txt=a&txt-shadow=false&txt-size=0&txt-color=pink&txt-font=../x&txt-align=middle&txt-pad=-1", Options{Text: Text{Value: "a"}}},
+		{"txt=a&txt-size=1001", Options{Text: Text{Value: "a"}}},
+
+		// borders
+		{"border=4", Options{BorderWidth: 4, BorderColor: "000000ff"}},
+		{"border=4,f00", Options{BorderWidth: 4, BorderColor: "ff0000ff"}},
+		{"border=4,f00&border-radius=8&border-outside=true", Options{BorderWidth: 4, BorderColor: "ff0000ff", BorderRadius: 8, BorderOutside: true}},
+		{"border=0,f00", emptyOptions},
+		{"border=1.5", emptyOptions},
+		{"border=1001", emptyOptions},
+		{"border=4,red", emptyOptions},
+		{"border-radius=-1&border-outside=maybe", emptyOptions},
+
+		// trim
+		{"trim=auto", Options{Trim: "auto"}},
+		{"trim=true", Options{Trim: "auto"}},
+		{"trim=false", emptyOptions},
+		{"trim=fff&trim-tol=10", Options{Trim: "ffffffff", TrimTolerance: 10}},
+		{"trim=borders", emptyOptions},
+		{"trim-tol=256", emptyOptions},
+		{"trim-tol=-1", emptyOptions},
+
+		// masks
+		{"mask=ellipse", Options{Mask: "ellipse"}},
+		{"mask=shapes/star.png", Options{Mask: "shapes/star.png"}},
+		{"corner-radius=8", Options{CornerRadius: 8}},
+		{"corner-radius=0.5", Options{CornerRadius: 0.5}},
+		{"corner-radius=-1", emptyOptions},
+		{"corner-radius=round", emptyOptions},
+
+		// watermark
+		{"mark=logo.png", Options{Mark: Mark{URL: "logo.png"}}},
+		{"mark=logo.png&mark-pos=top-left", Options{Mark: Mark{URL: "logo.png", Pos: "top-left"}}},
+		{"mark=logo.png&mark-pos=right,top", Options{Mark: Mark{URL: "logo.png", Pos: "top-right"}}},
+		{"mark=logo.png&mark-pos=center", Options{Mark: Mark{URL: "logo.png", Pos: "center"}}},
+		{"mark=logo.png&mark-pos=entropy", Options{Mark: Mark{URL: "logo.png"}}},
+		{"mark=logo.png&mark-pos=middle", Options{Mark: Mark{URL: "logo.png"}}},
+		{"mark=logo.png&mark-scale=0.2&mark-alpha=40&mark-pad=0.05", Options{Mark: Mark{URL: "logo.png", Scale: 0.2, Alpha: 40, Pad: 0.05}}},
+		{"mark=logo.png&mark-scale=2&mark-alpha=0&mark-pad=-1", Options{Mark: Mark{URL: "logo.png"}}},
+
+		// blur and sharpen
+		{"blur=2.5", Options{Blur: 2.5}},
+		{"blur=0", emptyOptions},
+		{"blur=101", emptyOptions},
+		{"sharp=30", Options{Sharpen: 30}},
+		{"sharp=-1", emptyOptions},
+		{"usm=80", Options{UnsharpAmount: 80, UnsharpRadius: 1}},
+		{"usm=80,1.5,4", Options{UnsharpAmount: 80, UnsharpRadius: 1.5, UnsharpThreshold: 4}},
+		{"usm=80,0", emptyOptions},
+		{"usm=80,1,256", emptyOptions},
+		{"usm=80,1,4,1", emptyOptions},
+		{"usm=x", emptyOptions},
+
+		// padding
+		{"size=100&fit=fill", Options{Width: 100, Height: 100, FitMode: "fill"}},
+		{"fit=fill&bg=F00", Options{FitMode: "fill", Background: "ff0000ff"}},
+		{"fit=fill&bg=%23f008", Options{FitMode: "fill", Background: "ff000088"}},
+		{"fit=fill&bg=00ff00", Options{FitMode: "fill", Background: "00ff00ff"}},
+		{"fit=fill&bg=00ff0080", Options{FitMode: "fill", Background: "00ff0080"}},
+		{"fit=fill&bg=blur", Options{FitMode: "fill", Background: "blur"}},
+		{"bg=ff", emptyOptions},
+		{"bg=gggggg", emptyOptions},
+		{"bg=-fffff", emptyOptions},
 
 		// mix of valid and invalid flags
-		{"FOO=BAR&size=1&BAR=foo&rotate=90&BAZ=DAS", Options{Width: 1, Height: 1, Rotate: 90, Fit: true}},
+		{"FOO=BAR&size=1&BAR=foo&rotate=90&BAZ=DAS", Options{Width: 1, Height: 1, Rotate: 90, FitMode: "clip"}},
 
 		// flags, in different orders
-		{"quality=70&width=1&height=2&mode=fit&rotate=90&flip=v&flip=h&signature=c0ffee&format=png", Options{1, 2, true, 90, true, true, 70, "c0ffee", false, "png", 0, 0, 0, 0, false}},
-		{"rotate=90&flip=h&signature=c0ffee&format=png&quality=90&width=1&height=2&flip=v&mode=fit", Options{1, 2, true, 90, true, true, 90, "c0ffee", false, "png", 0, 0, 0, 0, false}},
+		{"quality=70&width=1&height=2&mode=fit&rotate=90&flip=v&flip=h&signature=c0ffee&format=png", Options{Width: 1, Height: 2, FitMode: "clip", Rotate: 90, FlipVertical: true, FlipHorizontal: true, Quality: 70, Signature: "c0ffee", Format: "png"}},
+		{"rotate=90&flip=h&signature=c0ffee&format=png&quality=90&width=1&height=2&flip=v&mode=fit", Options{Width: 1, Height: 2, FitMode: "clip", Rotate: 90, FlipVertical: true, FlipHorizontal: true, Quality: 90, Signature: "c0ffee", Format: "png"}},
 
 		// all flags, in different orders with crop
-		{"quality=70&width=1&height=2&mode=fit&crop=100,200,300,400&rotate=90&flip=v&flip=h&signature=c0ffee&format=png", Options{1, 2, true, 90, true, true, 70, "c0ffee", false, "png", 100, 200, 300, 400, false}},
-		{"rotate=90&flip=h&signature=c0ffee&format=png&crop=100,200,300,400&quality=90&width=1&height=2&flip=v&mode=fit", Options{1, 2, true, 90, true, true, 90, "c0ffee", false, "png", 100, 200, 300, 400, false}},
+		{"quality=70&width=1&height=2&mode=fit&crop=100,200,300,400&rotate=90&flip=v&flip=h&signature=c0ffee&format=png", Options{Width: 1, Height: 2, FitMode: "clip", Rotate: 90, FlipVertical: true, FlipHorizontal: true, Quality: 70, Signature: "c0ffee", Format: "png", CropX: 100, CropY: 200, CropWidth: 300, CropHeight: 400}},
+		{"rotate=90&flip=h&signature=c0ffee&format=png&crop=100,200,300,400&quality=90&width=1&height=2&flip=v&mode=fit", Options{Width: 1, Height: 2, FitMode: "clip", Rotate: 90, FlipVertical: true, FlipHorizontal: true, Quality: 90, Signature: "c0ffee", Format: "png", CropX: 100, CropY: 200, CropWidth: 300, CropHeight: 400}},
 
 		// all flags, in different orders with crop & different resizes
-		{"quality=70&crop=100,200,300,400&height=2&mode=fit&rotate=90&flip=v&flip=h&signature=c0ffee&format=png", Options{0, 2, true, 90, true, true, 70, "c0ffee", false, "png", 100, 200, 300, 400, false}},
-		{"crop=100,200,300,400&rotate=90&flip=h&quality=90&signature=c0ffee&format=png&width=1&flip=v&mode=fit", Options{1, 0, true, 90, true, true, 90, "c0ffee", false, "png", 100, 200, 300, 400, false}},
-		{"crop=100,200,300,400&rotate=90&flip=h&signature=c0ffee&flip=v&format=png&quality=90&mode=fit", Options{0, 0, true, 90, true, true, 90, "c0ffee", false, "png", 100, 200, 300, 400, false}},
-		{"crop=100,200,0,400&rotate=90&quality=90&flip=h&signature=c0ffee&format=png&flip=v&mode=fit&width=123&height=321", Options{123, 321, true, 90, true, true, 90, "c0ffee", false, "png", 100, 200, 0, 400, false}},
-		{"flip=v&width=123&height=321&crop=100,200,300,400&quality=90&rotate=90&flip=h&signature=c0ffee&format=png&mode=fit", Options{123, 321, true, 90, true, true, 90, "c0ffee", false, "png", 100, 200, 300, 400, false}},
+		{"quality=70&crop=100,200,300,400&height=2&mode=fit&rotate=90&flip=v&flip=h&signature=c0ffee&format=png", Options{Height: 2, FitMode: "clip", Rotate: 90, FlipVertical: true, FlipHorizontal: true, Quality: 70, Signature: "c0ffee", Format: "png", CropX: 100, CropY: 200, CropWidth: 300, CropHeight: 400}},
+		{"crop=100,200,300,400&rotate=90&flip=h&quality=90&signature=c0ffee&format=png&width=1&flip=v&mode=fit", Options{Width: 1, FitMode: "clip", Rotate: 90, FlipVertical: true, FlipHorizontal: true, Quality: 90, Signature: "c0ffee", Format: "png", CropX: 100, CropY: 200, CropWidth: 300, CropHeight: 400}},
+		{"crop=100,200,300,400&rotate=90&flip=h&signature=c0ffee&flip=v&format=png&quality=90&mode=fit", Options{FitMode: "clip", Rotate: 90, FlipVertical: true, FlipHorizontal: true, Quality: 90, Signature: "c0ffee", Format: "png", CropX: 100, CropY: 200, CropWidth: 300, CropHeight: 400}},
+		{"crop=100,200,0,400&rotate=90&quality=90&flip=h&signature=c0ffee&format=png&flip=v&mode=fit&width=123&height=321", Options{Width: 123, Height: 321, FitMode: "clip", Rotate: 90, FlipVertical: true, FlipHorizontal: true, Quality: 90, Signature: "c0ffee", Format: "png", CropX: 100, CropY: 200, CropHeight: 400}},
+		{"flip=v&width=123&height=321&crop=100,200,300,400&quality=90&rotate=90&flip=h&signature=c0ffee&format=png&mode=fit", Options{Width: 123, Height: 321, FitMode: "clip", Rotate: 90, FlipVertical: true, FlipHorizontal: true, Quality: 90, Signature: "c0ffee", Format: "png", CropX: 100, CropY: 200, CropWidth: 300, CropHeight: 400}},
 	}
 
 	for _, tt := range tests {
@@ -127,6 +466,28 @@ func TestNewRequest(t *testing.T) {
 			"http://example.com/?width=1&height=s", Options{Width: 1}, false,
 		},
 
+		// combinations of options that cannot be honored
+		{"http://localhost/http://example.com/foo?rotate=45&bg=blur", "", emptyOptions, true},
+		{"http://localhost/http://example.com/foo?mask=ftp://example.com/star.png", "", emptyOptions, true},
+		{"http://localhost/http://example.com/foo?rotate=45&bg=0008&format=jpeg", "", emptyOptions, true},
+		{"http://localhost/http://example.com/foo?size=10&fit=fill&bg=0008&format=jpeg", "", emptyOptions, true},
+		{
+			"http://localhost/http://example.com/a/foo?mask=star.png",
+			"http://example.com/a/foo?mask=star.png", Options{Mask: "http://example.com/a/star.png"}, false,
+		},
+		{
+			"http://localhost/http://example.com/a/foo?mask=ellipse",
+			"http://example.com/a/foo?mask=ellipse", Options{Mask: "ellipse"}, false,
+		},
+		{
+			"http://localhost/http://example.com/foo?rotate=45&bg=0008&format=png",
+			"http://example.com/foo?rotate=45&bg=0008&format=png", Options{Rotate: 45, Background: "00000088", Format: "png"}, false,
+		},
+		{
+			"http://localhost/http://example.com/foo?rotate=90&bg=blur",
+			"http://example.com/foo?rotate=90&bg=blur", Options{Rotate: 90, Background: "blur"}, false,
+		},
+
 		// valid URLs. the recognized query parameters are dropped just before querying upstream, so they
 		// are present in RemoteURLs in this phase :(
 		{
@@ -139,11 +500,11 @@ func TestNewRequest(t *testing.T) {
 		},
 		{
 			"http://localhost/http://example.com/foo?width=1&height=2",
-			"http://example.com/foo?width=1&height=2", Options{Width: 1, Height: 2, Fit: true}, false,
+			"http://example.com/foo?width=1&height=2", Options{Width: 1, Height: 2, FitMode: "clip"}, false,
 		},
 		{
 			"http://localhost/http://example.com/foo?width=1&height=2&bar=baz",
-			"http://example.com/foo?width=1&height=2&bar=baz", Options{Width: 1, Height: 2, Fit: true}, false,
+			"http://example.com/foo?width=1&height=2&bar=baz", Options{Width: 1, Height: 2, FitMode: "clip"}, false,
 		},
 		{
 			"http://localhost/http:/example.com/foo",
@@ -169,11 +530,11 @@ func TestNewRequest(t *testing.T) {
 		},
 		{
 			"http://localhost/prefix/http://example.com/foo?width=1&height=2",
-			"http://example.com/foo?width=1&height=2", Options{Width: 1, Height: 2, Fit: true}, false,
+			"http://example.com/foo?width=1&height=2", Options{Width: 1, Height: 2, FitMode: "clip"}, false,
 		},
 		{
 			"http://localhost/prefix/http://example.com/foo?width=1&height=2&bar=baz",
-			"http://example.com/foo?width=1&height=2&bar=baz", Options{Width: 1, Height: 2, Fit: true}, false,
+			"http://example.com/foo?width=1&height=2&bar=baz", Options{Width: 1, Height: 2, FitMode: "clip"}, false,
 		},
 		{
 			"http://localhost/prefix/http:/example.com/foo",
@@ -225,6 +586,342 @@ func TestNewRequest(t *testing.T) {
 	}
 }
 
+func TestNewRequest_Mark(t *testing.T) {
+	forced := Mark{URL: "https://example.com/forced.png", Alpha: 50}
+	configMap := map[string]*SourceConfiguration{
+		"/forced": {Mark: forced},
+		"/prefix": {},
+	}
+
+	tests := []struct {
+		URL         string // input URL to parse as an imageproxy request
+		Mark        Mark   // expected watermark
+		ExpectError bool   // whether an error is expected from NewRequest
+	}{
+		{"http://localhost/prefix/http://example.com/a/foo.jpg?mark=logo.png", Mark{URL: "http://example.com/a/logo.png"}, false},
+		{"http://localhost/prefix/http://example.com/a/foo.jpg?mark=/logo.png", Mark{URL: "http://example.com/logo.png"}, false},
+		{"http://localhost/prefix/http://example.com/foo.jpg?mark=https://marks.test/logo.png&mark-pos=top", Mark{URL: "https://marks.test/logo.png", Pos: "top"}, false},
+		{"http://localhost/prefix/http://example.com/foo.jpg?mark=ftp://marks.test/logo.png", Mark{}, true},
+		{"http://localhost/forced/http://example.com/foo.jpg", forced, false},
+		{"http://localhost/forced/http://example.com/foo.jpg?mark=logo.png&mark-alpha=100", forced, false},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.URL, nil)
+		if err != nil {
+			t.Errorf("http.NewRequest(%q) returned error: %v", tt.URL, err)
+			continue
+		}
+
+		r, err := NewRequest(req, configMap)
+		if tt.ExpectError {
+			if err == nil {
+				t.Errorf("NewRequest(%q) did not return expected error", tt.URL)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("NewRequest(%q) return unexpected error: %v", tt.URL, err)
+			continue
+		}
+
+		if got, want := r.Options.Mark, tt.Mark; got != want {
+			t.Errorf("NewRequest(%q) watermark = %#v, want %#v", tt.URL, got, want)
+		}
+	}
+}
+
+func TestNewRequest_SizeCaps(t *testing.T) {
+	configMap := map[string]*SourceConfiguration{
+		"/capped": {MaxWidth: 1000, MaxHeight: 800},
+		"/prefix": {},
+	}
+
+	tests := []struct {
+		URL                 string // input URL to parse as an imageproxy request
+		MaxWidth, MaxHeight int    // expected size limits
+	}{
+		{"http://localhost/prefix/http://example.com/foo.jpg?max-w=2000", 2000, 0},
+		{"http://localhost/capped/http://example.com/foo.jpg", 1000, 800},
+		{"http://localhost/capped/http://example.com/foo.jpg?max-w=500", 500, 800},
+		{"http://localhost/capped/http://example.com/foo.jpg?max-w=2000&max-h=0", 1000, 800},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.URL, nil)
+		if err != nil {
+			t.Errorf("http.NewRequest(%q) returned error: %v", tt.URL, err)
+			continue
+		}
+
+		r, err := NewRequest(req, configMap)
+		if err != nil {
+			t.Errorf("NewRequest(%q) return unexpected error: %v", tt.URL, err)
+			continue
+		}
+
+		if r.Options.MaxWidth != tt.MaxWidth || r.Options.MaxHeight != tt.MaxHeight {
+			t.Errorf("NewRequest(%q) size limits = %dx%d, want %dx%d", tt.URL, r.Options.MaxWidth, r.Options.MaxHeight, tt.MaxWidth, tt.MaxHeight)
+		}
+	}
+
+	// limits larger than any image are rejected
+	for _, u := range []string{
+		"http://localhost/prefix/http://example.com/foo.jpg?min-w=200000",
+		"http://localhost/prefix/http://example.com/foo.jpg?max-h=16385",
+	} {
+		req, _ := http.NewRequest("GET", u, nil)
+		if _, err := NewRequest(req, configMap); err == nil {
+			t.Errorf("NewRequest(%q) did not return expected error", u)
+		}
+	}
+}
+
+func TestNewRequest_FormatNegotiation(t *testing.T) {
+	tests := []struct {
+		URL           string // input URL to parse as an imageproxy request
+		Accept        string // Accept header of the request
+		DefaultFormat string // default format of the prefix
+		Format        string // expected format
+		AcceptWebP    bool   // whether webp is expected to be accepted
+		Vary          bool   // whether the request is expected to vary by Accept
+	}{
+		{"http://localhost/http://example.com/foo", "image/webp,*/*", "", "", false, false},
+		{"http://localhost/http://example.com/foo?format=png", "image/webp,*/*", "", "png", false, false},
+		{"http://localhost/http://example.com/foo?format=auto", "image/webp,image/*,*/*;q=0.8", "", "auto", true, true},
+		{"http://localhost/http://example.com/foo?format=auto", "image/png,image/*;q=0.8", "", "auto", false, true},
+		{"http://localhost/http://example.com/foo?format=auto", "image/WebP; q=0.5", "", "auto", true, true},
+		{"http://localhost/http://example.com/foo?format=auto", "image/webp;q=0", "", "auto", false, true},
+		{"http://localhost/http://example.com/foo?format=auto", "", "", "auto", false, true},
+		{"http://localhost/prefix/http://example.com/foo", "image/webp", "auto", "auto", true, true},
+		{"http://localhost/prefix/http://example.com/foo?format=jpeg", "image/webp", "auto", "jpeg", false, false},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.URL, nil)
+		if err != nil {
+			t.Errorf("http.NewRequest(%q) returned error: %v", tt.URL, err)
+			continue
+		}
+		req.Header.Set("Accept", tt.Accept)
+
+		configMap := map[string]*SourceConfiguration{
+			"/prefix": {DefaultOptions: Options{Format: tt.DefaultFormat}},
+		}
+		r, err := NewRequest(req, configMap)
+		if err != nil {
+			t.Errorf("NewRequest(%q) return unexpected error: %v", tt.URL, err)
+			continue
+		}
+
+		if got, want := r.Options.Format, tt.Format; got != want {
+			t.Errorf("NewRequest(%q) with Accept %q returned format %q, want %q", tt.URL, tt.Accept, got, want)
+		}
+		if got, want := r.Options.AcceptWebP, tt.AcceptWebP; got != want {
+			t.Errorf("NewRequest(%q) with Accept %q returned AcceptWebP %v, want %v", tt.URL, tt.Accept, got, want)
+		}
+		if got, want := len(r.Vary) == 1 && r.Vary[0] == "Accept", tt.Vary; got != want {
+			t.Errorf("NewRequest(%q) returned Vary %v", tt.URL, r.Vary)
+		}
+	}
+}
+
+func TestRequest_applyClientHints(t *testing.T) {
+	tests := []struct {
+		Headers map[string]string
+		Options Options // options before applying hints
+		Want    Options // options after applying hints
+	}{
+		{nil, emptyOptions, emptyOptions},
+		{nil, Options{Width: 100, Quality: 80}, Options{Width: 100, Quality: 80}},
+
+		// pixel ratio
+		{map[string]string{"Sec-CH-DPR": "2"}, Options{Width: 100, Height: 50}, Options{Width: 100, Height: 50, DPR: 2}},
+		{map[string]string{"Sec-CH-DPR": "2"}, Options{Width: 100, DPR: 3}, Options{Width: 100, DPR: 3}},
+		{map[string]string{"Sec-CH-DPR": "0.5"}, Options{Width: 100}, Options{Width: 100, DPR: 1}},
+		{map[string]string{"Sec-CH-DPR": "8"}, Options{Width: 100}, Options{Width: 100, DPR: 5}},
+		{map[string]string{"Sec-CH-DPR": "x"}, Options{Width: 100}, Options{Width: 100}},
+		{map[string]string{"Sec-CH-DPR": "-1"}, Options{Width: 100}, Options{Width: 100}},
+
+		// width caps
+		{map[string]string{"Sec-CH-Width": "300"}, emptyOptions, Options{Width: 300}},
+		{map[string]string{"Sec-CH-Width": "300"}, Options{Width: 200}, Options{Width: 200}},
+		{map[string]string{"Sec-CH-Width": "300"}, Options{Width: 600, Height: 400}, Options{Width: 300, Height: 200}},
+		{map[string]string{"Sec-CH-Width": "300", "Sec-CH-DPR": "2"}, emptyOptions, Options{Width: 150, DPR: 2}},
+		{map[string]string{"Sec-CH-Width": "300", "Sec-CH-DPR": "2"}, Options{Width: 200, Height: 100}, Options{Width: 150, Height: 75, DPR: 2}},
+		{map[string]string{"Sec-CH-Viewport-Width": "400", "Sec-CH-DPR": "2"}, Options{Width: 1000}, Options{Width: 400, DPR: 2}},
+		{map[string]string{"Sec-CH-Viewport-Width": "400", "Sec-CH-Width": "300"}, emptyOptions, Options{Width: 300}},
+		{map[string]string{"Sec-CH-Width": "300"}, Options{Width: 0.5}, Options{Width: 0.5}},
+		{map[string]string{"Sec-CH-Width": "300"}, Options{Height: 400}, Options{Height: 400, MaxWidth: 300}},
+		{map[string]string{"Sec-CH-Width": "300"}, Options{Height: 400, MaxWidth: 200}, Options{Height: 400, MaxWidth: 200}},
+		{map[string]string{"Sec-CH-Width": "300"}, Options{Height: 400, MaxWidth: 500}, Options{Height: 400, MaxWidth: 300}},
+		{map[string]string{"Sec-CH-Viewport-Width": "400", "Sec-CH-DPR": "2"}, Options{Height: 400}, Options{Height: 400, DPR: 2, MaxWidth: 800}},
+		{map[string]string{"Sec-CH-Width": "100000"}, Options{Height: 400}, Options{Height: 400, MaxWidth: maxDimension}},
+		{map[string]string{"Sec-CH-Width": "300"}, Options{Height: 0.5}, Options{Height: 0.5}},
+		{map[string]string{"Sec-CH-Width": "1", "Sec-CH-DPR": "5"}, emptyOptions, Options{Width: 1, DPR: 5}},
+		{map[string]string{"Sec-CH-Width": "2", "Sec-CH-DPR": "4"}, Options{Width: 100, Height: 10}, Options{Width: 1, Height: 1, DPR: 4}},
+
+		// reduced data usage
+		{map[string]string{"Save-Data": "on"}, emptyOptions, Options{Quality: saveDataQuality}},
+		{map[string]string{"Save-Data": "on"}, Options{Quality: 90}, Options{Quality: saveDataQuality}},
+		{map[string]string{"Save-Data": "on"}, Options{Quality: 30}, Options{Quality: 30}},
+		{map[string]string{"Save-Data": "off"}, Options{Quality: 90}, Options{Quality: 90}},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "http://localhost/http://example.com/foo", nil)
+		for k, v := range tt.Headers {
+			req.Header.Set(k, v)
+		}
+		r := &Request{Options: tt.Options, Original: req}
+		r.applyClientHints()
+		if got, want := r.Options, tt.Want; got != want {
+			t.Errorf("applyClientHints(%v) with options %#v returned %#v, want %#v", tt.Headers, tt.Options, got, want)
+		}
+		if got, want := r.Vary, []string{"Sec-CH-DPR", "Sec-CH-Width", "Sec-CH-Viewport-Width", "Save-Data"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("applyClientHints(%v) returned Vary %v, want %v", tt.Headers, got, want)
+		}
+	}
+}
+
+func TestParseFormValues_FocalPointDefaults(t *testing.T) {
+	defaults := Options{Focal: true, FocalX: 0.25, FocalY: 0.75}
+	tests := []struct {
+		InputQS string
+		Options Options
+	}{
+		{"", defaults},
+		{"fp-x=0.5", Options{Focal: true, FocalX: 0.5, FocalY: 0.75}},
+		{"fp-y=0", Options{Focal: true, FocalX: 0.25}},
+		{"size=100", Options{Width: 100, Height: 100, Focal: true, FocalX: 0.25, FocalY: 0.75}},
+	}
+
+	for _, tt := range tests {
+		input, err := url.ParseQuery(tt.InputQS)
+		if err != nil {
+			panic(err)
+		}
+
+		if got, want := ParseFormValues(input, defaults), tt.Options; got != want {
+			t.Errorf("ParseFormValues(%q) returned %#v, want %#v", tt.InputQS, got, want)
+		}
+	}
+}
+
+func TestParseFormValues_FitModeDefaults(t *testing.T) {
+	defaults := Options{FitMode: "fill"}
+	tests := []struct {
+		InputQS string
+		Options Options
+	}{
+		{"size=100", Options{Width: 100, Height: 100, FitMode: "fill"}},
+		{"size=100&fit=crop", Options{Width: 100, Height: 100, FitMode: "crop"}},
+		{"size=100&mode=fit", Options{Width: 100, Height: 100, FitMode: "clip"}},
+	}
+
+	for _, tt := range tests {
+		input, err := url.ParseQuery(tt.InputQS)
+		if err != nil {
+			panic(err)
+		}
+
+		if got, want := ParseFormValues(input, defaults), tt.Options; got != want {
+			t.Errorf("ParseFormValues(%q) returned %#v, want %#v", tt.InputQS, got, want)
+		}
+	}
+}
+
+func TestParseFormValues_CropModeDefaults(t *testing.T) {
+	defaults := Options{CropMode: "top-left"}
+	tests := []struct {
+		InputQS string
+		Options Options
+	}{
+		{"size=100", Options{Width: 100, Height: 100, CropMode: "top-left"}},
+		{"size=100&mode=fit", Options{Width: 100, Height: 100, FitMode: "clip", CropMode: "top-left"}},
+		{"width=100", Options{Width: 100, CropMode: "top-left"}},
+	}
+
+	for _, tt := range tests {
+		input, err := url.ParseQuery(tt.InputQS)
+		if err != nil {
+			panic(err)
+		}
+
+		if got, want := ParseFormValues(input, defaults), tt.Options; got != want {
+			t.Errorf("ParseFormValues(%q) returned %#v, want %#v", tt.InputQS, got, want)
+		}
+	}
+}
+
+func TestParseFormValues_JPEGDefaults(t *testing.T) {
+	defaults := Options{Subsampling: "444", Baseline: true, NoOptimize: true, NoTrellis: true, JPEGQuant: "flat"}
+	tests := []struct {
+		InputQS string
+		Options Options
+	}{
+		{"width=100", Options{Width: 100, Subsampling: "444", Baseline: true, NoOptimize: true, NoTrellis: true, JPEGQuant: "flat"}},
+		{"subsampling=4:2:0&jpeg-mode=progressive&jpeg-optimize=true&jpeg-trellis=true&jpeg-quant=klein", Options{Subsampling: "420", JPEGQuant: "klein"}},
+		{"subsampling=411&jpeg-mode=fast&jpeg-optimize=maybe&jpeg-trellis=maybe&jpeg-quant=best", defaults},
+	}
+
+	for _, tt := range tests {
+		input, err := url.ParseQuery(tt.InputQS)
+		if err != nil {
+			panic(err)
+		}
+
+		if got, want := ParseFormValues(input, defaults), tt.Options; got != want {
+			t.Errorf("ParseFormValues(%q) returned %#v, want %#v", tt.InputQS, got, want)
+		}
+	}
+}
+
+func TestSourceConfiguration_UnmarshalJSON(t *testing.T) {
+	var configs map[string]*SourceConfiguration
+	input := `{"/asset/1": {"base_url": "https://example.com/", "default_options": {"fp_x": 0.25, "fp_y": 0.75, "fp_z": 2, "filter": "lanczos", "subsampling": "444", "baseline": true}, "mark": {"url": "https://example.com/logo.png", "pos": "top-left", "alpha": 50}, "max_width": 1000, "max_height": 800}}`
+	if err := json.Unmarshal([]byte(input), &configs); err != nil {
+		t.Fatalf("json.Unmarshal returned error: %v", err)
+	}
+
+	config := configs["/asset/1"]
+	if got, want := config.BaseURL.String(), "https://example.com/"; got != want {
+		t.Errorf("BaseURL = %v, want %v", got, want)
+	}
+	if got, want := config.DefaultOptions, (Options{Focal: true, FocalX: 0.25, FocalY: 0.75, FocalZoom: 2, Filter: "lanczos", Subsampling: "444", Baseline: true}); got != want {
+		t.Errorf("DefaultOptions = %#v, want %#v", got, want)
+	}
+	if got, want := config.Mark, (Mark{URL: "https://example.com/logo.png", Pos: "top-left", Alpha: 50}); got != want {
+		t.Errorf("Mark = %#v, want %#v", got, want)
+	}
+	if config.MaxWidth != 1000 || config.MaxHeight != 800 {
+		t.Errorf("MaxWidth, MaxHeight = %d, %d, want 1000, 800", config.MaxWidth, config.MaxHeight)
+	}
+}
+
+func TestOptions_UnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Options
+	}{
+		{`{"fit_mode": "crop"}`, Options{FitMode: "crop"}},
+		{`{"fit": true}`, Options{FitMode: "clip"}},
+		{`{"fit": false}`, emptyOptions},
+		{`{"fit": true, "fit_mode": "max"}`, Options{FitMode: "max"}},
+		{`{"fp_x": 0, "fp_y": 0}`, Options{Focal: true}},
+		{`{"fp_y": 0.25}`, Options{Focal: true, FocalX: 0.5, FocalY: 0.25}},
+	}
+	for _, tt := range tests {
+		var got Options
+		if err := json.Unmarshal([]byte(tt.input), &got); err != nil {
+			t.Errorf("json.Unmarshal(%s) returned error: %v", tt.input, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("json.Unmarshal(%s) returned %#v, want %#v", tt.input, got, tt.want)
+		}
+	}
+}
+
 func Test_NewRequest_PrefixAndBaseURL(t *testing.T) {
 	req, err := http.NewRequest("GET", "http://localhost/prefix/baz.jpg?size=123", nil)
 	if err != nil {
@@ -253,7 +950,7 @@ func Test_NewRequest_PrefixAndBaseURL(t *testing.T) {
 	expectedRemoteURL := "https://imagehost.invalid/foobar/baz.jpg?size=123"
 	actualRemoteURL := r.URL.String()
 
-	expectedOptions := Options{Width: 123, Height: 123, Fit: true}
+	expectedOptions := Options{Width: 123, Height: 123, FitMode: "clip"}
 	actualOptions := r.Options
 
 	if expectedRemoteURL != actualRemoteURL {
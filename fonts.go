@@ -0,0 +1,176 @@
+package imageproxy
+
+import (
+	"fmt"
+	"image"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/math/fixed"
+)
+
+// defaultFont is the bundled font of text without a font name.
+const defaultFont = "go"
+
+// defaultTextSize is the font size of text without a size, as a fraction of
+// the output height.
+const defaultTextSize = 0.1
+
+// fontSet maps font names to fonts.
+type fontSet map[string]*truetype.Font
+
+// bundledFonts are the fonts available without a font directory.
+var bundledFonts = fontSet{
+	defaultFont: mustParseFont(goregular.TTF),
+	"go-bold":   mustParseFont(gobold.TTF),
+}
+
+// mustParseFont parses the TrueType font b, which must be valid.
+func mustParseFont(b []byte) *truetype.Font {
+	f, err := truetype.Parse(b)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// loadFonts parses the TrueType fonts in dir.  Each font is named by its file
+// name, in lower case and without the ".ttf" extension.
+func loadFonts(dir string) (fontSet, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	fonts := make(fontSet)
+	for _, fi := range files {
+		ext := filepath.Ext(fi.Name())
+		name := strings.ToLower(strings.TrimSuffix(fi.Name(), ext))
+		if fi.IsDir() || strings.ToLower(ext) != ".ttf" || !validFontName(name) {
+			continue
+		}
+
+		b, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		f, err := truetype.Parse(b)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing font %s: %v", fi.Name(), err)
+		}
+		fonts[name] = f
+	}
+	return fonts, nil
+}
+
+// font returns the font named name in fonts or the bundled fonts, or the
+// default font if there is no such font.
+func (fonts fontSet) font(name string) *truetype.Font {
+	if f, ok := fonts[name]; ok {
+		return f
+	}
+	if f, ok := bundledFonts[name]; ok {
+		return f
+	}
+	return bundledFonts[defaultFont]
+}
+
+// drawText draws the text described by opt onto m, in one of fonts.  m is
+// returned unchanged if there is no text.
+func drawText(m image.Image, opt Text, fonts fontSet) image.Image {
+	if opt.Value == "" {
+		return m
+	}
+
+	dst := imaging.Clone(m)
+	b := dst.Bounds()
+	f := fonts.font(opt.Font)
+	pad := edgePadding(opt.Pad, b)
+
+	size := opt.Size
+	if size == 0 {
+		size = defaultTextSize
+	}
+	if size < 1 {
+		size *= float64(b.Dy())
+	}
+	face := truetype.NewFace(f, &truetype.Options{Size: size})
+	width := font.MeasureString(face, opt.Value).Ceil()
+
+	// shrink text that does not fit between the paddings
+	if avail := b.Dx() - 2*pad; width > avail && avail > 0 {
+		size *= float64(avail) / float64(width)
+		face = truetype.NewFace(f, &truetype.Options{Size: size})
+		width = font.MeasureString(face, opt.Value).Ceil()
+	}
+
+	metrics := face.Metrics()
+	height := (metrics.Ascent + metrics.Descent).Ceil()
+	align := opt.Align
+	if align == "" {
+		align = "bottom"
+	}
+	pt := anchorPoint(b, width, height, align, pad)
+	dot := fixed.Point26_6{X: fixed.I(pt.X), Y: fixed.I(pt.Y) + metrics.Ascent}
+
+	if c, ok := parseHexColor(opt.Shadow); ok {
+		offset := fixed.I(int(size/20 + 0.5))
+		if offset < fixed.I(1) {
+			offset = fixed.I(1)
+		}
+		d := font.Drawer{
+			Dst:  dst,
+			Src:  image.NewUniform(c),
+			Face: face,
+			Dot:  dot.Add(fixed.Point26_6{X: offset, Y: offset}),
+		}
+		d.DrawString(opt.Value)
+	}
+
+	d := font.Drawer{
+		Dst:  dst,
+		Src:  image.NewUniform(backgroundColor(opt.Color)),
+		Face: face,
+		Dot:  dot,
+	}
+	d.DrawString(opt.Value)
+	return dst
+}
+
+// edgePadding returns the distance pad from the edges of b in pixels, where a
+// pad less than 1 is a fraction of the smaller dimension of b.
+func edgePadding(pad float64, b image.Rectangle) int {
+	if pad < 1 {
+		side := b.Dx()
+		if b.Dy() < side {
+			side = b.Dy()
+		}
+		pad *= float64(side)
+	}
+	return int(pad + 0.5)
+}
+
+// anchorPoint returns the top left corner of a w by h rectangle placed in b
+// at the position pos, which is "center" or an anchor like "bottom-right", and
+// pad pixels from the edges it is anchored to.
+func anchorPoint(b image.Rectangle, w, h int, pos string, pad int) image.Point {
+	x := b.Min.X + (b.Dx()-w)/2
+	y := b.Min.Y + (b.Dy()-h)/2
+	if strings.Contains(pos, "left") {
+		x = b.Min.X + pad
+	} else if strings.Contains(pos, "right") {
+		x = b.Max.X - w - pad
+	}
+	if strings.Contains(pos, "top") {
+		y = b.Min.Y + pad
+	} else if strings.Contains(pos, "bottom") {
+		y = b.Max.Y - h - pad
+	}
+	return image.Pt(x, y)
+}
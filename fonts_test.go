@@ -0,0 +1,116 @@
+package imageproxy
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+// changedRect returns the smallest rectangle containing the pixels of m that
+// differ from c.
+func changedRect(m image.Image, c color.NRGBA) image.Rectangle {
+	var r image.Rectangle
+	b := m.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if color.NRGBAModel.Convert(m.At(x, y)) != c {
+				r = r.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return r
+}
+
+func TestDrawText(t *testing.T) {
+	black := color.NRGBA{0, 0, 0, 255}
+	src := newImage(100, 40, black)
+
+	tests := []struct {
+		opt    Text
+		inside image.Rectangle // region that must contain all the text
+	}{
+		{Text{Value: "Sale", Size: 20, Align: "top-left"}, image.Rect(0, 0, 50, 20)},
+		{Text{Value: "Sale", Size: 20, Align: "top-left", Pad: 10}, image.Rect(10, 10, 60, 30)},
+		{Text{Value: "Sale", Size: 20, Align: "bottom-right"}, image.Rect(50, 15, 100, 40)},
+		{Text{Value: "Sale", Size: 0.5}, image.Rect(25, 15, 75, 40)},
+		{Text{Value: "A caption much too long for the image", Size: 20, Pad: 5}, image.Rect(5, 0, 95, 40)},
+	}
+
+	for _, tt := range tests {
+		got := drawText(src, tt.opt, nil)
+		r := changedRect(got, black)
+		if r.Empty() {
+			t.Errorf("drawText(%#v) drew nothing", tt.opt)
+		} else if !r.In(tt.inside) {
+			t.Errorf("drawText(%#v) drew in %v, want inside %v", tt.opt, r, tt.inside)
+		}
+	}
+
+	// text is white by default and drawn in the requested color otherwise
+	got := drawText(src, Text{Value: "I", Size: 30, Align: "center"}, nil)
+	if c := got.(*image.NRGBA).NRGBAAt(50, 20); c != white {
+		t.Errorf("drawText returned %v at the center of the text, want %v", c, white)
+	}
+	got = drawText(src, Text{Value: "I", Size: 30, Align: "center", Color: "ff0000ff"}, nil)
+	if c := got.(*image.NRGBA).NRGBAAt(50, 20); c != red {
+		t.Errorf("drawText with color returned %v at the center of the text, want %v", c, red)
+	}
+
+	// shadows are offset to the bottom right
+	got = drawText(src, Text{Value: "I", Size: 30, Align: "center", Shadow: "ff0000ff"}, nil)
+	if r := changedRect(got, black); r.Eq(changedRect(drawText(src, Text{Value: "I", Size: 30, Align: "center"}, nil), black)) {
+		t.Errorf("drawText with shadow drew in %v, the same as without", r)
+	}
+
+	if got := drawText(src, Text{}, nil); got != src {
+		t.Errorf("drawText without text changed the image")
+	}
+}
+
+func TestLoadFonts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imageproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string][]byte{
+		"Brand.ttf":    goregular.TTF,
+		"notes.txt":    []byte("not a font"),
+		"bad name.ttf": goregular.TTF,
+	}
+	for name, b := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fonts, err := loadFonts(dir)
+	if err != nil {
+		t.Fatalf("loadFonts returned error: %v", err)
+	}
+	if len(fonts) != 1 || fonts["brand"] == nil {
+		t.Errorf("loadFonts returned %v, want only font brand", fonts)
+	}
+	if got, want := fonts.font("brand"), fonts["brand"]; got != want {
+		t.Errorf("font(brand) did not return the loaded font")
+	}
+	if got, want := fonts.font("go-bold"), bundledFonts["go-bold"]; got != want {
+		t.Errorf("font(go-bold) did not return the bundled font")
+	}
+	if got, want := fonts.font("missing"), bundledFonts[defaultFont]; got != want {
+		t.Errorf("font(missing) did not return the default font")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "broken.ttf"), []byte("not a font"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadFonts(dir); err == nil {
+		t.Errorf("loadFonts did not return an error for an invalid font")
+	}
+}
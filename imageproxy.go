@@ -9,8 +9,10 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
+	"image"
 	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"net/url"
 	"strings"
@@ -48,6 +50,13 @@ type Proxy struct {
 	// Allow images to scale beyond their original dimensions.
 	ScaleUp bool
 
+	// ClientHints enables sizing images using the client hint headers
+	// of requests.  See Request.applyClientHints for details.
+	ClientHints bool
+
+	// transformer transforms the images fetched by Client.
+	transformer *TransformingTransport
+
 	// Timeout specifies a time limit for requests served by this Proxy.
 	// If a call runs for longer than its time limit, a 504 Gateway Timeout
 	// response is returned.  A Timeout of zero means no timeout.
@@ -71,12 +80,13 @@ func NewProxy(transport http.RoundTripper, cache Cache, logger *zap.SugaredLogge
 	}
 
 	client := new(http.Client)
+	proxy.transformer = &TransformingTransport{
+		Transport:     transport,
+		CachingClient: client,
+		logger:        logger,
+	}
 	client.Transport = &httpcache.Transport{
-		Transport: &TransformingTransport{
-			Transport:     transport,
-			CachingClient: client,
-			logger:        logger,
-		},
+		Transport:           proxy.transformer,
 		Cache:               cache,
 		MarkCachedResponses: true,
 	}
@@ -86,6 +96,18 @@ func NewProxy(transport http.RoundTripper, cache Cache, logger *zap.SugaredLogge
 	return proxy
 }
 
+// LoadFonts makes the TrueType fonts in dir available to text drawn on
+// images, in addition to the bundled fonts.  Each font is named by its file
+// name without the ".ttf" extension.
+func (p *Proxy) LoadFonts(dir string) error {
+	fonts, err := loadFonts(dir)
+	if err != nil {
+		return err
+	}
+	p.transformer.fonts = fonts
+	return nil
+}
+
 // ServeHTTP handles incoming requests.
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Respond to health checks
@@ -125,6 +147,10 @@ func (p *Proxy) serveImage(w http.ResponseWriter, r *http.Request) {
 	// assign static settings from proxy to req.Options
 	req.Options.ScaleUp = p.ScaleUp
 
+	if p.ClientHints {
+		req.applyClientHints()
+	}
+
 	if err := p.allowed(req); err != nil {
 		p.logger.Infow("Generated request did not pass validation",
 			"error", err.Error(),
@@ -153,6 +179,12 @@ func (p *Proxy) serveImage(w http.ResponseWriter, r *http.Request) {
 	)
 
 	copyHeader(w.Header(), resp.Header, "Cache-Control", "Last-Modified", "Expires", "Etag", "Link")
+	for _, h := range req.Vary {
+		w.Header().Add("Vary", h)
+	}
+	if p.ClientHints {
+		w.Header().Set("Accept-CH", strings.Join(clientHints, ", "))
+	}
 
 	// Set Cache-Tag values to make it possible to detect and purge responses created by this app
 	resp.Header.Set("Cache-Tag", cacheTags)
@@ -162,7 +194,7 @@ func (p *Proxy) serveImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	copyHeader(w.Header(), resp.Header, "Content-Length", "Content-Type")
+	copyHeader(w.Header(), resp.Header, "Content-Length", "Content-Type", "Content-DPR", "Content-Quality")
 
 	//Enable CORS for 3rd party applications
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -200,7 +232,7 @@ func (p *Proxy) allowed(r *Request) error {
 		return nil // no whitelist or signature key, all requests accepted
 	}
 
-	if len(p.Whitelist) > 0 && validHost(p.Whitelist, r.URL) {
+	if len(p.Whitelist) > 0 && validHost(p.Whitelist, r.URL) && validResourceHosts(p.Whitelist, r) {
 		return nil
 	}
 
@@ -225,6 +257,26 @@ func validHost(hosts []string, u *url.URL) bool {
 	return false
 }
 
+// validResourceHosts returns whether the hosts of the other images used in
+// transforming r, like its watermark, match one of hosts.
+func validResourceHosts(hosts []string, r *Request) bool {
+	var resources []string
+	if r.Options.Mark.URL != "" {
+		resources = append(resources, r.Options.Mark.URL)
+	}
+	if r.Options.Mask != "" && r.Options.Mask != maskEllipse {
+		resources = append(resources, r.Options.Mask)
+	}
+
+	for _, resource := range resources {
+		u, err := url.Parse(resource)
+		if err != nil || !validHost(hosts, u) {
+			return false
+		}
+	}
+	return true
+}
+
 // returns whether the referrer from the request is in the host list.
 func validReferrer(hosts []string, r *http.Request) bool {
 	u, err := url.Parse(r.Header.Get("Referer"))
@@ -294,6 +346,9 @@ type TransformingTransport struct {
 	// responses are properly cached.
 	CachingClient *http.Client
 
+	// fonts loaded from the font directory of the proxy
+	fonts fontSet
+
 	logger *zap.SugaredLogger
 }
 
@@ -368,13 +423,40 @@ func (t *TransformingTransport) RoundTrip(req *http.Request) (*http.Response, er
 		"options fragment", req.URL.Fragment,
 	)
 
-	img, err := Transform(b, opt)
+	res := transformResources{fonts: t.fonts}
+	if opt.Mark.URL != "" {
+		res.mark, err = t.fetchImage(opt.Mark.URL)
+		if err != nil {
+			t.logger.Warnw("Error fetching watermark",
+				"u", opt.Mark.URL,
+				"error", err.Error(),
+			)
+			return nil, err
+		}
+	}
+	if opt.Mask != "" && opt.Mask != maskEllipse {
+		res.mask, err = t.fetchImage(opt.Mask)
+		if err != nil {
+			t.logger.Warnw("Error fetching mask",
+				"u", opt.Mask,
+				"error", err.Error(),
+			)
+			return nil, err
+		}
+	}
+
+	img, info, err := transform(b, opt, res)
 	if err != nil {
 		t.logger.Warnw("Error transforming image",
 			"error", err.Error(),
 			"opt", opt,
 		)
-		img = b
+		// never serve watermarked images, which may be required by the
+		// prefix, without their watermark
+		if opt.Mark.URL != "" {
+			return nil, err
+		}
+		img, info = b, transformInfo{}
 	}
 
 	// replay response with transformed image and updated content length
@@ -382,11 +464,41 @@ func (t *TransformingTransport) RoundTrip(req *http.Request) (*http.Response, er
 	fmt.Fprintf(buf, "%s %s\n", resp.Proto, resp.Status)
 	resp.Header.WriteSubset(buf, map[string]bool{
 		"Content-Length": true,
-		// exclude Content-Type header if the format may have changed during transformation
-		"Content-Type": opt.Format != "" || resp.Header.Get("Content-Type") == "image/webp" || resp.Header.Get("Content-Type") == "image/tiff",
+		// replace the Content-Type header with the format the image was
+		// encoded in, which may differ from the source
+		"Content-Type":    info.format != "",
+		"Content-DPR":     info.dpr != 0,
+		"Content-Quality": info.quality != 0,
 	})
+	if info.format != "" {
+		fmt.Fprintf(buf, "Content-Type: %s\n", formatTypes[info.format])
+	}
+	if info.dpr != 0 {
+		// report the ratio with a sensible precision
+		fmt.Fprintf(buf, "Content-DPR: %v\n", math.Floor(info.dpr*1000+0.5)/1000)
+	}
+	if info.quality != 0 {
+		fmt.Fprintf(buf, "Content-Quality: %d\n", info.quality)
+	}
 	fmt.Fprintf(buf, "Content-Length: %d\n\n", len(img))
 	buf.Write(img)
 
 	return http.ReadResponse(bufio.NewReader(buf), req)
 }
+
+// fetchImage fetches and decodes the image at u, such as a watermark, through
+// the caching client.
+func (t *TransformingTransport) fetchImage(u string) (image.Image, error) {
+	resp, err := t.CachingClient.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("unexpected status code %d from upstream", resp.StatusCode)
+	}
+
+	m, _, err := image.Decode(resp.Body)
+	return m, err
+}
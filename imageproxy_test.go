@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"image"
+	"image/jpeg"
 	"image/png"
 	"net/http"
 	"net/http/httptest"
@@ -135,6 +136,15 @@ func TestAllowed(t *testing.T) {
 		{"http://good/image", emptyOptions, whitelist, nil, key, nil, true},
 		{"http://bad/image", Options{Signature: "gWivrPhXBbsYEwpmWAKjbJEiAEgZwbXbltg95O2tgNI="}, nil, nil, key, nil, true},
 		{"http://bad/image", emptyOptions, whitelist, nil, key, nil, false},
+
+		// watermark
+		{"http://good/image", Options{Mark: Mark{URL: "http://good/logo.png"}}, whitelist, nil, nil, nil, true},
+		{"http://good/image", Options{Mark: Mark{URL: "http://bad/logo.png"}}, whitelist, nil, nil, nil, false},
+
+		// mask
+		{"http://good/image", Options{Mask: "ellipse"}, whitelist, nil, nil, nil, true},
+		{"http://good/image", Options{Mask: "http://good/star.png"}, whitelist, nil, nil, nil, true},
+		{"http://good/image", Options{Mask: "http://bad/star.png"}, whitelist, nil, nil, nil, false},
 	}
 
 	for _, tt := range tests {
@@ -147,7 +157,7 @@ func TestAllowed(t *testing.T) {
 		if err != nil {
 			t.Errorf("error parsing url %q: %v", tt.url, err)
 		}
-		req := &Request{u, tt.options, tt.request}
+		req := &Request{URL: u, Options: tt.options, Original: tt.request}
 		if got, want := p.allowed(req), tt.allowed; (got == nil) != want {
 			t.Errorf("allowed(%q) returned %v, want %v.\nTest struct: %#v", req, got, want, tt)
 		}
@@ -202,7 +212,7 @@ func TestValidSignature(t *testing.T) {
 		if err != nil {
 			t.Errorf("error parsing url %q: %v", tt.url, err)
 		}
-		req := &Request{u, tt.options, &http.Request{}}
+		req := &Request{URL: u, Options: tt.options, Original: &http.Request{}}
 		if got, want := validSignature(key, req), tt.valid; got != want {
 			t.Errorf("validSignature(%v, %q) returned %v, want %v", key, u, got, want)
 		}
@@ -316,6 +326,12 @@ func (t testTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 		png.Encode(img, m)
 
 		raw = fmt.Sprintf("HTTP/1.1 200 OK\nContent-Length: %d\n\n%s", len(img.Bytes()), img.Bytes())
+	case "/jpeg":
+		m := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+		img := new(bytes.Buffer)
+		jpeg.Encode(img, m, nil)
+
+		raw = fmt.Sprintf("HTTP/1.1 200 OK\nContent-Type: image/jpeg\nContent-Length: %d\n\n%s", len(img.Bytes()), img.Bytes())
 	default:
 		raw = "HTTP/1.1 404 Not Found\n\n"
 	}
@@ -378,6 +394,155 @@ func TestProxy_ServeHTTP_is304(t *testing.T) {
 	}
 }
 
+// test that responses with negotiated formats vary by the Accept header.
+func TestProxy_ServeHTTP_Vary(t *testing.T) {
+	p := &Proxy{
+		Client: &http.Client{
+			Transport: testTransport{},
+		},
+		logger: logger(),
+	}
+
+	tests := []struct {
+		url  string
+		vary string
+	}{
+		{"http://localhost/http://good.test/ok?format=png", ""},
+		{"http://localhost/http://good.test/ok?format=auto", "Accept"},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", tt.url, nil)
+		req.Header.Set("Accept", "image/webp")
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+
+		if got, want := resp.Header().Get("Vary"), tt.vary; got != want {
+			t.Errorf("ServeHTTP(%v) returned Vary header %q, want %q", tt.url, got, want)
+		}
+	}
+}
+
+func TestProxy_ServeHTTP_ClientHints(t *testing.T) {
+	p := &Proxy{
+		Client: &http.Client{
+			Transport: testTransport{},
+		},
+		ClientHints: true,
+		logger:      logger(),
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost/http://good.test/ok?format=auto", nil)
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, req)
+
+	if got, want := resp.Header().Get("Accept-CH"), "Sec-CH-DPR, Sec-CH-Width, Sec-CH-Viewport-Width"; got != want {
+		t.Errorf("ServeHTTP(%v) returned Accept-CH header %q, want %q", req, got, want)
+	}
+	if got, want := resp.Header()["Vary"], []string{"Accept", "Sec-CH-DPR", "Sec-CH-Width", "Sec-CH-Viewport-Width", "Save-Data"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ServeHTTP(%v) returned Vary headers %q, want %q", req, got, want)
+	}
+}
+
+func TestTransformingTransport_ContentDPR(t *testing.T) {
+	client := new(http.Client)
+	tr := &TransformingTransport{
+		Transport:     testTransport{},
+		CachingClient: client,
+		logger:        logger(),
+	}
+	client.Transport = tr
+
+	tests := []struct {
+		url string
+		dpr string
+	}{
+		{"http://good.test/png#1x0", ""},
+		{"http://good.test/png#1x0,dpr2", "1"},
+		{"http://good.test/png#1x0,dpr2,scaleUp", "2"},
+		{"http://good.test/png#3x0,dpr2", "0.333"},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", tt.url, nil)
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Errorf("RoundTrip(%v) returned unexpected error: %v", tt.url, err)
+			continue
+		}
+		if got, want := resp.Header.Get("Content-DPR"), tt.dpr; got != want {
+			t.Errorf("RoundTrip(%v) returned Content-DPR %q, want %q", tt.url, got, want)
+		}
+	}
+}
+
+func TestTransformingTransport_ContentQuality(t *testing.T) {
+	client := new(http.Client)
+	tr := &TransformingTransport{
+		Transport:     testTransport{},
+		CachingClient: client,
+		logger:        logger(),
+	}
+	client.Transport = tr
+
+	tests := []struct {
+		url     string
+		quality string
+	}{
+		{"http://good.test/png#1x0,jpeg", ""},
+		{"http://good.test/png#1x0,jpeg,maxbytes100000", "95"},
+		{"http://good.test/png#1x0,q80,webp,maxbytes100000", "80"},
+		{"http://good.test/png#1x0,png,maxbytes100000", ""},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", tt.url, nil)
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Errorf("RoundTrip(%v) returned unexpected error: %v", tt.url, err)
+			continue
+		}
+		if got, want := resp.Header.Get("Content-Quality"), tt.quality; got != want {
+			t.Errorf("RoundTrip(%v) returned Content-Quality %q, want %q", tt.url, got, want)
+		}
+	}
+}
+
+func TestTransformingTransport_ContentType(t *testing.T) {
+	client := new(http.Client)
+	tr := &TransformingTransport{
+		Transport:     testTransport{},
+		CachingClient: client,
+		logger:        logger(),
+	}
+	client.Transport = tr
+
+	tests := []struct {
+		url         string
+		contentType string
+	}{
+		{"http://good.test/jpeg", "image/jpeg"},
+		{"http://good.test/jpeg#2x0", "image/jpeg"},
+		{"http://good.test/jpeg#png", "image/png"},
+		{"http://good.test/png#jpeg", "image/jpeg"},
+		{"http://good.test/jpeg#r45,bgffffff00", "image/png"},
+		{"http://good.test/jpeg#8x2,fit-fill,bg00000000", "image/png"},
+		{"http://good.test/jpeg#r45,bgffffffff", "image/jpeg"},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", tt.url, nil)
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Errorf("RoundTrip(%v) returned unexpected error: %v", tt.url, err)
+			continue
+		}
+		if got, want := resp.Header.Get("Content-Type"), tt.contentType; got != want {
+			t.Errorf("RoundTrip(%v) returned Content-Type %q, want %q", tt.url, got, want)
+		}
+	}
+}
+
 func TestTransformingTransport(t *testing.T) {
 	client := new(http.Client)
 	tr := &TransformingTransport{
@@ -394,6 +559,12 @@ func TestTransformingTransport(t *testing.T) {
 	}{
 		{"http://good.test/png#1", http.StatusOK, false},
 		{"http://good.test/error#1", http.StatusInternalServerError, true},
+		{"http://good.test/png#1x0,mark-aHR0cDovL2dvb2QudGVzdC9wbmc", http.StatusOK, false},
+		{"http://good.test/png#1x0,mark-aHR0cDovL2dvb2QudGVzdC9taXNzaW5n", http.StatusNotFound, true},
+		{"http://good.test/ok#1x0", http.StatusOK, false},
+		{"http://good.test/ok#1x0,mark-aHR0cDovL2dvb2QudGVzdC9wbmc", http.StatusOK, true},
+		{"http://good.test/png#1x0,mask-aHR0cDovL2dvb2QudGVzdC9wbmc", http.StatusOK, false},
+		{"http://good.test/png#1x0,mask-aHR0cDovL2dvb2QudGVzdC9taXNzaW5n", http.StatusNotFound, true},
 		// TODO: test more than just status code... verify that image
 		// is actually transformed and returned properly and that
 		// non-image responses are returned as-is
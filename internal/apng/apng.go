@@ -0,0 +1,299 @@
+// Package apng implements an animated PNG encoder.
+//
+// Frames are encoded as 8-bit truecolor images of the whole canvas, with an
+// alpha channel if any frame is transparent.  The first frame is the default
+// image, so decoders without APNG support show it as a still.  See the APNG
+// specification: https://wiki.mozilla.org/APNG_Specification
+package apng
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+)
+
+// Animation is a sequence of images of the same size, shown in turn.
+type Animation struct {
+	Frames []image.Image
+
+	// Delays are the display times of the frames in milliseconds.
+	Delays []int
+
+	// LoopCount is the number of times the animation is played, 0 meaning
+	// forever.
+	LoopCount int
+}
+
+// Encoder configures encoding animated PNG images.
+type Encoder struct {
+	CompressionLevel png.CompressionLevel
+}
+
+// PNG color types
+const (
+	ctTrueColor      = 2
+	ctTrueColorAlpha = 6
+)
+
+// Encode writes the animation a to w in animated PNG format.
+func (e *Encoder) Encode(w io.Writer, a *Animation) error {
+	if len(a.Frames) == 0 {
+		return errors.New("apng: no frames to encode")
+	}
+	if len(a.Delays) != len(a.Frames) {
+		return errors.New("apng: mismatched frame and delay counts")
+	}
+	b := a.Frames[0].Bounds()
+	if b.Dx() <= 0 || b.Dy() <= 0 {
+		return errors.New("apng: empty image")
+	}
+
+	frames := make([]*image.NRGBA, len(a.Frames))
+	colorType := byte(ctTrueColor)
+	for i, m := range a.Frames {
+		if m.Bounds().Size() != b.Size() {
+			return errors.New("apng: frames are not all the same size")
+		}
+		frames[i] = toNRGBA(m)
+		if !opaque(frames[i]) {
+			colorType = ctTrueColorAlpha
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(b.Dx()))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(b.Dy()))
+	ihdr[8] = 8 // bit depth
+	ihdr[9] = colorType
+	writeChunk(buf, "IHDR", ihdr)
+
+	actl := make([]byte, 8)
+	binary.BigEndian.PutUint32(actl[0:], uint32(len(frames)))
+	binary.BigEndian.PutUint32(actl[4:], uint32(clamp(a.LoopCount, 0, 1<<31-1)))
+	writeChunk(buf, "acTL", actl)
+
+	// fcTL and fdAT chunks share a sequence of numbers
+	var seq uint32
+	for i, m := range frames {
+		writeChunk(buf, "fcTL", fctlPayload(seq, b.Dx(), b.Dy(), a.Delays[i]))
+		seq++
+
+		data, err := e.compress(m, colorType)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			writeChunk(buf, "IDAT", data)
+			continue
+		}
+		fdat := make([]byte, 4, 4+len(data))
+		binary.BigEndian.PutUint32(fdat, seq)
+		writeChunk(buf, "fdAT", append(fdat, data...))
+		seq++
+	}
+	writeChunk(buf, "IEND", nil)
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// fctlPayload returns the payload of an fcTL chunk of a w by h frame with
+// sequence number seq, shown for delay milliseconds in place of the whole
+// canvas.
+func fctlPayload(seq uint32, w, h, delay int) []byte {
+	// delays are fractions of 16-bit numbers, in milliseconds if possible
+	num, den := clamp(delay, 0, 1<<16-1), 1000
+	if delay > num {
+		num, den = clamp(delay/10, 0, 1<<16-1), 100
+	}
+
+	b := make([]byte, 26)
+	binary.BigEndian.PutUint32(b[0:], seq)
+	binary.BigEndian.PutUint32(b[4:], uint32(w))
+	binary.BigEndian.PutUint32(b[8:], uint32(h))
+	// the frame is at (0, 0)
+	binary.BigEndian.PutUint16(b[20:], uint16(num))
+	binary.BigEndian.PutUint16(b[22:], uint16(den))
+	// dispose_op and blend_op 0: keep the frame, and replace the canvas
+	return b
+}
+
+// compress returns the zlib compressed, filtered rows of m in the color type.
+func (e *Encoder) compress(m *image.NRGBA, colorType byte) ([]byte, error) {
+	bpp := 4
+	if colorType == ctTrueColor {
+		bpp = 3
+	}
+	w, h := m.Bounds().Dx(), m.Bounds().Dy()
+
+	buf := new(bytes.Buffer)
+	zw, err := zlib.NewWriterLevel(buf, zlibLevel(e.CompressionLevel))
+	if err != nil {
+		return nil, err
+	}
+
+	prev := make([]byte, w*bpp)
+	cur := make([]byte, w*bpp)
+	var filtered [5][]byte
+	for f := range filtered {
+		filtered[f] = make([]byte, 1+w*bpp)
+		filtered[f][0] = byte(f)
+	}
+	for y := 0; y < h; y++ {
+		row := m.Pix[y*m.Stride : y*m.Stride+w*4]
+		if bpp == 4 {
+			copy(cur, row)
+		} else {
+			for x := 0; x < w; x++ {
+				copy(cur[x*3:x*3+3], row[x*4:x*4+3])
+			}
+		}
+
+		f := 0
+		if e.CompressionLevel != png.NoCompression {
+			f = filterRow(&filtered, cur, prev, bpp)
+		} else {
+			copy(filtered[0][1:], cur)
+		}
+		if _, err := zw.Write(filtered[f]); err != nil {
+			return nil, err
+		}
+		prev, cur = cur, prev
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// filterRow applies each PNG filter to the row cur, following the row prev,
+// into filtered, and returns the filter that is likely to compress best:
+// the one with the smallest sum of absolute differences.
+func filterRow(filtered *[5][]byte, cur, prev []byte, bpp int) int {
+	best, bestSum := 0, -1
+	for f := range filtered {
+		out := filtered[f][1:]
+		sum := 0
+		for i, c := range cur {
+			var left, up, upLeft byte
+			if i >= bpp {
+				left, upLeft = cur[i-bpp], prev[i-bpp]
+			}
+			up = prev[i]
+
+			var v byte
+			switch f {
+			case 0:
+				v = c
+			case 1:
+				v = c - left
+			case 2:
+				v = c - up
+			case 3:
+				v = c - byte((int(left)+int(up))/2)
+			case 4:
+				v = c - paeth(left, up, upLeft)
+			}
+			out[i] = v
+			if d := int(int8(v)); d < 0 {
+				sum -= d
+			} else {
+				sum += d
+			}
+		}
+		if bestSum < 0 || sum < bestSum {
+			best, bestSum = f, sum
+		}
+	}
+	return best
+}
+
+// paeth returns the Paeth predictor of a pixel from its left, upper and
+// upper left neighbors.
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+// zlibLevel returns the zlib compression level of a PNG compression level.
+func zlibLevel(l png.CompressionLevel) int {
+	switch l {
+	case png.NoCompression:
+		return zlib.NoCompression
+	case png.BestSpeed:
+		return zlib.BestSpeed
+	case png.BestCompression:
+		return zlib.BestCompression
+	default:
+		return zlib.DefaultCompression
+	}
+}
+
+// writeChunk writes a PNG chunk of the given type and data to buf.
+func writeChunk(buf *bytes.Buffer, typ string, data []byte) {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(data)))
+	buf.Write(n[:])
+
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	crc.Write(data)
+	buf.WriteString(typ)
+	buf.Write(data)
+	binary.BigEndian.PutUint32(n[:], crc.Sum32())
+	buf.Write(n[:])
+}
+
+// toNRGBA returns m as a non-premultiplied image with its origin at (0, 0).
+func toNRGBA(m image.Image) *image.NRGBA {
+	if n, ok := m.(*image.NRGBA); ok && n.Rect.Min == (image.Point{}) {
+		return n
+	}
+	b := m.Bounds()
+	n := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(n, n.Bounds(), m, b.Min, draw.Src)
+	return n
+}
+
+// opaque returns whether every pixel of m is fully opaque.
+func opaque(m *image.NRGBA) bool {
+	for i := 3; i < len(m.Pix); i += 4 {
+		if m.Pix[i] != 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
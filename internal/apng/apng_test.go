@@ -0,0 +1,150 @@
+package apng
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// testImage returns a w by h image with gradients and the alpha value a.
+func testImage(w, h int, a uint8, shift int) *image.NRGBA {
+	m := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			m.SetNRGBA(x, y, color.NRGBA{uint8(x*7 + shift), uint8(y * 5), uint8(x * y), a})
+		}
+	}
+	return m
+}
+
+type pngChunk struct {
+	typ  string
+	data []byte
+}
+
+// readChunks returns the chunks of the PNG image b.
+func readChunks(t *testing.T, b []byte) []pngChunk {
+	var chunks []pngChunk
+	b = b[8:]
+	for len(b) > 0 {
+		n := int(binary.BigEndian.Uint32(b))
+		chunks = append(chunks, pngChunk{string(b[4:8]), b[8 : 8+n]})
+		b = b[12+n:]
+	}
+	return chunks
+}
+
+// stillPNG returns a PNG image with the header ihdr and the image data data.
+func stillPNG(ihdr, data []byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	writeChunk(buf, "IHDR", ihdr)
+	writeChunk(buf, "IDAT", data)
+	writeChunk(buf, "IEND", nil)
+	return buf.Bytes()
+}
+
+func TestEncode(t *testing.T) {
+	for _, tt := range []struct {
+		alpha     uint8
+		level     png.CompressionLevel
+		colorType byte
+	}{
+		{0xff, png.DefaultCompression, ctTrueColor},
+		{0x80, png.BestCompression, ctTrueColorAlpha},
+		{0x80, png.NoCompression, ctTrueColorAlpha},
+	} {
+		frames := []*image.NRGBA{testImage(13, 7, 0xff, 0), testImage(13, 7, tt.alpha, 50), testImage(13, 7, 0xff, 100)}
+		a := &Animation{
+			Frames:    []image.Image{frames[0], frames[1], frames[2]},
+			Delays:    []int{100, 70000, 20},
+			LoopCount: 2,
+		}
+		buf := new(bytes.Buffer)
+		e := &Encoder{CompressionLevel: tt.level}
+		if err := e.Encode(buf, a); err != nil {
+			t.Fatalf("Encode returned error: %v", err)
+		}
+
+		// decoders without APNG support show the first frame
+		m, err := png.Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("error decoding image: %v", err)
+		}
+		if !equal(m, frames[0]) {
+			t.Errorf("default image does not match the first frame")
+		}
+
+		chunks := readChunks(t, buf.Bytes())
+		ihdr := chunks[0].data
+		if chunks[0].typ != "IHDR" || ihdr[9] != tt.colorType {
+			t.Errorf("first chunk is %q with color type %d, want IHDR with %d", chunks[0].typ, ihdr[9], tt.colorType)
+		}
+		if c := chunks[1]; c.typ != "acTL" || binary.BigEndian.Uint32(c.data) != 3 || binary.BigEndian.Uint32(c.data[4:]) != 2 {
+			t.Errorf("second chunk is %q %v, want acTL of 3 frames played 2 times", c.typ, c.data)
+		}
+
+		var seq uint32
+		var frame int
+		var delays []float64
+		for _, c := range chunks[2:] {
+			switch c.typ {
+			case "fcTL":
+				if got := binary.BigEndian.Uint32(c.data); got != seq {
+					t.Errorf("fcTL has sequence number %d, want %d", got, seq)
+				}
+				seq++
+				num, den := binary.BigEndian.Uint16(c.data[20:]), binary.BigEndian.Uint16(c.data[22:])
+				delays = append(delays, float64(num)/float64(den))
+			case "IDAT":
+				frame++
+			case "fdAT":
+				if got := binary.BigEndian.Uint32(c.data); got != seq {
+					t.Errorf("fdAT has sequence number %d, want %d", got, seq)
+				}
+				seq++
+				m, err := png.Decode(bytes.NewReader(stillPNG(ihdr, c.data[4:])))
+				if err != nil {
+					t.Errorf("error decoding frame %d: %v", frame, err)
+				} else if !equal(m, frames[frame]) {
+					t.Errorf("frame %d does not match", frame)
+				}
+				frame++
+			}
+		}
+		if frame != 3 {
+			t.Errorf("image has %d frames, want 3", frame)
+		}
+		if len(delays) != 3 || delays[0] != 0.1 || delays[1] != 70 || delays[2] != 0.02 {
+			t.Errorf("frame delays are %v, want [0.1 70 0.02]", delays)
+		}
+	}
+
+	for _, a := range []*Animation{
+		{},
+		{Frames: []image.Image{testImage(2, 2, 0xff, 0)}},
+		{Frames: []image.Image{testImage(2, 2, 0xff, 0), testImage(3, 2, 0xff, 0)}, Delays: []int{10, 10}},
+	} {
+		if err := new(Encoder).Encode(new(bytes.Buffer), a); err == nil {
+			t.Errorf("Encode(%v) did not return an error", a)
+		}
+	}
+}
+
+// equal returns whether m has the same pixels as want.
+func equal(m image.Image, want *image.NRGBA) bool {
+	if m.Bounds() != want.Bounds() {
+		return false
+	}
+	for y := 0; y < want.Bounds().Dy(); y++ {
+		for x := 0; x < want.Bounds().Dx(); x++ {
+			if color.NRGBAModel.Convert(m.At(x, y)) != want.NRGBAAt(x, y) {
+				return false
+			}
+		}
+	}
+	return true
+}
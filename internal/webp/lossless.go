@@ -0,0 +1,724 @@
+package webp
+
+import (
+	"image"
+	"sort"
+)
+
+// This file implements the lossless VP8L bitstream, as specified in
+// https://developers.google.com/speed/webp/docs/webp_lossless_bitstream_specification
+//
+// The encoder applies the subtract-green and predictor transforms, finds LZ77
+// backward references with a hash chain, and codes the result with a single
+// group of canonical Huffman codes.  It does not use the color cache, the
+// cross-color or color-indexing transforms, or meta Huffman codes.
+
+const (
+	vp8lSignature = 0x2f
+
+	transformPredictor     = 0
+	transformSubtractGreen = 2
+
+	// predictorBits is the log-2 size of the predictor transform tiles.
+	predictorBits = 4
+
+	nLiteralCodes  = 256
+	nLengthCodes   = 24
+	nDistanceCodes = 40
+
+	maxCodeLength           = 15
+	maxCodeLengthCodeLength = 7
+
+	minMatch    = 3
+	maxMatch    = 4096
+	maxWindow   = 1 << 18
+	maxChain    = 16
+	hashBits    = 16
+	nPredictors = 14
+)
+
+// codeLengthCodeOrder is the order in which the code length code lengths are
+// written, specified in section 5.2.2.
+var codeLengthCodeOrder = [19]uint8{
+	17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+}
+
+// distanceMapTable maps the first 120 distance codes to two-dimensional
+// pixel offsets, specified in section 4.2.2.
+var distanceMapTable = [120]uint8{
+	0x18, 0x07, 0x17, 0x19, 0x28, 0x06, 0x27, 0x29, 0x16, 0x1a,
+	0x26, 0x2a, 0x38, 0x05, 0x37, 0x39, 0x15, 0x1b, 0x36, 0x3a,
+	0x25, 0x2b, 0x48, 0x04, 0x47, 0x49, 0x14, 0x1c, 0x35, 0x3b,
+	0x46, 0x4a, 0x24, 0x2c, 0x58, 0x45, 0x4b, 0x34, 0x3c, 0x03,
+	0x57, 0x59, 0x13, 0x1d, 0x56, 0x5a, 0x23, 0x2d, 0x44, 0x4c,
+	0x55, 0x5b, 0x33, 0x3d, 0x68, 0x02, 0x67, 0x69, 0x12, 0x1e,
+	0x66, 0x6a, 0x22, 0x2e, 0x54, 0x5c, 0x43, 0x4d, 0x65, 0x6b,
+	0x32, 0x3e, 0x78, 0x01, 0x77, 0x79, 0x53, 0x5d, 0x11, 0x1f,
+	0x64, 0x6c, 0x42, 0x4e, 0x76, 0x7a, 0x21, 0x2f, 0x75, 0x7b,
+	0x31, 0x3f, 0x63, 0x6d, 0x52, 0x5e, 0x00, 0x74, 0x7c, 0x41,
+	0x4f, 0x10, 0x20, 0x62, 0x6e, 0x30, 0x73, 0x7d, 0x51, 0x5f,
+	0x40, 0x72, 0x7e, 0x61, 0x6f, 0x50, 0x71, 0x7f, 0x60, 0x70,
+}
+
+// bitWriter accumulates bits least significant bit first.
+type bitWriter struct {
+	buf   []byte
+	bits  uint64
+	nBits uint
+}
+
+func (w *bitWriter) write(v uint32, n uint) {
+	w.bits |= uint64(v) << w.nBits
+	w.nBits += n
+	for w.nBits >= 8 {
+		w.buf = append(w.buf, byte(w.bits))
+		w.bits >>= 8
+		w.nBits -= 8
+	}
+}
+
+// bytes flushes any partial byte and returns the written data.
+func (w *bitWriter) bytes() []byte {
+	if w.nBits > 0 {
+		w.buf = append(w.buf, byte(w.bits))
+		w.bits, w.nBits = 0, 0
+	}
+	return w.buf
+}
+
+// encodeLossless returns the VP8L bitstream of m.
+func encodeLossless(m *image.NRGBA) []byte {
+	w, h := m.Rect.Dx(), m.Rect.Dy()
+	argb := make([]uint32, 0, w*h)
+	alphaUsed := uint32(0)
+	for y := 0; y < h; y++ {
+		p := m.Pix[y*m.Stride : y*m.Stride+4*w]
+		for i := 0; i < len(p); i += 4 {
+			argb = append(argb, uint32(p[i+3])<<24|uint32(p[i])<<16|uint32(p[i+1])<<8|uint32(p[i+2]))
+			if p[i+3] != 0xff {
+				alphaUsed = 1
+			}
+		}
+	}
+
+	bw := new(bitWriter)
+	bw.write(vp8lSignature, 8)
+	bw.write(uint32(w-1), 14)
+	bw.write(uint32(h-1), 14)
+	bw.write(alphaUsed, 1)
+	bw.write(0, 3) // version
+	writeImageStream(bw, argb, w, h, true)
+	return bw.bytes()
+}
+
+// encodeAlpha returns the payload of an ALPH chunk holding the alpha channel
+// of m, compressed with the lossless bitstream.
+func encodeAlpha(m *image.NRGBA) []byte {
+	w, h := m.Rect.Dx(), m.Rect.Dy()
+	argb := make([]uint32, 0, w*h)
+	for y := 0; y < h; y++ {
+		p := m.Pix[y*m.Stride : y*m.Stride+4*w]
+		for i := 0; i < len(p); i += 4 {
+			argb = append(argb, 0xff000000|uint32(p[i+3])<<8)
+		}
+	}
+
+	bw := new(bitWriter)
+	// Header byte: no pre-processing, no filtering, lossless compression.
+	bw.write(1, 8)
+	writeImageStream(bw, argb, w, h, false)
+	return bw.bytes()
+}
+
+// writeImageStream writes the transforms and the entropy-coded pixels of the
+// w×h image argb.  The contents of argb are modified.
+func writeImageStream(bw *bitWriter, argb []uint32, w, h int, subtractGreen bool) {
+	if subtractGreen {
+		bw.write(1, 1)
+		bw.write(transformSubtractGreen, 2)
+		for i, p := range argb {
+			g := (p >> 8) & 0xff
+			r := ((p >> 16) - g) & 0xff
+			b := (p - g) & 0xff
+			argb[i] = p&0xff00ff00 | r<<16 | b
+		}
+	}
+
+	if w > 1 || h > 1 {
+		bw.write(1, 1)
+		bw.write(transformPredictor, 2)
+		bw.write(predictorBits-2, 3)
+		modes, tw, th := predictorModes(argb, w, h)
+		applyPredictor(argb, w, h, modes)
+		writeEntropyImage(bw, modes, tw, th, false)
+	}
+
+	bw.write(0, 1) // no more transforms
+	writeEntropyImage(bw, argb, w, h, true)
+}
+
+// predict returns the prediction of the given predictor mode, specified in
+// section 4.1.
+func predict(mode uint32, l, t, tr, tl uint32) uint32 {
+	switch mode {
+	case 0:
+		return 0xff000000
+	case 1:
+		return l
+	case 2:
+		return t
+	case 3:
+		return tr
+	case 4:
+		return tl
+	case 5:
+		return average2(average2(l, tr), t)
+	case 6:
+		return average2(l, tl)
+	case 7:
+		return average2(l, t)
+	case 8:
+		return average2(tl, t)
+	case 9:
+		return average2(t, tr)
+	case 10:
+		return average2(average2(l, tl), average2(t, tr))
+	case 11:
+		return selectPredictor(l, t, tl)
+	case 12:
+		return clampAddSubtractFull(l, t, tl)
+	case 13:
+		return clampAddSubtractHalf(average2(l, t), tl)
+	}
+	return 0
+}
+
+func average2(a, b uint32) uint32 {
+	return (((a ^ b) & 0xfefefefe) >> 1) + (a & b)
+}
+
+func channel(p uint32, shift uint) int32 {
+	return int32((p >> shift) & 0xff)
+}
+
+func abs32(x int32) int32 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func clamp255(x int32) uint32 {
+	if x < 0 {
+		return 0
+	}
+	if x > 255 {
+		return 255
+	}
+	return uint32(x)
+}
+
+func selectPredictor(l, t, tl uint32) uint32 {
+	var pl, pt int32
+	for shift := uint(0); shift < 32; shift += 8 {
+		pl += abs32(channel(tl, shift) - channel(t, shift))
+		pt += abs32(channel(tl, shift) - channel(l, shift))
+	}
+	if pl < pt {
+		return l
+	}
+	return t
+}
+
+func clampAddSubtractFull(a, b, c uint32) uint32 {
+	var p uint32
+	for shift := uint(0); shift < 32; shift += 8 {
+		p |= clamp255(channel(a, shift)+channel(b, shift)-channel(c, shift)) << shift
+	}
+	return p
+}
+
+func clampAddSubtractHalf(a, b uint32) uint32 {
+	var p uint32
+	for shift := uint(0); shift < 32; shift += 8 {
+		ca, cb := channel(a, shift), channel(b, shift)
+		p |= clamp255(ca+(ca-cb)/2) << shift
+	}
+	return p
+}
+
+// subPixels subtracts b from a channel by channel, modulo 256.
+func subPixels(a, b uint32) uint32 {
+	ag := (a | 0x00ff00ff) - (b & 0xff00ff00)
+	rb := (a | 0xff00ff00) - (b & 0x00ff00ff)
+	return ag&0xff00ff00 | rb&0x00ff00ff
+}
+
+// residualCost estimates the cost of coding residual r.
+func residualCost(r uint32) int {
+	c := 0
+	for shift := uint(0); shift < 32; shift += 8 {
+		c += int(abs32(int32(int8(r >> shift))))
+	}
+	return c
+}
+
+// neighbors returns the left, top, top-right and top-left pixels of the pixel
+// at index i, for a pixel that is neither in the first row nor the first
+// column.
+func neighbors(argb []uint32, w, i int) (l, t, tr, tl uint32) {
+	return argb[i-1], argb[i-w], argb[i-w+1], argb[i-w-1]
+}
+
+// predictorModes chooses the predictor mode with the smallest residuals for
+// every tile of the image.  The modes are returned as a sub-image, with the
+// mode in the green channel.
+func predictorModes(argb []uint32, w, h int) (modes []uint32, tw, th int) {
+	const size = 1 << predictorBits
+	tw, th = (w+size-1)>>predictorBits, (h+size-1)>>predictorBits
+	modes = make([]uint32, tw*th)
+	for ty := 0; ty < th; ty++ {
+		for tx := 0; tx < tw; tx++ {
+			var costs [nPredictors]int
+			for y := ty * size; y < (ty+1)*size && y < h; y++ {
+				if y == 0 {
+					continue
+				}
+				for x := tx * size; x < (tx+1)*size && x < w; x++ {
+					if x == 0 {
+						continue
+					}
+					i := y*w + x
+					l, t, tr, tl := neighbors(argb, w, i)
+					for mode := range costs {
+						costs[mode] += residualCost(subPixels(argb[i], predict(uint32(mode), l, t, tr, tl)))
+					}
+				}
+			}
+			best := 0
+			for mode, c := range costs {
+				if c < costs[best] {
+					best = mode
+				}
+			}
+			modes[ty*tw+tx] = 0xff000000 | uint32(best)<<8
+		}
+	}
+	return modes, tw, th
+}
+
+// applyPredictor replaces argb with its prediction residuals.
+func applyPredictor(argb []uint32, w, h int, modes []uint32) {
+	tw := (w + 1<<predictorBits - 1) >> predictorBits
+	// Work backwards so that predictions use the original pixel values.
+	for y := h - 1; y >= 0; y-- {
+		for x := w - 1; x >= 0; x-- {
+			i := y*w + x
+			var pred uint32
+			switch {
+			case x == 0 && y == 0:
+				pred = 0xff000000
+			case y == 0:
+				pred = argb[i-1]
+			case x == 0:
+				pred = argb[i-w]
+			default:
+				mode := (modes[(y>>predictorBits)*tw+x>>predictorBits] >> 8) & 0x0f
+				l, t, tr, tl := neighbors(argb, w, i)
+				pred = predict(mode, l, t, tr, tl)
+			}
+			argb[i] = subPixels(argb[i], pred)
+		}
+	}
+}
+
+// symbol is an entropy coding symbol of the pixel data: either a literal
+// pixel or a backward reference.
+type symbol struct {
+	argb   uint32
+	length int // zero for literals
+	dist   int // distance code
+}
+
+// writeEntropyImage writes the w×h image argb with a single group of Huffman
+// codes.  Only the top level image has the meta Huffman code flag.
+func writeEntropyImage(bw *bitWriter, argb []uint32, w, h int, topLevel bool) {
+	bw.write(0, 1) // no color cache
+	if topLevel {
+		bw.write(0, 1) // no meta Huffman codes
+	}
+
+	syms := backwardReferences(argb, w)
+
+	var (
+		green    = make([]uint32, nLiteralCodes+nLengthCodes)
+		red      = make([]uint32, nLiteralCodes)
+		blue     = make([]uint32, nLiteralCodes)
+		alpha    = make([]uint32, nLiteralCodes)
+		distance = make([]uint32, nDistanceCodes)
+	)
+	for _, s := range syms {
+		if s.length == 0 {
+			green[(s.argb>>8)&0xff]++
+			red[(s.argb>>16)&0xff]++
+			blue[s.argb&0xff]++
+			alpha[s.argb>>24]++
+			continue
+		}
+		code, _, _ := prefixEncode(s.length)
+		green[nLiteralCodes+code]++
+		code, _, _ = prefixEncode(s.dist)
+		distance[code]++
+	}
+
+	var codes [5]huffmanCode
+	for i, hist := range [][]uint32{green, red, blue, alpha, distance} {
+		codes[i] = writeHuffmanCode(bw, hist)
+	}
+
+	for _, s := range syms {
+		if s.length == 0 {
+			codes[0].write(bw, int((s.argb>>8)&0xff))
+			codes[1].write(bw, int((s.argb>>16)&0xff))
+			codes[2].write(bw, int(s.argb&0xff))
+			codes[3].write(bw, int(s.argb>>24))
+			continue
+		}
+		code, n, extra := prefixEncode(s.length)
+		codes[0].write(bw, nLiteralCodes+code)
+		bw.write(extra, n)
+		code, n, extra = prefixEncode(s.dist)
+		codes[4].write(bw, code)
+		bw.write(extra, n)
+	}
+}
+
+// prefixEncode returns the prefix code, the number of extra bits and the extra
+// bits value of the LZ77 length or distance v, specified in section 4.2.2.
+func prefixEncode(v int) (code int, nBits uint, extra uint32) {
+	v--
+	if v < 4 {
+		return v, 0, 0
+	}
+	hb := uint(0)
+	for 2<<hb <= v {
+		hb++
+	}
+	second := (v >> (hb - 1)) & 1
+	nBits = hb - 1
+	return int(2*hb) + second, nBits, uint32(v) & (1<<nBits - 1)
+}
+
+// backwardReferences splits argb into literals and backward references.
+func backwardReferences(argb []uint32, w int) []symbol {
+	n := len(argb)
+	syms := make([]symbol, 0, n)
+
+	// Short distances have dedicated codes for small two-dimensional offsets.
+	distCodes := make(map[int]int)
+	for i := len(distanceMapTable) - 1; i >= 0; i-- {
+		c := distanceMapTable[i]
+		d := int(c>>4)*w + 8 - int(c&0xf)
+		if d >= 1 {
+			distCodes[d] = i + 1
+		}
+	}
+	distCode := func(d int) int {
+		if c, ok := distCodes[d]; ok {
+			return c
+		}
+		return d + len(distanceMapTable)
+	}
+
+	head := make([]int32, 1<<hashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int32, n)
+	hash := func(i int) uint32 {
+		return ((argb[i] * 0x1e35a7bd) ^ (argb[i+1] * 0x9e3779b1)) >> (32 - hashBits)
+	}
+	insert := func(i int) {
+		if i+1 < n {
+			k := hash(i)
+			prev[i] = head[k]
+			head[k] = int32(i)
+		}
+	}
+	matchLength := func(i, j int) int {
+		limit := n - i
+		if limit > maxMatch {
+			limit = maxMatch
+		}
+		l := 0
+		for l < limit && argb[i+l] == argb[j+l] {
+			l++
+		}
+		return l
+	}
+
+	for i := 0; i < n; {
+		bestLen, bestDist := 0, 0
+		try := func(j int) {
+			if j < 0 || i-j > maxWindow {
+				return
+			}
+			if l := matchLength(i, j); l > bestLen {
+				bestLen, bestDist = l, i-j
+			}
+		}
+		try(i - 1)
+		if w > 1 {
+			try(i - w)
+		}
+		if i+1 < n {
+			j := head[hash(i)]
+			for chain := 0; j >= 0 && chain < maxChain; chain++ {
+				try(int(j))
+				j = prev[j]
+			}
+		}
+
+		if bestLen < minMatch {
+			syms = append(syms, symbol{argb: argb[i]})
+			insert(i)
+			i++
+			continue
+		}
+		syms = append(syms, symbol{length: bestLen, dist: distCode(bestDist)})
+		for k := 0; k < bestLen; k++ {
+			insert(i + k)
+		}
+		i += bestLen
+	}
+	return syms
+}
+
+// huffmanCode holds the bit-reversed canonical codes of an alphabet.
+type huffmanCode struct {
+	codes   []uint32
+	lengths []uint8
+}
+
+func (h huffmanCode) write(bw *bitWriter, s int) {
+	if n := h.lengths[s]; n > 0 {
+		bw.write(h.codes[s], uint(n))
+	}
+}
+
+// writeHuffmanCode writes the Huffman code for the histogram hist and returns
+// the code to use for the symbols, specified in section 5.2.2.
+func writeHuffmanCode(bw *bitWriter, hist []uint32) huffmanCode {
+	var used []int
+	for s, c := range hist {
+		if c > 0 {
+			used = append(used, s)
+		}
+	}
+
+	if len(used) == 0 {
+		used = append(used, 0)
+	}
+	if len(used) <= 2 && used[len(used)-1] < nLiteralCodes {
+		// Simple code length code with one or two symbols.
+		bw.write(1, 1)
+		bw.write(uint32(len(used)-1), 1)
+		if used[0] < 2 {
+			bw.write(0, 1)
+			bw.write(uint32(used[0]), 1)
+		} else {
+			bw.write(1, 1)
+			bw.write(uint32(used[0]), 8)
+		}
+		h := huffmanCode{codes: make([]uint32, len(hist)), lengths: make([]uint8, len(hist))}
+		if len(used) == 2 {
+			bw.write(uint32(used[1]), 8)
+			h.codes[used[1]] = 1
+			h.lengths[used[0]] = 1
+			h.lengths[used[1]] = 1
+		}
+		return h
+	}
+
+	lengths := huffmanLengths(hist, maxCodeLength)
+	bw.write(0, 1)
+	writeCodeLengths(bw, lengths)
+	return canonicalCode(lengths)
+}
+
+// writeCodeLengths writes code lengths compressed with the code length code.
+func writeCodeLengths(bw *bitWriter, lengths []uint8) {
+	type token struct {
+		code  uint8
+		extra uint32
+	}
+	var tokens []token
+	for i := 0; i < len(lengths); {
+		v := lengths[i]
+		run := 1
+		for i+run < len(lengths) && lengths[i+run] == v {
+			run++
+		}
+		i += run
+		if v == 0 {
+			for run >= 11 {
+				r := run
+				if r > 138 {
+					r = 138
+				}
+				tokens = append(tokens, token{18, uint32(r - 11)})
+				run -= r
+			}
+			if run >= 3 {
+				tokens = append(tokens, token{17, uint32(run - 3)})
+				run = 0
+			}
+		} else {
+			tokens = append(tokens, token{v, 0})
+			run--
+			for run >= 3 {
+				r := run
+				if r > 6 {
+					r = 6
+				}
+				tokens = append(tokens, token{16, uint32(r - 3)})
+				run -= r
+			}
+		}
+		for ; run > 0; run-- {
+			tokens = append(tokens, token{v, 0})
+		}
+	}
+
+	hist := make([]uint32, len(codeLengthCodeOrder))
+	for _, t := range tokens {
+		hist[t.code]++
+	}
+	clLengths := huffmanLengths(hist, maxCodeLengthCodeLength)
+	n := len(codeLengthCodeOrder)
+	for n > 4 && clLengths[codeLengthCodeOrder[n-1]] == 0 {
+		n--
+	}
+	bw.write(uint32(n-4), 4)
+	for _, s := range codeLengthCodeOrder[:n] {
+		bw.write(uint32(clLengths[s]), 3)
+	}
+	bw.write(0, 1) // code lengths for the full alphabet follow
+
+	code := canonicalCode(clLengths)
+	extraBits := [3]uint{2, 3, 7}
+	for _, t := range tokens {
+		code.write(bw, int(t.code))
+		if t.code >= 16 {
+			bw.write(t.extra, extraBits[t.code-16])
+		}
+	}
+}
+
+// huffmanLengths returns Huffman code lengths of at most maxLength bits for
+// the histogram hist.  An alphabet with a single used symbol gets a one bit
+// code.
+func huffmanLengths(hist []uint32, maxLength int) []uint8 {
+	lengths := make([]uint8, len(hist))
+	type node struct {
+		count       uint32
+		left, right int // children indexes, -1 for leaves
+		symbol      int
+	}
+	var leaves []node
+	for s, c := range hist {
+		if c > 0 {
+			leaves = append(leaves, node{count: c, left: -1, right: -1, symbol: s})
+		}
+	}
+	switch len(leaves) {
+	case 0:
+		return lengths
+	case 1:
+		lengths[leaves[0].symbol] = 1
+		return lengths
+	}
+
+	// Flatten the histogram until the tree is shallow enough.
+	for countMin := uint32(1); ; countMin *= 2 {
+		nodes := make([]node, len(leaves), 2*len(leaves))
+		for i, l := range leaves {
+			if l.count < countMin {
+				l.count = countMin
+			}
+			nodes[i] = l
+		}
+		sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].count < nodes[j].count })
+
+		// Two-queue Huffman construction over the sorted leaves.
+		leaf, inner := 0, len(nodes)
+		pick := func() int {
+			if leaf < len(leaves) && (inner >= len(nodes) || nodes[leaf].count <= nodes[inner].count) {
+				leaf++
+				return leaf - 1
+			}
+			inner++
+			return inner - 1
+		}
+		for k := 0; k < len(leaves)-1; k++ {
+			a, b := pick(), pick()
+			nodes = append(nodes, node{count: nodes[a].count + nodes[b].count, left: a, right: b})
+		}
+
+		depths := make([]int, len(nodes))
+		maxDepth := 0
+		for i := len(nodes) - 1; i >= len(leaves); i-- {
+			d := depths[i] + 1
+			depths[nodes[i].left] = d
+			depths[nodes[i].right] = d
+			if d > maxDepth {
+				maxDepth = d
+			}
+		}
+		if maxDepth > maxLength {
+			continue
+		}
+		for i := 0; i < len(leaves); i++ {
+			lengths[nodes[i].symbol] = uint8(depths[i])
+		}
+		return lengths
+	}
+}
+
+// canonicalCode assigns canonical codes to the code lengths.  The codes are
+// bit-reversed, since the bitstream is written least significant bit first.
+// A single used symbol is coded with zero bits.
+func canonicalCode(lengths []uint8) huffmanCode {
+	h := huffmanCode{codes: make([]uint32, len(lengths)), lengths: make([]uint8, len(lengths))}
+	var count [maxCodeLength + 1]uint32
+	used := 0
+	for _, l := range lengths {
+		if l > 0 {
+			count[l]++
+			used++
+		}
+	}
+	if used <= 1 {
+		return h
+	}
+	var next [maxCodeLength + 1]uint32
+	code := uint32(0)
+	for l := 1; l <= maxCodeLength; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	for s, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		c := next[l]
+		next[l]++
+		r := uint32(0)
+		for i := uint8(0); i < l; i++ {
+			r = r<<1 | (c>>i)&1
+		}
+		h.codes[s] = r
+		h.lengths[s] = l
+	}
+	return h
+}
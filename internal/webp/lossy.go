@@ -0,0 +1,909 @@
+package webp
+
+import (
+	"image"
+	"math"
+)
+
+// This file implements the lossy VP8 bitstream, as specified in RFC 6386.
+//
+// Every macroblock is predicted as a whole with one of the four 16x16 luma
+// and 8x8 chroma intra modes.  The frame is coded in two passes: the first
+// chooses modes and quantizes the residuals, the second gathers token
+// statistics to update the coefficient probabilities before writing the
+// partitions.
+
+// Intra prediction modes of whole macroblocks.
+const (
+	predDC = iota
+	predTM
+	predVE
+	predHE
+	nIntraModes
+)
+
+// Quantization rounding biases, in 1/256ths of the quantizer step.
+const (
+	biasDC = 96
+	biasAC = 110
+)
+
+// macroblock holds the coding decisions of one macroblock.  Coefficient
+// levels are stored in zigzag order.
+type macroblock struct {
+	yMode, uvMode int
+	skip          bool
+	y2            [16]int16
+	y             [16][16]int16
+	u, v          [4][16]int16
+}
+
+// quantizer holds the DC and AC step sizes of a coefficient plane.
+type quantizer [2]int32
+
+// lossyEncoder holds the state of a VP8 key frame being encoded.
+type lossyEncoder struct {
+	w, h     int
+	mbw, mbh int
+
+	// source and reconstructed planes, padded to whole macroblocks
+	srcY, srcU, srcV []uint8
+	recY, recU, recV []uint8
+	yStride, cStride int
+
+	qIndex       int
+	y1, y2, uv   quantizer
+	filterLevel  int
+	macroblocks  []macroblock
+	probs        [nPlane * nBand * nContext * nProb]uint8
+	updateProbs  [nPlane * nBand * nContext * nProb]bool
+	skipProb     uint8
+	counts       [nPlane * nBand * nContext * nProb][2]uint32
+	nzLeft       uint8 // bits 0-3 luma rows, 4-5 U rows, 6-7 V rows
+	nzTop        []uint8
+	nzY2Left     uint8
+	nzY2Top      []uint8
+	countingPass bool
+	tokens       *boolEncoder
+}
+
+// encodeLossy returns the VP8 bitstream of m at the given quality.
+func encodeLossy(m *image.NRGBA, quality int) []byte {
+	e := newLossyEncoder(m, quality)
+	for mby := 0; mby < e.mbh; mby++ {
+		for mbx := 0; mbx < e.mbw; mbx++ {
+			e.encodeMacroblock(mbx, mby)
+		}
+	}
+	e.computeProbs()
+	return e.frame()
+}
+
+func newLossyEncoder(m *image.NRGBA, quality int) *lossyEncoder {
+	e := &lossyEncoder{w: m.Rect.Dx(), h: m.Rect.Dy()}
+	e.mbw, e.mbh = (e.w+15)/16, (e.h+15)/16
+	e.yStride, e.cStride = 16*e.mbw, 8*e.mbw
+	e.srcY = make([]uint8, e.yStride*16*e.mbh)
+	e.srcU = make([]uint8, e.cStride*8*e.mbh)
+	e.srcV = make([]uint8, e.cStride*8*e.mbh)
+	e.recY = make([]uint8, len(e.srcY))
+	e.recU = make([]uint8, len(e.srcU))
+	e.recV = make([]uint8, len(e.srcV))
+	e.macroblocks = make([]macroblock, e.mbw*e.mbh)
+	e.nzTop = make([]uint8, e.mbw)
+	e.nzY2Top = make([]uint8, e.mbw)
+	e.convert(m)
+
+	e.qIndex = quantIndex(quality)
+	q := e.qIndex
+	e.y1 = quantizer{int32(dequantTableDC[q]), int32(dequantTableAC[q])}
+	e.y2 = quantizer{int32(dequantTableDC[q]) * 2, int32(dequantTableAC[q]) * 155 / 100}
+	if e.y2[1] < 8 {
+		e.y2[1] = 8
+	}
+	uvq := q
+	if uvq > 117 {
+		uvq = 117
+	}
+	e.uv = quantizer{int32(dequantTableDC[uvq]), int32(dequantTableAC[q])}
+	e.filterLevel = q / 3
+	return e
+}
+
+// quantIndex maps a quality from 1 to 100 to a quantizer index from 127 to
+// 0, following the curve used by libwebp.
+func quantIndex(quality int) int {
+	c := float64(quality) / 100
+	linear := 2*c - 1
+	if c < 0.75 {
+		linear = c * 2 / 3
+	}
+	q := int(127*(1-math.Cbrt(linear)) + 0.5)
+	if q < 0 {
+		return 0
+	}
+	if q > 127 {
+		return 127
+	}
+	return q
+}
+
+// convert fills the source planes with the BT.601 studio swing YCbCr
+// representation of m, replicating edge pixels into the padding.
+func (e *lossyEncoder) convert(m *image.NRGBA) {
+	rgb := func(x, y int) (r, g, b int32) {
+		if x >= e.w {
+			x = e.w - 1
+		}
+		if y >= e.h {
+			y = e.h - 1
+		}
+		p := m.Pix[y*m.Stride+4*x:]
+		return int32(p[0]), int32(p[1]), int32(p[2])
+	}
+	for y := 0; y < 16*e.mbh; y++ {
+		for x := 0; x < e.yStride; x++ {
+			r, g, b := rgb(x, y)
+			e.srcY[y*e.yStride+x] = uint8((16839*r + 33059*g + 6420*b + 1<<15 + 16<<16) >> 16)
+		}
+	}
+	for y := 0; y < 8*e.mbh; y++ {
+		for x := 0; x < e.cStride; x++ {
+			var r, g, b int32
+			for _, d := range [4][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+				pr, pg, pb := rgb(2*x+d[0], 2*y+d[1])
+				r, g, b = r+pr, g+pg, b+pb
+			}
+			e.srcU[y*e.cStride+x] = clipUV(-9719*r - 19081*g + 28800*b)
+			e.srcV[y*e.cStride+x] = clipUV(28800*r - 24116*g - 4684*b)
+		}
+	}
+}
+
+// clipUV scales a chroma value computed from the sum of four pixels.
+func clipUV(v int32) uint8 {
+	v = (v + 1<<17 + 128<<18) >> 18
+	return clip8(v)
+}
+
+func clip8(v int32) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
+
+// edges returns the reconstructed pixels above and left of the size×size
+// block at (x, y) of plane, and the pixel above-left of it.  Missing pixels
+// take the values specified in section 12.2.
+func edges(plane []uint8, stride, x, y, size int) (top, left []uint8, corner uint8) {
+	top = make([]uint8, size)
+	left = make([]uint8, size)
+	switch {
+	case y == 0:
+		corner = 127
+	case x == 0:
+		corner = 129
+	default:
+		corner = plane[(y-1)*stride+x-1]
+	}
+	for i := 0; i < size; i++ {
+		if y == 0 {
+			top[i] = 127
+		} else {
+			top[i] = plane[(y-1)*stride+x+i]
+		}
+		if x == 0 {
+			left[i] = 129
+		} else {
+			left[i] = plane[(y+i)*stride+x-1]
+		}
+	}
+	return top, left, corner
+}
+
+// predictBlock returns the size×size intra prediction of mode.  The DC mode
+// averages only the edges inside the frame, as specified in section 12.2.
+func predictBlock(mode int, top, left []uint8, corner uint8, hasTop, hasLeft bool) []uint8 {
+	size := len(top)
+	pred := make([]uint8, size*size)
+	switch mode {
+	case predDC:
+		shift := uint(3)
+		if size == 16 {
+			shift = 4
+		}
+		var sum uint32
+		dc := uint8(0x80)
+		switch {
+		case hasTop && hasLeft:
+			for i := 0; i < size; i++ {
+				sum += uint32(top[i]) + uint32(left[i])
+			}
+			dc = uint8((sum + 1<<shift) >> (shift + 1))
+		case hasTop:
+			for i := 0; i < size; i++ {
+				sum += uint32(top[i])
+			}
+			dc = uint8((sum + 1<<(shift-1)) >> shift)
+		case hasLeft:
+			for i := 0; i < size; i++ {
+				sum += uint32(left[i])
+			}
+			dc = uint8((sum + 1<<(shift-1)) >> shift)
+		}
+		for i := range pred {
+			pred[i] = dc
+		}
+	case predTM:
+		for j := 0; j < size; j++ {
+			for i := 0; i < size; i++ {
+				pred[j*size+i] = clip8(int32(top[i]) + int32(left[j]) - int32(corner))
+			}
+		}
+	case predVE:
+		for j := 0; j < size; j++ {
+			copy(pred[j*size:], top)
+		}
+	case predHE:
+		for j := 0; j < size; j++ {
+			for i := 0; i < size; i++ {
+				pred[j*size+i] = left[j]
+			}
+		}
+	}
+	return pred
+}
+
+// sse returns the sum of squared differences between the size×size block at
+// (x, y) of plane and pred.
+func sse(plane []uint8, stride, x, y int, pred []uint8, size int) int {
+	s := 0
+	for j := 0; j < size; j++ {
+		for i := 0; i < size; i++ {
+			d := int(plane[(y+j)*stride+x+i]) - int(pred[j*size+i])
+			s += d * d
+		}
+	}
+	return s
+}
+
+// encodeMacroblock chooses the prediction modes of a macroblock, quantizes
+// its residuals and reconstructs it as a decoder would.
+func (e *lossyEncoder) encodeMacroblock(mbx, mby int) {
+	mb := &e.macroblocks[mby*e.mbw+mbx]
+	hasTop, hasLeft := mby > 0, mbx > 0
+
+	// luma
+	x, y := 16*mbx, 16*mby
+	top, left, corner := edges(e.recY, e.yStride, x, y, 16)
+	var pred []uint8
+	best := -1
+	for mode := 0; mode < nIntraModes; mode++ {
+		p := predictBlock(mode, top, left, corner, hasTop, hasLeft)
+		if s := sse(e.srcY, e.yStride, x, y, p, 16); best < 0 || s < best {
+			best, pred, mb.yMode = s, p, mode
+		}
+	}
+
+	var coeffs [16][16]int32
+	var dc [16]int32
+	for n := 0; n < 16; n++ {
+		bx, by := 4*(n%4), 4*(n/4)
+		var res [16]int32
+		for j := 0; j < 4; j++ {
+			for i := 0; i < 4; i++ {
+				res[4*j+i] = int32(e.srcY[(y+by+j)*e.yStride+x+bx+i]) - int32(pred[(by+j)*16+bx+i])
+			}
+		}
+		coeffs[n] = forwardDCT(res)
+		dc[n] = coeffs[n][0]
+	}
+
+	nonZero := false
+	wht := forwardWHT(dc)
+	var y2 [16]int32
+	for k := 0; k < 16; k++ {
+		z := zigzag[k]
+		mb.y2[k] = quantize(wht[z], e.y2[btoi(k > 0)], biasDC)
+		y2[z] = int32(mb.y2[k]) * e.y2[btoi(k > 0)]
+		nonZero = nonZero || mb.y2[k] != 0
+	}
+	dc = inverseWHT(y2)
+	for n := 0; n < 16; n++ {
+		var deq [16]int32
+		deq[0] = dc[n]
+		for k := 1; k < 16; k++ {
+			z := zigzag[k]
+			mb.y[n][k] = quantize(coeffs[n][z], e.y1[1], biasAC)
+			deq[z] = int32(mb.y[n][k]) * e.y1[1]
+			nonZero = nonZero || mb.y[n][k] != 0
+		}
+		bx, by := 4*(n%4), 4*(n/4)
+		inverseDCT(deq, pred[by*16+bx:], 16)
+	}
+	for j := 0; j < 16; j++ {
+		copy(e.recY[(y+j)*e.yStride+x:], pred[j*16:j*16+16])
+	}
+
+	// chroma
+	x, y = 8*mbx, 8*mby
+	topU, leftU, cornerU := edges(e.recU, e.cStride, x, y, 8)
+	topV, leftV, cornerV := edges(e.recV, e.cStride, x, y, 8)
+	var predU, predV []uint8
+	best = -1
+	for mode := 0; mode < nIntraModes; mode++ {
+		pu := predictBlock(mode, topU, leftU, cornerU, hasTop, hasLeft)
+		pv := predictBlock(mode, topV, leftV, cornerV, hasTop, hasLeft)
+		s := sse(e.srcU, e.cStride, x, y, pu, 8) + sse(e.srcV, e.cStride, x, y, pv, 8)
+		if best < 0 || s < best {
+			best, predU, predV, mb.uvMode = s, pu, pv, mode
+		}
+	}
+	for _, c := range []struct {
+		src, rec []uint8
+		pred     []uint8
+		levels   *[4][16]int16
+	}{
+		{e.srcU, e.recU, predU, &mb.u},
+		{e.srcV, e.recV, predV, &mb.v},
+	} {
+		for n := 0; n < 4; n++ {
+			bx, by := 4*(n%2), 4*(n/2)
+			var res [16]int32
+			for j := 0; j < 4; j++ {
+				for i := 0; i < 4; i++ {
+					res[4*j+i] = int32(c.src[(y+by+j)*e.cStride+x+bx+i]) - int32(c.pred[(by+j)*8+bx+i])
+				}
+			}
+			coef := forwardDCT(res)
+			var deq [16]int32
+			for k := 0; k < 16; k++ {
+				z := zigzag[k]
+				bias := int32(biasAC)
+				if k == 0 {
+					bias = biasDC
+				}
+				c.levels[n][k] = quantize(coef[z], e.uv[btoi(k > 0)], bias)
+				deq[z] = int32(c.levels[n][k]) * e.uv[btoi(k > 0)]
+				nonZero = nonZero || c.levels[n][k] != 0
+			}
+			inverseDCT(deq, c.pred[by*8+bx:], 8)
+		}
+		for j := 0; j < 8; j++ {
+			copy(c.rec[(y+j)*e.cStride+x:], c.pred[j*8:j*8+8])
+		}
+	}
+
+	mb.skip = !nonZero
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// quantize returns the quantized level of coefficient c with step q and a
+// rounding bias in 1/256ths of q.
+func quantize(c, q, bias int32) int16 {
+	a := c
+	if a < 0 {
+		a = -a
+	}
+	l := (a + q*bias>>8) / q
+	if l > 2048 {
+		l = 2048
+	}
+	if c < 0 {
+		l = -l
+	}
+	return int16(l)
+}
+
+// forwardDCT returns the 4x4 forward DCT of the residual block in, as in the
+// reference encoder.
+func forwardDCT(in [16]int32) (out [16]int32) {
+	var tmp [16]int32
+	for i := 0; i < 4; i++ {
+		p := in[4*i:]
+		a := (p[0] + p[3]) * 8
+		b := (p[1] + p[2]) * 8
+		c := (p[1] - p[2]) * 8
+		d := (p[0] - p[3]) * 8
+		tmp[4*i+0] = a + b
+		tmp[4*i+2] = a - b
+		tmp[4*i+1] = (c*2217 + d*5352 + 14500) >> 12
+		tmp[4*i+3] = (d*2217 - c*5352 + 7500) >> 12
+	}
+	for i := 0; i < 4; i++ {
+		a := tmp[i] + tmp[12+i]
+		b := tmp[4+i] + tmp[8+i]
+		c := tmp[4+i] - tmp[8+i]
+		d := tmp[i] - tmp[12+i]
+		out[i] = (a + b + 7) >> 4
+		out[8+i] = (a - b + 7) >> 4
+		out[4+i] = (c*2217+d*5352+12000)>>16 + int32(btoi(d != 0))
+		out[12+i] = (d*2217 - c*5352 + 51000) >> 16
+	}
+	return out
+}
+
+// inverseDCT adds the inverse DCT of the dequantized coefficients in to the
+// 4x4 block at the start of dst, as specified in section 14.3.
+func inverseDCT(in [16]int32, dst []uint8, stride int) {
+	const (
+		c1 = 85627 // 65536 * cos(pi/8) * sqrt(2)
+		c2 = 35468 // 65536 * sin(pi/8) * sqrt(2)
+	)
+	var m [4][4]int32
+	for i := 0; i < 4; i++ {
+		a := in[i] + in[8+i]
+		b := in[i] - in[8+i]
+		c := (in[4+i]*c2)>>16 - (in[12+i]*c1)>>16
+		d := (in[4+i]*c1)>>16 + (in[12+i]*c2)>>16
+		m[i][0] = a + d
+		m[i][1] = b + c
+		m[i][2] = b - c
+		m[i][3] = a - d
+	}
+	for j := 0; j < 4; j++ {
+		dc := m[0][j] + 4
+		a := dc + m[2][j]
+		b := dc - m[2][j]
+		c := (m[1][j]*c2)>>16 - (m[3][j]*c1)>>16
+		d := (m[1][j]*c1)>>16 + (m[3][j]*c2)>>16
+		row := dst[j*stride:]
+		row[0] = clip8(int32(row[0]) + (a+d)>>3)
+		row[1] = clip8(int32(row[1]) + (b+c)>>3)
+		row[2] = clip8(int32(row[2]) + (b-c)>>3)
+		row[3] = clip8(int32(row[3]) + (a-d)>>3)
+	}
+}
+
+// forwardWHT returns the Walsh-Hadamard transform of the 16 luma DC
+// coefficients, as in the reference encoder.
+func forwardWHT(in [16]int32) (out [16]int32) {
+	var tmp [16]int32
+	for i := 0; i < 4; i++ {
+		p := in[4*i:]
+		a := (p[0] + p[2]) * 4
+		d := (p[1] + p[3]) * 4
+		c := (p[1] - p[3]) * 4
+		b := (p[0] - p[2]) * 4
+		tmp[4*i+0] = a + d + int32(btoi(a != 0))
+		tmp[4*i+1] = b + c
+		tmp[4*i+2] = b - c
+		tmp[4*i+3] = a - d
+	}
+	for i := 0; i < 4; i++ {
+		a := tmp[i] + tmp[8+i]
+		d := tmp[4+i] + tmp[12+i]
+		c := tmp[4+i] - tmp[12+i]
+		b := tmp[i] - tmp[8+i]
+		a2, b2, c2, d2 := a+d, b+c, b-c, a-d
+		for _, v := range []*int32{&a2, &b2, &c2, &d2} {
+			if *v < 0 {
+				*v++
+			}
+		}
+		out[i] = (a2 + 3) >> 3
+		out[4+i] = (b2 + 3) >> 3
+		out[8+i] = (c2 + 3) >> 3
+		out[12+i] = (d2 + 3) >> 3
+	}
+	return out
+}
+
+// inverseWHT returns the luma DC coefficients of the dequantized WHT
+// coefficients in, as specified in section 14.3.
+func inverseWHT(in [16]int32) (out [16]int32) {
+	var m [16]int32
+	for i := 0; i < 4; i++ {
+		a0 := in[i] + in[12+i]
+		a1 := in[4+i] + in[8+i]
+		a2 := in[4+i] - in[8+i]
+		a3 := in[i] - in[12+i]
+		m[i] = a0 + a1
+		m[8+i] = a0 - a1
+		m[4+i] = a3 + a2
+		m[12+i] = a3 - a2
+	}
+	for i := 0; i < 4; i++ {
+		dc := m[4*i] + 3
+		a0 := dc + m[4*i+3]
+		a1 := m[4*i+1] + m[4*i+2]
+		a2 := m[4*i+1] - m[4*i+2]
+		a3 := dc - m[4*i+3]
+		out[4*i+0] = (a0 + a1) >> 3
+		out[4*i+1] = (a3 + a2) >> 3
+		out[4*i+2] = (a0 - a1) >> 3
+		out[4*i+3] = (a3 - a2) >> 3
+	}
+	return out
+}
+
+// probIndex returns the index of a token probability in the flattened
+// probability tables.
+func probIndex(plane, band, ctx, k int) int {
+	return ((plane*nBand+band)*nContext+ctx)*nProb + k
+}
+
+// putTokenBit codes a bit with a token probability, or counts it during the
+// statistics pass.
+func (e *lossyEncoder) putTokenBit(i int, bit bool) {
+	if e.countingPass {
+		e.counts[i][btoi(bit)]++
+		return
+	}
+	e.tokens.putBit(e.probs[i], bit)
+}
+
+// putFixedBit codes a bit with a constant probability.
+func (e *lossyEncoder) putFixedBit(prob uint8, bit bool) {
+	if !e.countingPass {
+		e.tokens.putBit(prob, bit)
+	}
+}
+
+// codeBlock codes the levels of a 4x4 block, starting at scan position first,
+// as specified in section 13.  It returns whether the block has any non-zero
+// level.
+func (e *lossyEncoder) codeBlock(levels *[16]int16, first, plane int, ctx uint8) uint8 {
+	last := -1
+	for k := 15; k >= first; k-- {
+		if levels[k] != 0 {
+			last = k
+			break
+		}
+	}
+
+	n := first
+	p := probIndex(plane, int(bands[n]), int(ctx), 0)
+	if last < 0 {
+		e.putTokenBit(p, false)
+		return 0
+	}
+	e.putTokenBit(p, true)
+	for n < 16 {
+		l := levels[n]
+		v := int32(l)
+		if v < 0 {
+			v = -v
+		}
+		n++
+		if v == 0 {
+			e.putTokenBit(p+1, false)
+			p = probIndex(plane, int(bands[n]), 0, 0)
+			continue
+		}
+		e.putTokenBit(p+1, true)
+		next := 2
+		switch {
+		case v == 1:
+			e.putTokenBit(p+2, false)
+			next = 1
+		case v <= 4:
+			e.putTokenBit(p+2, true)
+			e.putTokenBit(p+3, false)
+			if v == 2 {
+				e.putTokenBit(p+4, false)
+			} else {
+				e.putTokenBit(p+4, true)
+				e.putTokenBit(p+5, v == 4)
+			}
+		case v <= 10:
+			e.putTokenBit(p+2, true)
+			e.putTokenBit(p+3, true)
+			e.putTokenBit(p+6, false)
+			if v <= 6 {
+				e.putTokenBit(p+7, false)
+				e.putFixedBit(159, v == 6)
+			} else {
+				e.putTokenBit(p+7, true)
+				e.putFixedBit(165, (v-7)&2 != 0)
+				e.putFixedBit(145, (v-7)&1 != 0)
+			}
+		default:
+			e.putTokenBit(p+2, true)
+			e.putTokenBit(p+3, true)
+			e.putTokenBit(p+6, true)
+			cat := 3
+			switch {
+			case v <= 18:
+				cat = 0
+			case v <= 34:
+				cat = 1
+			case v <= 66:
+				cat = 2
+			}
+			e.putTokenBit(p+8, cat >= 2)
+			e.putTokenBit(p+9+cat/2, cat&1 != 0)
+			extra := v - 3 - 8<<uint(cat)
+			tab := cat3456[cat]
+			for i, prob := range tab {
+				e.putFixedBit(prob, extra>>uint(len(tab)-1-i)&1 != 0)
+			}
+		}
+		p = probIndex(plane, int(bands[n]), next, 0)
+		e.putFixedBit(128, l < 0)
+		if n == 16 {
+			break
+		}
+		e.putTokenBit(p, n <= last)
+		if n > last {
+			break
+		}
+	}
+	return 1
+}
+
+// codeMacroblock codes the coefficient tokens of a macroblock, as specified
+// in section 13, tracking the non-zero contexts of its neighbors.
+func (e *lossyEncoder) codeMacroblock(mbx int, mb *macroblock) {
+	if mb.skip {
+		e.nzLeft, e.nzTop[mbx] = 0, 0
+		e.nzY2Left, e.nzY2Top[mbx] = 0, 0
+		return
+	}
+
+	nz := e.codeBlock(&mb.y2, 0, planeY2, e.nzY2Left+e.nzY2Top[mbx])
+	e.nzY2Left, e.nzY2Top[mbx] = nz, nz
+
+	left, top := e.nzLeft, e.nzTop[mbx]
+	var newLeft, newTop uint8
+	for y := uint(0); y < 4; y++ {
+		l := left >> y & 1
+		for x := uint(0); x < 4; x++ {
+			t := top >> x & 1
+			if y > 0 {
+				t = newTop >> x & 1
+			}
+			l = e.codeBlock(&mb.y[4*y+x], 1, planeY1WithY2, l+t)
+			newTop = newTop&^(1<<x) | l<<x
+		}
+		newLeft |= l << y
+	}
+	for c, blocks := range []*[4][16]int16{&mb.u, &mb.v} {
+		shift := uint(4 + 2*c)
+		for y := uint(0); y < 2; y++ {
+			l := left >> (shift + y) & 1
+			for x := uint(0); x < 2; x++ {
+				t := top >> (shift + x) & 1
+				if y > 0 {
+					t = newTop >> (shift + x) & 1
+				}
+				l = e.codeBlock(&blocks[2*y+x], 0, planeUV, l+t)
+				newTop = newTop&^(1<<(shift+x)) | l<<(shift+x)
+			}
+			newLeft |= l << (shift + y)
+		}
+	}
+	e.nzLeft, e.nzTop[mbx] = newLeft, newTop
+}
+
+// codeTokens codes the coefficient tokens of all macroblocks.
+func (e *lossyEncoder) codeTokens() {
+	for i := range e.nzTop {
+		e.nzTop[i], e.nzY2Top[i] = 0, 0
+	}
+	for mby := 0; mby < e.mbh; mby++ {
+		e.nzLeft, e.nzY2Left = 0, 0
+		for mbx := 0; mbx < e.mbw; mbx++ {
+			e.codeMacroblock(mbx, &e.macroblocks[mby*e.mbw+mbx])
+		}
+	}
+}
+
+// computeProbs gathers token statistics and decides which coefficient
+// probabilities are worth updating, as well as the skip probability.
+func (e *lossyEncoder) computeProbs() {
+	e.countingPass = true
+	e.codeTokens()
+	e.countingPass = false
+
+	i := 0
+	for plane := range defaultTokenProb {
+		for band := range defaultTokenProb[plane] {
+			for ctx := range defaultTokenProb[plane][band] {
+				for k, old := range defaultTokenProb[plane][band][ctx] {
+					e.probs[i] = old
+					c := e.counts[i]
+					if total := c[0] + c[1]; total > 0 {
+						upd := tokenProbUpdateProb[plane][band][ctx][k]
+						p := clampProb(255 * c[0] / total)
+						oldCost := branchCost(c, old) + bitCost(upd, false)
+						newCost := branchCost(c, p) + bitCost(upd, true) + 8
+						if newCost < oldCost {
+							e.probs[i] = p
+							e.updateProbs[i] = true
+						}
+					}
+					i++
+				}
+			}
+		}
+	}
+
+	skipped := uint32(0)
+	for _, mb := range e.macroblocks {
+		if mb.skip {
+			skipped++
+		}
+	}
+	e.skipProb = clampProb(255 * (uint32(len(e.macroblocks)) - skipped) / uint32(len(e.macroblocks)))
+}
+
+func clampProb(p uint32) uint8 {
+	if p < 1 {
+		return 1
+	}
+	if p > 255 {
+		return 255
+	}
+	return uint8(p)
+}
+
+// bitCost returns the cost in bits of coding bit with probability prob.
+func bitCost(prob uint8, bit bool) float64 {
+	p := float64(prob) / 256
+	if bit {
+		p = 1 - p
+	}
+	return -math.Log2(p)
+}
+
+// branchCost returns the cost in bits of coding the counted zeros and ones
+// with probability prob.
+func branchCost(c [2]uint32, prob uint8) float64 {
+	return float64(c[0])*bitCost(prob, false) + float64(c[1])*bitCost(prob, true)
+}
+
+// frame writes the key frame header and both partitions.
+func (e *lossyEncoder) frame() []byte {
+	fp := newBoolEncoder()
+	fp.putLiteral(0, 1) // color space
+	fp.putLiteral(0, 1) // clamping type
+	fp.putLiteral(0, 1) // no segmentation
+	fp.putLiteral(0, 1) // normal loop filter
+	fp.putLiteral(uint32(e.filterLevel), 6)
+	fp.putLiteral(0, 3) // sharpness
+	fp.putLiteral(0, 1) // no loop filter deltas
+	fp.putLiteral(0, 2) // one token partition
+	fp.putLiteral(uint32(e.qIndex), 7)
+	for i := 0; i < 5; i++ {
+		fp.putLiteral(0, 1) // no quantizer deltas
+	}
+	fp.putLiteral(0, 1) // refresh entropy probabilities
+	i := 0
+	for plane := range tokenProbUpdateProb {
+		for band := range tokenProbUpdateProb[plane] {
+			for ctx := range tokenProbUpdateProb[plane][band] {
+				for _, upd := range tokenProbUpdateProb[plane][band][ctx] {
+					fp.putBit(upd, e.updateProbs[i])
+					if e.updateProbs[i] {
+						fp.putLiteral(uint32(e.probs[i]), 8)
+					}
+					i++
+				}
+			}
+		}
+	}
+	fp.putLiteral(1, 1) // macroblock skipping enabled
+	fp.putLiteral(uint32(e.skipProb), 8)
+
+	for _, mb := range e.macroblocks {
+		fp.putBit(e.skipProb, mb.skip)
+		fp.putBit(145, true) // 16x16 luma prediction
+		switch mb.yMode {
+		case predDC:
+			fp.putBit(156, false)
+			fp.putBit(163, false)
+		case predVE:
+			fp.putBit(156, false)
+			fp.putBit(163, true)
+		case predHE:
+			fp.putBit(156, true)
+			fp.putBit(128, false)
+		case predTM:
+			fp.putBit(156, true)
+			fp.putBit(128, true)
+		}
+		switch mb.uvMode {
+		case predDC:
+			fp.putBit(142, false)
+		case predVE:
+			fp.putBit(142, true)
+			fp.putBit(114, false)
+		case predHE:
+			fp.putBit(142, true)
+			fp.putBit(114, true)
+			fp.putBit(183, false)
+		case predTM:
+			fp.putBit(142, true)
+			fp.putBit(114, true)
+			fp.putBit(183, true)
+		}
+	}
+	first := fp.bytes()
+
+	e.tokens = newBoolEncoder()
+	e.codeTokens()
+	tokens := e.tokens.bytes()
+
+	out := make([]byte, 10, 10+len(first)+len(tokens))
+	tag := uint32(len(first))<<5 | 1<<4 // key frame, version 0, shown
+	putUint24(out, tag)
+	out[3], out[4], out[5] = 0x9d, 0x01, 0x2a
+	out[6], out[7] = byte(e.w), byte(e.w>>8)
+	out[8], out[9] = byte(e.h), byte(e.h>>8)
+	out = append(out, first...)
+	return append(out, tokens...)
+}
+
+// boolEncoder is the boolean entropy encoder specified in section 7.
+type boolEncoder struct {
+	buf      []byte
+	rng      uint32
+	bottom   uint32
+	bitCount int
+}
+
+func newBoolEncoder() *boolEncoder {
+	return &boolEncoder{rng: 255, bitCount: 24}
+}
+
+func (e *boolEncoder) putBit(prob uint8, bit bool) {
+	split := 1 + (e.rng-1)*uint32(prob)>>8
+	if bit {
+		e.bottom += split
+		e.rng -= split
+	} else {
+		e.rng = split
+	}
+	for e.rng < 128 {
+		e.rng <<= 1
+		if e.bottom&(1<<31) != 0 {
+			e.carry()
+		}
+		e.bottom <<= 1
+		e.bitCount--
+		if e.bitCount == 0 {
+			e.buf = append(e.buf, byte(e.bottom>>24))
+			e.bottom &= 1<<24 - 1
+			e.bitCount = 8
+		}
+	}
+}
+
+// carry propagates an overflow of bottom into the bytes already written.
+func (e *boolEncoder) carry() {
+	i := len(e.buf) - 1
+	for ; i >= 0 && e.buf[i] == 0xff; i-- {
+		e.buf[i] = 0
+	}
+	if i >= 0 {
+		e.buf[i]++
+	}
+}
+
+// putLiteral codes the n least significant bits of v, most significant first,
+// with even probability.
+func (e *boolEncoder) putLiteral(v uint32, n uint) {
+	for n > 0 {
+		n--
+		e.putBit(128, v>>n&1 != 0)
+	}
+}
+
+// bytes flushes the encoder and returns the coded data.
+func (e *boolEncoder) bytes() []byte {
+	for i := 0; i < 32; i++ {
+		e.putBit(128, false)
+	}
+	return e.buf
+}
@@ -0,0 +1,257 @@
+// Package webp implements a WebP image encoder.
+//
+// Both the lossy (VP8) and the lossless (VP8L) bitstreams are supported.
+// Lossy images with transparency carry their alpha channel in a separate,
+// losslessly compressed ALPH chunk as described in the WebP container
+// specification: https://developers.google.com/speed/webp/docs/riff_container
+//
+// Animations are encoded as ANMF frames of the whole canvas.
+package webp
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+)
+
+// DefaultQuality is the default quality encoding parameter.
+const DefaultQuality = 75
+
+// maxDimension is the largest width or height a WebP image can have.
+const maxDimension = 1 << 14
+
+// Options are the encoding parameters.
+type Options struct {
+	// Lossless selects the lossless VP8L bitstream.  Quality is ignored
+	// for lossless images.
+	Lossless bool
+
+	// Quality ranges from 1 to 100 inclusive, higher is better.
+	Quality int
+}
+
+// Animation is a sequence of images of the same size, shown in turn.
+type Animation struct {
+	Frames []image.Image
+
+	// Delays are the display times of the frames in milliseconds.
+	Delays []int
+
+	// LoopCount is the number of times the animation is played, 0 meaning
+	// forever.
+	LoopCount int
+}
+
+// Encode writes the image m to w in WebP format with the given options.
+// Default parameters are used if a nil *Options is passed.
+func Encode(w io.Writer, m image.Image, o *Options) error {
+	b := m.Bounds()
+	if err := checkSize(b); err != nil {
+		return err
+	}
+	opt := encodeOptions(o)
+
+	src := toNRGBA(m)
+	chunks := imageChunks(src, opt)
+	if !opt.Lossless && !opaque(src) {
+		chunks = append([]chunk{{"VP8X", vp8xHeader(vp8xAlpha, b.Dx(), b.Dy())}}, chunks...)
+	}
+	return writeRIFF(w, chunks)
+}
+
+// EncodeAll writes the animation a to w in WebP format with the given
+// options.  Default parameters are used if a nil *Options is passed.
+func EncodeAll(w io.Writer, a *Animation, o *Options) error {
+	if len(a.Frames) == 0 {
+		return errors.New("webp: no frames to encode")
+	}
+	if len(a.Delays) != len(a.Frames) {
+		return errors.New("webp: mismatched frame and delay counts")
+	}
+	b := a.Frames[0].Bounds()
+	if err := checkSize(b); err != nil {
+		return err
+	}
+	opt := encodeOptions(o)
+
+	flags := byte(vp8xAnimation)
+	frames := make([]chunk, len(a.Frames))
+	for i, m := range a.Frames {
+		if m.Bounds().Size() != b.Size() {
+			return errors.New("webp: frames are not all the same size")
+		}
+		src := toNRGBA(m)
+		if !opaque(src) {
+			flags |= vp8xAlpha
+		}
+		frames[i] = chunk{"ANMF", anmfPayload(src, a.Delays[i], imageChunks(src, opt))}
+	}
+
+	// a transparent background color, and the loop count
+	anim := make([]byte, 6)
+	binary.LittleEndian.PutUint16(anim[4:], uint16(clamp(a.LoopCount, 0, 1<<16-1)))
+
+	chunks := []chunk{
+		{"VP8X", vp8xHeader(flags, b.Dx(), b.Dy())},
+		{"ANIM", anim},
+	}
+	return writeRIFF(w, append(chunks, frames...))
+}
+
+// checkSize returns an error if an image with bounds b cannot be encoded.
+func checkSize(b image.Rectangle) error {
+	if b.Dx() <= 0 || b.Dy() <= 0 {
+		return errors.New("webp: empty image")
+	}
+	if b.Dx() > maxDimension || b.Dy() > maxDimension {
+		return errors.New("webp: image is too large to encode")
+	}
+	return nil
+}
+
+// encodeOptions returns the options o with defaults filled in.
+func encodeOptions(o *Options) Options {
+	var opt Options
+	if o != nil {
+		opt = *o
+	}
+	if opt.Quality <= 0 {
+		opt.Quality = DefaultQuality
+	}
+	if opt.Quality > 100 {
+		opt.Quality = 100
+	}
+	return opt
+}
+
+// imageChunks returns the chunks of the bitstream of src, without a VP8X
+// chunk.
+func imageChunks(src *image.NRGBA, opt Options) []chunk {
+	if opt.Lossless {
+		return []chunk{{"VP8L", encodeLossless(src)}}
+	}
+	vp8 := encodeLossy(src, opt.Quality)
+	if opaque(src) {
+		return []chunk{{"VP8 ", vp8}}
+	}
+	return []chunk{
+		{"ALPH", encodeAlpha(src)},
+		{"VP8 ", vp8},
+	}
+}
+
+// anmfPayload returns the payload of an ANMF chunk of the frame src, shown
+// for delay milliseconds in place of the whole canvas, with the bitstream in
+// chunks.
+func anmfPayload(src *image.NRGBA, delay int, chunks []chunk) []byte {
+	b := make([]byte, 16)
+	putUint24(b[6:], uint32(src.Bounds().Dx()-1))
+	putUint24(b[9:], uint32(src.Bounds().Dy()-1))
+	putUint24(b[12:], uint32(clamp(delay, 0, 1<<24-1)))
+	b[15] = anmfNoBlend
+	for _, c := range chunks {
+		b = appendChunk(b, c)
+	}
+	return b
+}
+
+func clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// toNRGBA returns m as a non-premultiplied image with its origin at (0, 0).
+func toNRGBA(m image.Image) *image.NRGBA {
+	if n, ok := m.(*image.NRGBA); ok && n.Rect.Min == (image.Point{}) {
+		return n
+	}
+	b := m.Bounds()
+	n := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(n, n.Bounds(), m, b.Min, draw.Src)
+	return n
+}
+
+// opaque returns whether every pixel of m is fully opaque.
+func opaque(m *image.NRGBA) bool {
+	for i := 3; i < len(m.Pix); i += 4 {
+		if m.Pix[i] != 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+// VP8X feature flags, specified in the "Extended File Format" section of the
+// container specification.
+const (
+	vp8xAnimation = 1 << 1
+	vp8xAlpha     = 1 << 4
+)
+
+// anmfNoBlend is the ANMF flag for frames that replace the canvas rather
+// than being blended onto it.
+const anmfNoBlend = 1 << 1
+
+// vp8xHeader returns the payload of a VP8X chunk.
+func vp8xHeader(flags byte, w, h int) []byte {
+	b := make([]byte, 10)
+	b[0] = flags
+	putUint24(b[4:], uint32(w-1))
+	putUint24(b[7:], uint32(h-1))
+	return b
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
+
+// chunk is a RIFF chunk.
+type chunk struct {
+	fourCC string
+	data   []byte
+}
+
+// writeRIFF writes chunks to w wrapped in a RIFF WEBP container.
+func writeRIFF(w io.Writer, chunks []chunk) error {
+	size := 4
+	for _, c := range chunks {
+		size += 8 + len(c.data) + len(c.data)&1
+	}
+
+	buf := make([]byte, 0, 8+size)
+	buf = append(buf, "RIFF"...)
+	buf = appendUint32(buf, uint32(size))
+	buf = append(buf, "WEBP"...)
+	for _, c := range chunks {
+		buf = appendChunk(buf, c)
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// appendChunk appends the chunk c, padded to an even length, to b.
+func appendChunk(b []byte, c chunk) []byte {
+	b = append(b, c.fourCC...)
+	b = appendUint32(b, uint32(len(c.data)))
+	b = append(b, c.data...)
+	if len(c.data)&1 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var tmp [4]byte
+	binary.LittleEndian.PutUint32(tmp[:], v)
+	return append(b, tmp[:]...)
+}
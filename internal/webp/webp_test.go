@@ -0,0 +1,233 @@
+package webp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+// testImage returns a w by h image with smooth gradients on the left and
+// noise on the right, using alpha values from the alpha function.
+func testImage(w, h int, alpha func(x, y int) uint8) *image.NRGBA {
+	m := image.NewNRGBA(image.Rect(0, 0, w, h))
+	r := rand.New(rand.NewSource(1))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBA{uint8(x * 3), uint8(y * 5), uint8(x * y), alpha(x, y)}
+			if x > w*3/4 {
+				c.R, c.G, c.B = uint8(r.Intn(256)), uint8(r.Intn(256)), uint8(r.Intn(256))
+			}
+			m.SetNRGBA(x, y, c)
+		}
+	}
+	return m
+}
+
+func opaqueAlpha(x, y int) uint8 { return 0xff }
+
+func gradientAlpha(x, y int) uint8 { return uint8(x + y) }
+
+var sizes = [][2]int{{1, 1}, {2, 1}, {7, 5}, {17, 9}, {64, 48}, {301, 203}}
+
+func TestEncode_Lossless(t *testing.T) {
+	for _, sz := range sizes {
+		m := testImage(sz[0], sz[1], gradientAlpha)
+		buf := new(bytes.Buffer)
+		if err := Encode(buf, m, &Options{Lossless: true}); err != nil {
+			t.Fatalf("Encode(%v) returned error: %v", sz, err)
+		}
+		d, err := webp.Decode(buf)
+		if err != nil {
+			t.Errorf("error decoding %v image: %v", sz, err)
+			continue
+		}
+		if got, ok := d.(*image.NRGBA); !ok || !bytes.Equal(got.Pix, m.Pix) {
+			t.Errorf("decoded %v image does not match the source", sz)
+		}
+	}
+}
+
+// Test that the decoder reconstructs exactly the frame the encoder predicted
+// from.  The loop filter is disabled, since the encoder does not apply it.
+func TestEncode_LossyReconstruction(t *testing.T) {
+	for _, quality := range []int{1, 30, 75, 100} {
+		for _, sz := range sizes {
+			e := newLossyEncoder(testImage(sz[0], sz[1], opaqueAlpha), quality)
+			for mby := 0; mby < e.mbh; mby++ {
+				for mbx := 0; mbx < e.mbw; mbx++ {
+					e.encodeMacroblock(mbx, mby)
+				}
+			}
+			e.computeProbs()
+			e.filterLevel = 0
+
+			buf := new(bytes.Buffer)
+			if err := writeRIFF(buf, []chunk{{"VP8 ", e.frame()}}); err != nil {
+				t.Fatal(err)
+			}
+			d, err := webp.Decode(buf)
+			if err != nil {
+				t.Errorf("error decoding %v image at quality %d: %v", sz, quality, err)
+				continue
+			}
+			got := d.(*image.YCbCr)
+			for y := 0; y < sz[1]; y++ {
+				if !bytes.Equal(got.Y[y*got.YStride:y*got.YStride+sz[0]], e.recY[y*e.yStride:y*e.yStride+sz[0]]) {
+					t.Errorf("luma row %d of %v image at quality %d does not match", y, sz, quality)
+					break
+				}
+			}
+			cw := (sz[0] + 1) / 2
+			for y := 0; y < (sz[1]+1)/2; y++ {
+				if !bytes.Equal(got.Cb[y*got.CStride:y*got.CStride+cw], e.recU[y*e.cStride:y*e.cStride+cw]) ||
+					!bytes.Equal(got.Cr[y*got.CStride:y*got.CStride+cw], e.recV[y*e.cStride:y*e.cStride+cw]) {
+					t.Errorf("chroma row %d of %v image at quality %d does not match", y, sz, quality)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestEncode_Lossy(t *testing.T) {
+	tests := []struct {
+		alpha func(x, y int) uint8
+		model color.Model
+	}{
+		{opaqueAlpha, color.YCbCrModel},
+		{gradientAlpha, color.NYCbCrAModel},
+	}
+	for _, tt := range tests {
+		m := testImage(64, 48, tt.alpha)
+		buf := new(bytes.Buffer)
+		if err := Encode(buf, m, nil); err != nil {
+			t.Fatalf("Encode returned error: %v", err)
+		}
+		d, err := webp.Decode(buf)
+		if err != nil {
+			t.Errorf("error decoding image: %v", err)
+			continue
+		}
+		if got, want := d.ColorModel(), tt.model; got != want {
+			t.Errorf("decoded image has color model %v, want %v", got, want)
+		}
+		if nycbcra, ok := d.(*image.NYCbCrA); ok {
+			for i, a := range nycbcra.A {
+				if a != m.Pix[4*i+3] {
+					t.Errorf("alpha of pixel %d is %d, want %d", i, a, m.Pix[4*i+3])
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestEncode_Size(t *testing.T) {
+	for _, r := range []image.Rectangle{
+		image.Rect(0, 0, 0, 0),
+		image.Rect(0, 0, maxDimension+1, 1),
+	} {
+		if err := Encode(new(bytes.Buffer), image.NewNRGBA(r), nil); err == nil {
+			t.Errorf("Encode of %v image did not return an error", r)
+		}
+	}
+}
+
+// readChunks returns the chunks in b, a sequence of RIFF chunks.
+func readChunks(t *testing.T, b []byte) []chunk {
+	var chunks []chunk
+	for len(b) > 0 {
+		if len(b) < 8 {
+			t.Fatalf("truncated chunk header")
+		}
+		n := int(binary.LittleEndian.Uint32(b[4:]))
+		if len(b) < 8+n {
+			t.Fatalf("truncated %q chunk", b[:4])
+		}
+		chunks = append(chunks, chunk{string(b[:4]), b[8 : 8+n]})
+		b = b[8+n+n&1:]
+	}
+	return chunks
+}
+
+func TestEncodeAll(t *testing.T) {
+	for _, tt := range []struct {
+		opt   *Options
+		alpha func(x, y int) uint8
+	}{
+		{nil, opaqueAlpha},
+		{nil, gradientAlpha},
+		{&Options{Lossless: true}, gradientAlpha},
+	} {
+		a := &Animation{
+			Frames:    []image.Image{testImage(17, 9, tt.alpha), testImage(17, 9, opaqueAlpha), image.NewNRGBA(image.Rect(0, 0, 17, 9))},
+			Delays:    []int{100, 50, 1 << 25},
+			LoopCount: 3,
+		}
+		buf := new(bytes.Buffer)
+		if err := EncodeAll(buf, a, tt.opt); err != nil {
+			t.Fatalf("EncodeAll returned error: %v", err)
+		}
+
+		b := buf.Bytes()
+		if string(b[:4]) != "RIFF" || string(b[8:12]) != "WEBP" || int(binary.LittleEndian.Uint32(b[4:])) != len(b)-8 {
+			t.Fatalf("EncodeAll did not write a RIFF WEBP container")
+		}
+		chunks := readChunks(t, b[12:])
+		if len(chunks) != 2+len(a.Frames) || chunks[0].fourCC != "VP8X" || chunks[1].fourCC != "ANIM" {
+			t.Fatalf("EncodeAll wrote chunks %v, want VP8X, ANIM and a frame each", chunks)
+		}
+		if flags := chunks[0].data[0]; flags != vp8xAnimation|vp8xAlpha {
+			t.Errorf("VP8X flags are %b, want animation and alpha", flags)
+		}
+		if loop := binary.LittleEndian.Uint16(chunks[1].data[4:]); loop != 3 {
+			t.Errorf("loop count is %d, want 3", loop)
+		}
+
+		for i, c := range chunks[2:] {
+			if c.fourCC != "ANMF" {
+				t.Errorf("chunk %d is %q, want ANMF", i+2, c.fourCC)
+				continue
+			}
+			d := c.data
+			w, h := int(d[6])|int(d[7])<<8|int(d[8])<<16, int(d[9])|int(d[10])<<8|int(d[11])<<16
+			delay := int(d[12]) | int(d[13])<<8 | int(d[14])<<16
+			if w != 16 || h != 8 || delay != clamp(a.Delays[i], 0, 1<<24-1) || d[15] != anmfNoBlend {
+				t.Errorf("frame %d header is %v", i, d[:16])
+			}
+
+			// the frame decodes on its own
+			frame := readChunks(t, d[16:])
+			if frame[0].fourCC == "ALPH" {
+				frame = append([]chunk{{"VP8X", vp8xHeader(vp8xAlpha, 17, 9)}}, frame...)
+			}
+			fb := new(bytes.Buffer)
+			if err := writeRIFF(fb, frame); err != nil {
+				t.Fatal(err)
+			}
+			m, err := webp.Decode(fb)
+			if err != nil {
+				t.Errorf("error decoding frame %d: %v", i, err)
+				continue
+			}
+			if m.Bounds() != image.Rect(0, 0, 17, 9) {
+				t.Errorf("frame %d is %v, want 17x9", i, m.Bounds())
+			}
+		}
+	}
+
+	for _, a := range []*Animation{
+		{},
+		{Frames: []image.Image{testImage(2, 2, opaqueAlpha)}},
+		{Frames: []image.Image{testImage(2, 2, opaqueAlpha), testImage(3, 2, opaqueAlpha)}, Delays: []int{10, 10}},
+	} {
+		if err := EncodeAll(new(bytes.Buffer), a, nil); err == nil {
+			t.Errorf("EncodeAll(%v) did not return an error", a)
+		}
+	}
+}
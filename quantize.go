@@ -0,0 +1,181 @@
+package imageproxy
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+
+	"github.com/disintegration/imaging"
+)
+
+// Range of palette sizes images can be quantized to.
+const (
+	minColors = 2
+	maxColors = 256
+)
+
+// quantize returns m reduced to a palette of at most n colors, chosen by
+// median cut unless m has no more colors than that.  With dither, the
+// quantization error is diffused with Floyd-Steinberg dithering.
+func quantize(m image.Image, n int, dither bool) *image.Paletted {
+	pal, exact := exactPalette(m, n)
+	if !exact {
+		pal = medianCut(m, n)
+	}
+
+	dst := image.NewPaletted(m.Bounds(), pal)
+	if dither && !exact {
+		draw.FloydSteinberg.Draw(dst, dst.Bounds(), m, m.Bounds().Min)
+	} else {
+		draw.Draw(dst, dst.Bounds(), m, m.Bounds().Min, draw.Src)
+	}
+	return dst
+}
+
+// exactPalette returns the colors of m, if there are at most n of them.
+func exactPalette(m image.Image, n int) (color.Palette, bool) {
+	src := imaging.Clone(m)
+	seen := make(map[color.NRGBA]bool)
+	var pal color.Palette
+	for i := 0; i < len(src.Pix); i += 4 {
+		c := color.NRGBA{src.Pix[i], src.Pix[i+1], src.Pix[i+2], src.Pix[i+3]}
+		if seen[c] {
+			continue
+		}
+		if len(pal) == n {
+			return nil, false
+		}
+		seen[c] = true
+		pal = append(pal, c)
+	}
+	return pal, true
+}
+
+// colorBin is the pixels of an image that fall into one bin of a color
+// histogram, with the sums of their channels.
+type colorBin struct {
+	sum   [4]int
+	count int
+}
+
+// mean returns the average channel ch of the pixels in b.
+func (b *colorBin) mean(ch int) int {
+	return b.sum[ch] / b.count
+}
+
+// colorBox is a set of histogram bins that becomes one palette color.
+type colorBox []*colorBin
+
+// span returns the channel along which the bins of box are spread the most,
+// and the size of that spread.
+func (box colorBox) span() (ch, size int) {
+	for c := 0; c < 4; c++ {
+		lo, hi := 255, 0
+		for _, b := range box {
+			v := b.mean(c)
+			if v < lo {
+				lo = v
+			}
+			if v > hi {
+				hi = v
+			}
+		}
+		if hi-lo > size {
+			ch, size = c, hi-lo
+		}
+	}
+	return ch, size
+}
+
+// color returns the average color of the pixels in box.
+func (box colorBox) color() color.NRGBA {
+	var sum [4]int
+	var count int
+	for _, b := range box {
+		for c := range sum {
+			sum[c] += b.sum[c]
+		}
+		count += b.count
+	}
+	return color.NRGBA{
+		uint8((sum[0] + count/2) / count),
+		uint8((sum[1] + count/2) / count),
+		uint8((sum[2] + count/2) / count),
+		uint8((sum[3] + count/2) / count),
+	}
+}
+
+// medianCut returns a palette of up to n colors for m.  The colors of m,
+// binned to 5 bits per channel, are repeatedly split at the median of the
+// box with the widest spread of colors.
+func medianCut(m image.Image, n int) color.Palette {
+	src := imaging.Clone(m)
+	bins := make(map[uint32]*colorBin)
+	for i := 0; i < len(src.Pix); i += 4 {
+		p := src.Pix[i : i+4]
+		key := uint32(p[0]>>3)<<15 | uint32(p[1]>>3)<<10 | uint32(p[2]>>3)<<5 | uint32(p[3]>>3)
+		b := bins[key]
+		if b == nil {
+			b = new(colorBin)
+			bins[key] = b
+		}
+		for c := range b.sum {
+			b.sum[c] += int(p[c])
+		}
+		b.count++
+	}
+	if len(bins) == 0 {
+		return color.Palette{color.NRGBA{}}
+	}
+
+	// order the bins for the same palette every time
+	keys := make([]int, 0, len(bins))
+	for key := range bins {
+		keys = append(keys, int(key))
+	}
+	sort.Ints(keys)
+	all := make(colorBox, len(keys))
+	for i, key := range keys {
+		all[i] = bins[uint32(key)]
+	}
+	boxes := []colorBox{all}
+	for len(boxes) < n {
+		// split the box with the widest spread, if it has more than one bin
+		best, bestCh, bestSize := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			if ch, size := box.span(); size > bestSize {
+				best, bestCh, bestSize = i, ch, size
+			}
+		}
+		if best < 0 {
+			break
+		}
+
+		box := boxes[best]
+		sort.SliceStable(box, func(i, j int) bool { return box[i].mean(bestCh) < box[j].mean(bestCh) })
+		var total, half int
+		for _, b := range box {
+			total += b.count
+		}
+		split := 1
+		for i, b := range box[:len(box)-1] {
+			half += b.count
+			split = i + 1
+			if 2*half >= total {
+				break
+			}
+		}
+		boxes[best] = box[:split]
+		boxes = append(boxes, box[split:])
+	}
+
+	pal := make(color.Palette, len(boxes))
+	for i, box := range boxes {
+		pal[i] = box.color()
+	}
+	return pal
+}
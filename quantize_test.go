@@ -0,0 +1,60 @@
+package imageproxy
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+func TestQuantize(t *testing.T) {
+	// a horizontal gradient from black to red
+	src := image.NewNRGBA(image.Rect(0, 0, 64, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 64; x++ {
+			src.SetNRGBA(x, y, color.NRGBA{uint8(x * 4), 0, 0, 255})
+		}
+	}
+
+	m := quantize(src, 8, false)
+	if len(m.Palette) > 8 {
+		t.Errorf("quantize(8) returned %d colors", len(m.Palette))
+	}
+	if !m.Bounds().Eq(src.Bounds()) {
+		t.Errorf("quantize(8) returned %v image, want %v", m.Bounds(), src.Bounds())
+	}
+	for x := 0; x < 64; x++ {
+		c := color.NRGBAModel.Convert(m.At(x, 0)).(color.NRGBA)
+		if d := absDiff(c.R, uint8(x*4)); d > 24 || c.G != 0 || c.B != 0 || c.A != 255 {
+			t.Errorf("quantize(8) returned %v at (%d, 0), want close to %v", c, x, src.At(x, 0))
+		}
+	}
+	if again := quantize(src, 8, false); !reflect.DeepEqual(again, m) {
+		t.Errorf("quantize(8) returned a different image the second time")
+	}
+	if dithered := quantize(src, 8, true); reflect.DeepEqual(dithered.Pix, m.Pix) {
+		t.Errorf("quantize(8) with dither returned the same image as without")
+	}
+
+	// images with few colors keep them exactly
+	src2 := newImage(2, 2, red, green, blue, color.NRGBA{0, 0, 0, 0})
+	m = quantize(src2, 16, true)
+	if len(m.Palette) != 4 {
+		t.Errorf("quantize(16) returned %d colors, want 4", len(m.Palette))
+	}
+	for i, want := range []color.Color{red, green, blue, color.NRGBA{0, 0, 0, 0}} {
+		if got := color.NRGBAModel.Convert(m.At(i%2, i/2)); got != want {
+			t.Errorf("quantize(16) returned %v at (%d, %d), want %v", got, i%2, i/2, want)
+		}
+	}
+}
+
+func TestExactPalette(t *testing.T) {
+	src := newImage(3, 1, red, green, red)
+	if pal, ok := exactPalette(src, 2); !ok || len(pal) != 2 {
+		t.Errorf("exactPalette(2) returned %v, %v, want 2 colors", pal, ok)
+	}
+	if _, ok := exactPalette(src, 1); ok {
+		t.Errorf("exactPalette(1) returned a palette for an image with 2 colors")
+	}
+}
@@ -97,6 +97,13 @@ type EncoderOptions struct {
 	OptimizeCoding  bool
 	ProgressiveMode bool
 	DCTMethod       DCTMethod
+
+	// mozjpeg extensions, only applied if ExtensionsSupported.
+	// NoTrellisQuant turns off trellis quantization, which mozjpeg uses by
+	// default.  QuantTable, if not nil, selects the base quantization table
+	// preset, from 0 to 8.
+	NoTrellisQuant bool
+	QuantTable     *int
 }
 
 // Encode encodes src image and writes into w as JPEG format data.
@@ -259,6 +266,8 @@ func encodeGray(cinfo *C.struct_jpeg_compress_struct, src *image.Gray, p *Encode
 }
 
 func setupEncoderOptions(cinfo *C.struct_jpeg_compress_struct, opt *EncoderOptions) {
+	// the quantization table preset must be selected before the quality
+	setupExtensions(cinfo, opt)
 	C.jpeg_set_quality(cinfo, C.int(opt.Quality), C.TRUE)
 	if opt.OptimizeCoding {
 		cinfo.optimize_coding = C.TRUE
@@ -267,6 +276,10 @@ func setupEncoderOptions(cinfo *C.struct_jpeg_compress_struct, opt *EncoderOptio
 	}
 	if opt.ProgressiveMode {
 		C.jpeg_simple_progression(cinfo)
+	} else {
+		// mozjpeg defaults to a progressive scan script
+		cinfo.num_scans = 0
+		cinfo.scan_info = nil
 	}
 	cinfo.dct_method = C.J_DCT_METHOD(opt.DCTMethod)
 
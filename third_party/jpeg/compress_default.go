@@ -0,0 +1,17 @@
+//go:build !mozjpeg
+// +build !mozjpeg
+
+package jpeg
+
+/*
+#include <stdio.h>
+#include "jpeglib.h"
+*/
+import "C"
+
+// ExtensionsSupported reports whether the package is built against mozjpeg,
+// with the mozjpeg build tag, and applies the mozjpeg extensions of
+// EncoderOptions.
+const ExtensionsSupported = false
+
+func setupExtensions(cinfo *C.struct_jpeg_compress_struct, opt *EncoderOptions) {}
@@ -0,0 +1,35 @@
+//go:build mozjpeg
+// +build mozjpeg
+
+package jpeg
+
+/*
+#include <stdio.h>
+#include "jpeglib.h"
+
+static void setup_extensions(j_compress_ptr cinfo, int trellis, int quant_table) {
+	if (!trellis) {
+		jpeg_c_set_bool_param(cinfo, JBOOLEAN_TRELLIS_QUANT, FALSE);
+	}
+	if (quant_table >= 0) {
+		jpeg_c_set_int_param(cinfo, JINT_BASE_QUANT_TBL_IDX, quant_table);
+	}
+}
+*/
+import "C"
+
+// ExtensionsSupported reports whether the package is built against mozjpeg,
+// with the mozjpeg build tag, and applies the mozjpeg extensions of
+// EncoderOptions.
+const ExtensionsSupported = true
+
+func setupExtensions(cinfo *C.struct_jpeg_compress_struct, opt *EncoderOptions) {
+	trellis, quantTable := C.int(1), C.int(-1)
+	if opt.NoTrellisQuant {
+		trellis = 0
+	}
+	if opt.QuantTable != nil {
+		quantTable = C.int(*opt.QuantTable)
+	}
+	C.setup_extensions(cinfo, trellis, quantTable)
+}
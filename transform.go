@@ -4,43 +4,112 @@ import (
 	"bytes"
 	"fmt"
 	"image"
-	_ "image/gif"  // register gif format
+	"image/color"
+	"image/draw"
+	"image/gif"
 	_ "image/jpeg" // register jpeg format
 	"image/png"
 	"io"
 	"math"
+	"strconv"
+	"strings"
 
 	"github.com/disintegration/imaging"
 	"github.com/muesli/smartcrop"
 	"github.com/rwcarlsen/goexif/exif"
-	"github.com/svkoskin/go-libjpeg/jpeg"
 	"golang.org/x/image/tiff"   // register tiff format
 	_ "golang.org/x/image/webp" // register webp format
 	"willnorris.com/go/gifresize"
+
+	"github.com/richiefi/imageproxy/internal/apng"
+	"github.com/richiefi/imageproxy/internal/webp"
+	"github.com/richiefi/imageproxy/third_party/jpeg"
 )
 
 // default compression quality of resized jpegs
 const defaultQuality = 95
 
+// lowest quality tried when fitting an image into Options.MaxBytes, and the
+// most times the image is shrunk when even that is too large
+const (
+	minBudgetQuality = 10
+	maxBudgetShrinks = 4
+)
+
 // maximum distance into image to look for EXIF tags
 const maxExifSize = 1 << 20
 
 // resample filter used when resizing images
 var resampleFilter = imaging.Box
 
+// resample filters that can be selected by name with Options.Filter
+var resampleFilters = map[string]imaging.ResampleFilter{
+	"nearest":    imaging.NearestNeighbor,
+	"box":        imaging.Box,
+	"linear":     imaging.Linear,
+	"catmullrom": imaging.CatmullRom,
+	"lanczos":    imaging.Lanczos,
+	"mitchell":   imaging.MitchellNetravali,
+}
+
 // Transform the provided image.  img should contain the raw bytes of an
-// encoded image in one of the supported formats (gif, jpeg, or png).  The
+// encoded image in one of the supported formats (gif, jpeg, png, tiff or webp).  The
 // bytes of a similarly encoded image is returned.
 func Transform(img []byte, opt Options) ([]byte, error) {
+	img, _, err := transform(img, opt, transformResources{})
+	return img, err
+}
+
+// transformResources holds the images, other than the one being transformed,
+// that a transformation uses.
+type transformResources struct {
+	// decoded watermark image of Options.Mark, nil if none
+	mark image.Image
+
+	// fonts available to Options.Text in addition to the bundled ones
+	fonts fontSet
+
+	// decoded mask image of Options.Mask, nil if none
+	mask image.Image
+}
+
+// transformInfo describes a transformation, for reporting it in response
+// headers.
+type transformInfo struct {
+	// device pixel ratio the image was sized for, 0 if none was requested
+	dpr float64
+
+	// quality the image was encoded at to fit Options.MaxBytes, 0 if no
+	// size was requested
+	quality int
+
+	// format the image was encoded in, empty if it was not transformed
+	format string
+}
+
+// media types of the formats transformed images are encoded in, animated png
+// being served as png like browsers expect
+var formatTypes = map[string]string{
+	"apng": "image/png",
+	"gif":  "image/gif",
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"tiff": "image/tiff",
+	"webp": "image/webp",
+}
+
+// transform is like Transform, but also describes the transformation.
+func transform(img []byte, opt Options, res transformResources) ([]byte, transformInfo, error) {
+	var info transformInfo
 	if !opt.transform() {
 		// bail if no transformation was requested
-		return img, nil
+		return img, info, nil
 	}
 
 	// decode image
 	m, format, err := image.Decode(bytes.NewReader(img))
 	if err != nil {
-		return nil, err
+		return nil, info, err
 	}
 
 	// apply EXIF orientation for jpeg and tiff source images. Read at most
@@ -52,25 +121,103 @@ func Transform(img []byte, opt Options) ([]byte, error) {
 		}
 	}
 
-	// encode webp and tiff as jpeg by default
-	if format == "tiff" || format == "webp" {
+	gifSource := format == "gif"
+
+	// encode tiff as jpeg by default
+	if format == "tiff" {
 		format = "jpeg"
 	}
 
-	if opt.Format != "" {
+	if opt.Format == optFormatAuto {
+		format = autoFormat(m, format, opt.AcceptWebP)
+	} else if opt.Format != "" {
 		format = opt.Format
 	}
 
+	// gifs stay animated as webp and apng too, but single frames of gifs, and
+	// gifs in other formats, are stills of the frame as it is displayed
+	animated := gifSource && opt.Frame == 0 && (format == "webp" || format == "apng")
+	if gifSource && (opt.Frame > 0 || format != "gif") {
+		m, err = gifFrame(img, opt.Frame)
+		if err != nil {
+			return nil, info, err
+		}
+	}
+
+	// borders are found once, in the still or the first frame of animations,
+	// and every frame is trimmed the same
+	trim := trimRect(m, opt)
+	opt.Trim = ""
+	trimmed := func(m image.Image) image.Image {
+		if m.Bounds().Eq(trim) {
+			return m
+		}
+		return imaging.Crop(m, trim)
+	}
+	m = trimmed(m)
+
+	opt, info.dpr = applyDPR(m, opt)
+
+	// transparent backgrounds of rotated and padded images need a format
+	// with transparency, so jpeg images that were not explicitly requested
+	// as jpeg, which is rejected, are encoded as png
+	if c, ok := parseHexColor(opt.Background); ok && c.A != 0xff && format == "jpeg" &&
+		(opt.arbitraryRotation() || opt.FitMode == fitFill) {
+		format = "png"
+	}
+
+	// masks make images transparent, which jpeg cannot be, so masked jpeg
+	// images are filled with an opaque bg color or encoded as png
+	var maskBackground string
+	if opt.masked() && (format == "jpeg" || format == "gif") {
+		if c, ok := parseHexColor(opt.Background); ok && c.A == 0xff {
+			maskBackground = opt.Background
+		} else if format == "jpeg" {
+			format = "png"
+		} else {
+			maskBackground = "ffffffff"
+		}
+	}
+
+	// fill the corners of rotated images in formats without transparency
+	if opt.arbitraryRotation() && opt.Background == "" && (format == "jpeg" || format == "gif") {
+		opt.Background = "ffffffff"
+	}
+
+	// text, watermarks and borders go on top of the otherwise finished
+	// image, and masks cut out all of it
+	transformOutput := func(m image.Image) image.Image {
+		m = drawText(capOutput(transformImage(m, opt), opt), opt.Text, res.fonts)
+		m = drawMark(m, res.mark, opt.Mark)
+		m = drawBorder(m, opt)
+		return applyMask(m, res.mask, opt, maskBackground)
+	}
+	transformFrame := func(m image.Image) image.Image {
+		return transformOutput(trimmed(m))
+	}
+
 	// transform and encode image
 	buf := new(bytes.Buffer)
 	switch format {
 	case "gif":
-		fn := func(img image.Image) image.Image {
-			return transformImage(img, opt)
+		if opt.Frame > 0 {
+			m = transformOutput(m)
+			err = gif.Encode(buf, quantize(m, maxColors, true), nil)
+			if err != nil {
+				return nil, info, err
+			}
+			break
+		}
+
+		if opt.MaxFrames > 0 || opt.MaxDuration > 0 {
+			img, err = truncateGIF(img, opt.MaxFrames, opt.MaxDuration)
+			if err != nil {
+				return nil, info, err
+			}
 		}
-		err = gifresize.Process(buf, bytes.NewReader(img), fn)
+		err = gifresize.Process(buf, bytes.NewReader(img), transformFrame)
 		if err != nil {
-			return nil, err
+			return nil, info, err
 		}
 	case "jpeg":
 		quality := opt.Quality
@@ -78,36 +225,309 @@ func Transform(img []byte, opt Options) ([]byte, error) {
 			quality = defaultQuality
 		}
 
-		libjpegOptions := jpeg.EncoderOptions{
-			Quality:         quality,
-			OptimizeCoding:  true,
-			ProgressiveMode: true,
-		}
-
-		m = transformImage(m, opt)
+		m = transformOutput(m)
 
-		err = jpeg.Encode(buf, m, &libjpegOptions)
+		encode := jpegEncoder(opt)
+		if opt.MaxBytes > 0 {
+			b, q, err := encodeWithin(m, quality, opt.MaxBytes, resizeFilter(opt), encode)
+			if err != nil {
+				return nil, info, err
+			}
+			buf.Write(b)
+			info.quality = q
+			break
+		}
+		b, err := encode(m, quality)
 		if err != nil {
-			return nil, err
+			return nil, info, err
+		}
+		buf.Write(b)
+	case "apng":
+		if animated {
+			frames, delays, loopCount, err := gifFrames(img, opt.MaxFrames, opt.MaxDuration, transformFrame)
+			if err != nil {
+				return nil, info, err
+			}
+			enc := apng.Encoder{CompressionLevel: png.BestCompression}
+			if level, ok := pngLevels[opt.PNGLevel]; ok {
+				enc.CompressionLevel = level
+			}
+			err = enc.Encode(buf, &apng.Animation{Frames: frames, Delays: delays, LoopCount: loopCount})
+			if err != nil {
+				return nil, info, err
+			}
+			break
 		}
+		fallthrough
 	case "png":
-		m = transformImage(m, opt)
-		enc := png.Encoder{CompressionLevel: png.BestCompression}
-		err = enc.Encode(buf, m)
+		m = transformOutput(m)
+		b, err := encodePNG(m, opt)
 		if err != nil {
-			return nil, err
+			return nil, info, err
 		}
+		buf.Write(b)
 	case "tiff":
-		m = transformImage(m, opt)
-		err = tiff.Encode(buf, m, &tiff.Options{tiff.Deflate, true})
+		m = transformOutput(m)
+		err = tiff.Encode(buf, m, &tiff.Options{Compression: tiff.Deflate, Predictor: true})
 		if err != nil {
-			return nil, err
+			return nil, info, err
+		}
+	case "webp":
+		if animated {
+			frames, delays, loopCount, err := gifFrames(img, opt.MaxFrames, opt.MaxDuration, transformFrame)
+			if err != nil {
+				return nil, info, err
+			}
+			a := &webp.Animation{Frames: frames, Delays: delays, LoopCount: loopCount}
+			err = webp.EncodeAll(buf, a, &webp.Options{Lossless: opt.Lossless, Quality: opt.Quality})
+			if err != nil {
+				return nil, info, err
+			}
+			break
+		}
+
+		m = transformOutput(m)
+		if opt.MaxBytes > 0 && !opt.Lossless {
+			quality := opt.Quality
+			if quality == 0 {
+				quality = webp.DefaultQuality
+			}
+			b, q, err := encodeWithin(m, quality, opt.MaxBytes, resizeFilter(opt), encodeWebP)
+			if err != nil {
+				return nil, info, err
+			}
+			buf.Write(b)
+			info.quality = q
+			break
+		}
+		err = webp.Encode(buf, m, &webp.Options{Lossless: opt.Lossless, Quality: opt.Quality})
+		if err != nil {
+			return nil, info, err
 		}
 	default:
-		return nil, fmt.Errorf("unsupported format: %v", format)
+		return nil, info, fmt.Errorf("unsupported format: %v", format)
+	}
+
+	info.format = format
+	return buf.Bytes(), info, nil
+}
+
+// autoFormat returns the format to encode m, decoded from format, in for the
+// "auto" format.  gif images are kept as gif to preserve animations, and
+// others are encoded as webp if acceptWebP is set.  Otherwise images with
+// transparency are encoded as png, and all others as jpeg.
+func autoFormat(m image.Image, format string, acceptWebP bool) string {
+	if format == "gif" {
+		return format
+	}
+	if acceptWebP {
+		return "webp"
 	}
+	if o, ok := m.(interface {
+		Opaque() bool
+	}); ok && !o.Opaque() {
+		return "png"
+	}
+	return "jpeg"
+}
+
+// chroma subsampling ratios that can be selected with Options.Subsampling
+var subsampleRatios = map[string]image.YCbCrSubsampleRatio{
+	"444": image.YCbCrSubsampleRatio444,
+	"422": image.YCbCrSubsampleRatio422,
+	"420": image.YCbCrSubsampleRatio420,
+}
+
+// jpegEncoder returns a function encoding images as jpegs of a given quality,
+// with the jpeg encoding options of opt.
+func jpegEncoder(opt Options) func(image.Image, int) ([]byte, error) {
+	return func(m image.Image, quality int) ([]byte, error) {
+		// the encoder only keeps the subsampling of YCbCr images
+		if ratio, ok := subsampleRatios[opt.Subsampling]; ok {
+			m = toYCbCr(m, ratio)
+		}
+		buf := new(bytes.Buffer)
+		o := &jpeg.EncoderOptions{
+			Quality:         quality,
+			OptimizeCoding:  !opt.NoOptimize,
+			ProgressiveMode: !opt.Baseline,
+			NoTrellisQuant:  opt.NoTrellis,
+		}
+		if table, ok := jpegQuantTables[opt.JPEGQuant]; ok {
+			o.QuantTable = &table
+		}
+		err := jpeg.Encode(buf, m, o)
+		return buf.Bytes(), err
+	}
+}
+
+// mozjpeg quantization table presets that can be selected by name with
+// Options.JPEGQuant
+var jpegQuantTables = map[string]int{
+	"annex-k":     0,
+	"flat":        1,
+	"ms-ssim":     2,
+	"imagemagick": 3,
+	"psnr-hvs":    4,
+	"klein":       5,
+	"watson":      6,
+	"ahumada":     7,
+	"peterson":    8,
+}
+
+// toYCbCr converts m to a YCbCr image with the chroma subsampling ratio,
+// averaging the chroma of the pixels sharing a sample.  Transparency is
+// ignored, as when encoding m directly.
+func toYCbCr(m image.Image, ratio image.YCbCrSubsampleRatio) *image.YCbCr {
+	src := imaging.Clone(m)
+	b := src.Bounds()
+
+	// the encoder reads whole blocks, beyond the bounds of the image
+	dst := jpeg.NewYCbCrAligned(b, ratio)
+	cb := make([]int, len(dst.Cb))
+	cr := make([]int, len(dst.Cr))
+	n := make([]int, len(dst.Cb))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			i := src.PixOffset(x, y)
+			yy, u, v := color.RGBToYCbCr(src.Pix[i], src.Pix[i+1], src.Pix[i+2])
+			dst.Y[dst.YOffset(x, y)] = yy
+			ci := dst.COffset(x, y)
+			cb[ci] += int(u)
+			cr[ci] += int(v)
+			n[ci]++
+		}
+	}
+	for i := range n {
+		if n[i] > 0 {
+			dst.Cb[i] = uint8((cb[i] + n[i]/2) / n[i])
+			dst.Cr[i] = uint8((cr[i] + n[i]/2) / n[i])
+		}
+	}
+
+	// repeat the edges into the padding, so the blocks they share are not
+	// distorted by it
+	last := dst.COffset(b.Max.X-1, b.Max.Y-1)
+	cw, ch := last%dst.CStride+1, last/dst.CStride+1
+	extendPlane(dst.Y, dst.YStride, b.Dx(), b.Dy())
+	extendPlane(dst.Cb, dst.CStride, cw, ch)
+	extendPlane(dst.Cr, dst.CStride, cw, ch)
+	return dst
+}
+
+// extendPlane repeats the last column and row of the w by h pixels at the
+// start of the image plane p into the rest of it.
+func extendPlane(p []byte, stride, w, h int) {
+	for y := 0; y < h; y++ {
+		row := p[y*stride : (y+1)*stride]
+		for x := w; x < stride; x++ {
+			row[x] = row[w-1]
+		}
+	}
+	for y := h; (y+1)*stride <= len(p); y++ {
+		copy(p[y*stride:(y+1)*stride], p[(h-1)*stride:h*stride])
+	}
+}
 
-	return buf.Bytes(), nil
+// png compression levels that can be selected by name with Options.PNGLevel
+var pngLevels = map[string]png.CompressionLevel{
+	"none":    png.NoCompression,
+	"fast":    png.BestSpeed,
+	"default": png.DefaultCompression,
+	"best":    png.BestCompression,
+}
+
+// encodePNG encodes m as a png with the png encoding options of opt,
+// quantizing it to a palette and picking the smallest encoding as requested.
+func encodePNG(m image.Image, opt Options) ([]byte, error) {
+	enc := png.Encoder{CompressionLevel: png.BestCompression}
+	if level, ok := pngLevels[opt.PNGLevel]; ok {
+		enc.CompressionLevel = level
+	}
+
+	var candidates []image.Image
+	if opt.Colors > 0 {
+		candidates = append(candidates, quantize(m, opt.Colors, opt.Dither))
+	}
+	if opt.Colors == 0 || opt.PNGOptimize {
+		candidates = append(candidates, m)
+	}
+	if opt.Colors == 0 && opt.PNGOptimize {
+		if pal, ok := exactPalette(m, maxColors); ok {
+			p := image.NewPaletted(m.Bounds(), pal)
+			draw.Draw(p, p.Bounds(), m, m.Bounds().Min, draw.Src)
+			candidates = append(candidates, p)
+		}
+	}
+
+	var smallest []byte
+	for _, c := range candidates {
+		buf := new(bytes.Buffer)
+		if err := enc.Encode(buf, c); err != nil {
+			return nil, err
+		}
+		if smallest == nil || buf.Len() < len(smallest) {
+			smallest = buf.Bytes()
+		}
+	}
+	return smallest, nil
+}
+
+// encodeWebP encodes m as a lossy webp of the given quality.
+func encodeWebP(m image.Image, quality int) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := webp.Encode(buf, m, &webp.Options{Quality: quality})
+	return buf.Bytes(), err
+}
+
+// encodeWithin encodes m with encode at the highest quality, up to quality,
+// that keeps the output within maxBytes, along with the quality used.  When
+// even minBudgetQuality is too large, m is shrunk with filter and searched
+// again, and the smallest output is returned if none fits.
+func encodeWithin(m image.Image, quality, maxBytes int, filter imaging.ResampleFilter, encode func(image.Image, int) ([]byte, error)) ([]byte, int, error) {
+	lowest := minBudgetQuality
+	if quality < lowest {
+		lowest = quality
+	}
+
+	for i := 0; ; i++ {
+		b, err := encode(m, quality)
+		if err != nil || len(b) <= maxBytes {
+			return b, quality, err
+		}
+
+		// binary search for the highest quality that fits.  If none does,
+		// smallest ends up encoded at the lowest quality.
+		smallest := b
+		var best []byte
+		var bestQuality int
+		for lo, hi := lowest, quality-1; lo <= hi; {
+			q := (lo + hi) / 2
+			b, err := encode(m, q)
+			if err != nil {
+				return nil, 0, err
+			}
+			if len(b) <= maxBytes {
+				best, bestQuality = b, q
+				lo = q + 1
+			} else {
+				smallest = b
+				hi = q - 1
+			}
+		}
+		if best != nil {
+			return best, bestQuality, nil
+		}
+
+		// shrink the image by the ratio the size is off, with some margin
+		scale := 0.9 * math.Sqrt(float64(maxBytes)/float64(len(smallest)))
+		w := int(float64(m.Bounds().Dx()) * scale)
+		h := int(float64(m.Bounds().Dy()) * scale)
+		if i == maxBudgetShrinks || w < 1 || h < 1 {
+			return smallest, lowest, nil
+		}
+		m = imaging.Resize(m, w, h, filter)
+	}
 }
 
 // evaluateFloat interprets the option value f. If f is between 0 and 1, it is
@@ -123,17 +543,70 @@ func evaluateFloat(f float64, max int) int {
 	return int(f)
 }
 
+// applyDPR returns opt with its sizes multiplied by the device pixel ratio
+// opt.DPR, along with the ratio used.  Crop values in pixels are multiplied
+// by the requested ratio.  Unless the image may be scaled up, the ratio used for
+// width and height is lowered as needed to fit the cropped image of m.
+func applyDPR(m image.Image, opt Options) (Options, float64) {
+	dpr := opt.DPR
+	if dpr == 0 {
+		return opt, 0
+	}
+	opt.DPR = 0
+
+	for _, v := range []*float64{&opt.CropX, &opt.CropY, &opt.CropWidth, &opt.CropHeight} {
+		if math.Abs(*v) >= 1 {
+			*v *= dpr
+		}
+	}
+
+	if !opt.scaleUp() {
+		// smart crops only ever shrink the image, ignore them here
+		bounds := opt
+		bounds.SmartCrop = false
+		rect := cropParams(m, bounds)
+		if opt.Width >= 1 {
+			dpr = math.Min(dpr, float64(rect.Dx())/opt.Width)
+		}
+		if opt.Height >= 1 {
+			dpr = math.Min(dpr, float64(rect.Dy())/opt.Height)
+		}
+
+		// a dimension derived from the aspect ratio is limited too
+		if ar := opt.AspectRatio; ar > 0 && opt.Width >= 1 && opt.Height == 0 {
+			dpr = math.Min(dpr, float64(rect.Dy())*ar/opt.Width)
+		} else if ar > 0 && opt.Height >= 1 && opt.Width == 0 {
+			dpr = math.Min(dpr, float64(rect.Dx())/(opt.Height*ar))
+		}
+	}
+
+	if opt.Width >= 1 {
+		opt.Width = math.Floor(opt.Width*dpr + 0.5)
+	}
+	if opt.Height >= 1 {
+		opt.Height = math.Floor(opt.Height*dpr + 0.5)
+	}
+	return opt, dpr
+}
+
 // resizeParams determines if the image needs to be resized, and if so, the
 // dimensions to resize to.
 func resizeParams(m image.Image, opt Options) (w, h int, resize bool) {
 	// convert percentage width and height values to absolute values
 	imgW := m.Bounds().Dx()
 	imgH := m.Bounds().Dy()
-	w = evaluateFloat(opt.Width, imgW)
-	h = evaluateFloat(opt.Height, imgH)
+	w, h = requestedSize(opt, imgW, imgH)
+
+	// min and aspect ratios keep the requested aspect ratio when limiting it
+	// to the image
+	if (opt.FitMode == fitMin || opt.AspectRatio > 0 && !opt.scaleUp()) && w > 0 && h > 0 && (w > imgW || h > imgH) {
+		f := math.Min(float64(imgW)/float64(w), float64(imgH)/float64(h))
+		w = int(math.Floor(float64(w)*f + 0.5))
+		h = int(math.Floor(float64(h)*f + 0.5))
+	}
 
 	// never resize larger than the original image unless specifically allowed
-	if !opt.ScaleUp {
+	if !opt.scaleUp() {
 		if w > imgW {
 			w = imgW
 		}
@@ -142,6 +615,9 @@ func resizeParams(m image.Image, opt Options) (w, h int, resize bool) {
 		}
 	}
 
+	w, h = limitSize(m, opt, w, h)
+	w, h = capSize(opt, w, h)
+
 	// if requested width and height match the original, skip resizing
 	if (w == imgW || w == 0) && (h == imgH || h == 0) {
 		return 0, 0, false
@@ -150,22 +626,203 @@ func resizeParams(m image.Image, opt Options) (w, h int, resize bool) {
 	return w, h, true
 }
 
-// cropParams calculates crop rectangle parameters to keep it in image bounds
+// requestedSize returns the width and height requested by opt for an image of
+// imgW by imgH pixels, with a missing dimension derived from the aspect ratio.
+func requestedSize(opt Options, imgW, imgH int) (w, h int) {
+	w = evaluateFloat(opt.Width, imgW)
+	h = evaluateFloat(opt.Height, imgH)
+
+	ar := opt.AspectRatio
+	switch {
+	case ar <= 0 || w > 0 && h > 0:
+	case w > 0:
+		h = int(math.Max(1, math.Floor(float64(w)/ar+0.5)))
+	case h > 0:
+		w = int(math.Max(1, math.Floor(float64(h)*ar+0.5)))
+	default:
+		// the largest size with the aspect ratio that fits the image
+		w = imgW
+		h = int(math.Max(1, math.Floor(float64(imgW)/ar+0.5)))
+		if h > imgH {
+			h = imgH
+			w = int(math.Max(1, math.Floor(float64(imgH)*ar+0.5)))
+		}
+	}
+	return w, h
+}
+
+// limitSize scales the size w by h to the size limits of opt, keeping its
+// aspect ratio.  A zero dimension follows the aspect ratio of the cropped m,
+// and is left zero.  Maximums apply to the image as it is output, after
+// rotating it and adding outside borders.
+func limitSize(m image.Image, opt Options, w, h int) (int, int) {
+	if opt.MaxWidth == 0 && opt.MaxHeight == 0 && opt.MinWidth == 0 && opt.MinHeight == 0 {
+		return w, h
+	}
+
+	// the size the image would be resized to without limits
+	bounds := opt
+	bounds.SmartCrop = false
+	rect := cropParams(m, bounds)
+	fw, fh := float64(w), float64(h)
+	switch {
+	case w == 0 && h == 0:
+		fw, fh = float64(rect.Dx()), float64(rect.Dy())
+	case w == 0:
+		fw = fh * float64(rect.Dx()) / float64(rect.Dy())
+	case h == 0:
+		fh = fw * float64(rect.Dy()) / float64(rect.Dx())
+	}
+	if fw <= 0 || fh <= 0 {
+		return w, h
+	}
+
+	// minimums only scale up to the original image, unless allowed further
+	minW, minH := opt.MinWidth, opt.MinHeight
+	if !opt.scaleUp() {
+		if minW > rect.Dx() {
+			minW = rect.Dx()
+		}
+		if minH > rect.Dy() {
+			minH = rect.Dy()
+		}
+	}
+
+	scale := 1.0
+	if minW > 0 {
+		scale = math.Max(scale, float64(minW)/fw)
+	}
+	if minH > 0 {
+		scale = math.Max(scale, float64(minH)/fh)
+	}
+	rw, rh := rotatedSize(opt, fw, fh)
+	border := float64(2 * outsideBorder(opt))
+	if opt.MaxWidth > 0 {
+		scale = math.Min(scale, (float64(opt.MaxWidth)-border)/rw)
+	}
+	if opt.MaxHeight > 0 {
+		scale = math.Min(scale, (float64(opt.MaxHeight)-border)/rh)
+	}
+	if scale == 1 {
+		return w, h
+	}
+
+	if w == 0 && h == 0 {
+		return int(math.Max(1, math.Floor(fw*scale+0.5))), 0
+	}
+	if w > 0 {
+		w = int(math.Max(1, math.Floor(fw*scale+0.5)))
+	}
+	if h > 0 {
+		h = int(math.Max(1, math.Floor(fh*scale+0.5)))
+	}
+	return w, h
+}
+
+// capSize scales the size w by h down so the output, after rotating it and
+// adding outside borders as in opt, is at most maxDimension pixels in both
+// dimensions, keeping its aspect ratio.  A zero dimension is left zero.
+func capSize(opt Options, w, h int) (int, int) {
+	rw, rh := rotatedSize(opt, float64(w), float64(h))
+	limit := float64(maxDimension - 2*outsideBorder(opt))
+	if rw <= limit && rh <= limit {
+		return w, h
+	}
+	scale := math.Min(limit/rw, limit/rh)
+	if w > 0 {
+		w = int(math.Max(1, math.Floor(float64(w)*scale)))
+	}
+	if h > 0 {
+		h = int(math.Max(1, math.Floor(float64(h)*scale)))
+	}
+	return w, h
+}
+
+// capOutput scales m down to the size limits of opt and maxDimension, less
+// outside borders, in case rotating it made it larger than limitSize and
+// capSize expected.
+func capOutput(m image.Image, opt Options) image.Image {
+	limitW, limitH := maxDimension, maxDimension
+	if opt.MaxWidth > 0 && opt.MaxWidth < limitW {
+		limitW = opt.MaxWidth
+	}
+	if opt.MaxHeight > 0 && opt.MaxHeight < limitH {
+		limitH = opt.MaxHeight
+	}
+	border := 2 * outsideBorder(opt)
+	limitW = int(math.Max(1, float64(limitW-border)))
+	limitH = int(math.Max(1, float64(limitH-border)))
+	if m.Bounds().Dx() <= limitW && m.Bounds().Dy() <= limitH {
+		return m
+	}
+	w, h := fitSize(m, limitW, limitH)
+	return imaging.Resize(m, w, h, resizeFilter(opt))
+}
+
+// rotatedSize returns the size of the bounding box of a w by h image rotated
+// by opt.
+func rotatedSize(opt Options, w, h float64) (float64, float64) {
+	rotate := opt.Rotate - math.Floor(opt.Rotate/360)*360
+	switch rotate {
+	case 0, 180:
+		return w, h
+	case 90, 270:
+		return h, w
+	}
+	sin, cos := math.Sincos(math.Pi * rotate / 180)
+	sin, cos = math.Abs(sin), math.Abs(cos)
+	return w*cos + h*sin, w*sin + h*cos
+}
+
+// outsideBorder returns the width of the border opt adds around images, or 0
+// if it draws none or draws it over their edges.
+func outsideBorder(opt Options) int {
+	if !opt.BorderOutside || opt.BorderWidth <= 0 {
+		return 0
+	}
+	return opt.BorderWidth
+}
+
+// resizeFilter returns the resample filter of opt, or resampleFilter if it
+// selects none.
+func resizeFilter(opt Options) imaging.ResampleFilter {
+	if f, ok := resampleFilters[opt.Filter]; ok {
+		return f
+	}
+	return resampleFilter
+}
+
+// fitSize returns the largest size with the aspect ratio of m that fits in w
+// by h pixels.
+func fitSize(m image.Image, w, h int) (int, int) {
+	imgW, imgH := float64(m.Bounds().Dx()), float64(m.Bounds().Dy())
+	scale := math.Min(float64(w)/imgW, float64(h)/imgH)
+	fw := math.Max(1, math.Floor(imgW*scale+0.5))
+	fh := math.Max(1, math.Floor(imgH*scale+0.5))
+	return int(fw), int(fh)
+}
+
+// cropParams calculates crop rectangle parameters to keep it in image bounds.
+// The crop applies to the part of m left after trimming its borders.
 func cropParams(m image.Image, opt Options) image.Rectangle {
+	bounds := trimRect(m, opt)
 	if !opt.SmartCrop && opt.CropX == 0 && opt.CropY == 0 && opt.CropWidth == 0 && opt.CropHeight == 0 {
-		return m.Bounds()
+		return bounds
 	}
 
 	// width and height of image
-	imgW := m.Bounds().Dx()
-	imgH := m.Bounds().Dy()
+	imgW := bounds.Dx()
+	imgH := bounds.Dy()
 
 	if opt.SmartCrop {
-		w := evaluateFloat(opt.Width, imgW)
-		h := evaluateFloat(opt.Height, imgH)
-		r, err := smartcrop.SmartCrop(m, w, h)
+		w, h := requestedSize(opt, imgW, imgH)
+		trimmed := m
+		if !bounds.Eq(m.Bounds()) {
+			trimmed = imaging.Crop(m, bounds)
+		}
+		r, err := smartcrop.SmartCrop(trimmed, w, h)
 		if err == nil {
-			return r
+			return r.Add(bounds.Min.Sub(trimmed.Bounds().Min))
 		}
 	}
 
@@ -199,7 +856,559 @@ func cropParams(m image.Image, opt Options) image.Rectangle {
 		y1 = imgH
 	}
 
-	return image.Rect(x0, y0, x1, y1)
+	return image.Rect(x0, y0, x1, y1).Add(bounds.Min)
+}
+
+// trimRect returns the part of m inside the uniform borders that opt trims,
+// or the bounds of m if it trims none.  Images that are all border are not
+// trimmed.
+func trimRect(m image.Image, opt Options) image.Rectangle {
+	b := m.Bounds()
+	if opt.Trim == "" || b.Empty() {
+		return b
+	}
+
+	var border color.NRGBA
+	if opt.Trim == trimAuto {
+		border = color.NRGBAModel.Convert(m.At(b.Min.X, b.Min.Y)).(color.NRGBA)
+	} else if c, ok := parseHexColor(opt.Trim); ok {
+		border = c
+	} else {
+		return b
+	}
+
+	img := imaging.Clone(m)
+	tol := int(opt.TrimTolerance)
+	isBorder := func(x, y int) bool {
+		c := img.NRGBAAt(x, y)
+		if c.A == 0 && border.A == 0 {
+			return true
+		}
+		return absDiff(c.R, border.R) <= tol && absDiff(c.G, border.G) <= tol &&
+			absDiff(c.B, border.B) <= tol && absDiff(c.A, border.A) <= tol
+	}
+	rowIsBorder := func(y, x0, x1 int) bool {
+		for x := x0; x < x1; x++ {
+			if !isBorder(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+	colIsBorder := func(x, y0, y1 int) bool {
+		for y := y0; y < y1; y++ {
+			if !isBorder(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+
+	// the clone has its origin at 0, 0
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	y0, y1 := 0, h
+	for y0 < y1 && rowIsBorder(y0, 0, w) {
+		y0++
+	}
+	if y0 == y1 {
+		return b
+	}
+	for rowIsBorder(y1-1, 0, w) {
+		y1--
+	}
+	x0, x1 := 0, w
+	for colIsBorder(x0, y0, y1) {
+		x0++
+	}
+	for colIsBorder(x1-1, y0, y1) {
+		x1--
+	}
+	return image.Rect(x0, y0, x1, y1).Add(b.Min)
+}
+
+// absDiff returns the absolute difference of a and b.
+func absDiff(a, b uint8) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
+
+// focalPoint returns the focal point of opt in pixels, relative to the top
+// left corner of the crop rectangle rect of m.  Without a focal point, it is
+// the center of m.  Crop mode anchors move the focal point to the edges of
+// rect.
+func focalPoint(m image.Image, rect image.Rectangle, opt Options) (x, y float64) {
+	fx, fy := 0.5, 0.5
+	if opt.Focal {
+		fx, fy = opt.FocalX, opt.FocalY
+	}
+	b := m.Bounds()
+	x = fx*float64(b.Dx()) - float64(rect.Min.X-b.Min.X)
+	y = fy*float64(b.Dy()) - float64(rect.Min.Y-b.Min.Y)
+
+	if strings.Contains(opt.CropMode, "left") {
+		x = 0
+	} else if strings.Contains(opt.CropMode, "right") {
+		x = float64(rect.Dx())
+	}
+	if strings.Contains(opt.CropMode, "top") {
+		y = 0
+	} else if strings.Contains(opt.CropMode, "bottom") {
+		y = float64(rect.Dy())
+	}
+	return x, y
+}
+
+// focalCropRect returns the region of m to scale to fill w by h pixels,
+// centered as closely as possible on the point (fx, fy) relative to the top
+// left corner of m, and zoomed in by zoom.  Unless scaleUp is set, zoom is
+// limited to keep the region at least w by h pixels.
+func focalCropRect(m image.Image, w, h int, fx, fy, zoom float64, scaleUp bool) image.Rectangle {
+	b := m.Bounds()
+	imgW, imgH := float64(b.Dx()), float64(b.Dy())
+
+	// scale of the largest region with the aspect ratio of w by h
+	scale := math.Max(float64(w)/imgW, float64(h)/imgH)
+	zoom = math.Max(zoom, 1)
+	if !scaleUp {
+		zoom = math.Min(zoom, math.Max(1/scale, 1))
+	}
+	cw := math.Min(float64(w)/(scale*zoom), imgW)
+	ch := math.Min(float64(h)/(scale*zoom), imgH)
+
+	x0 := math.Max(0, math.Min(fx-cw/2, imgW-cw))
+	y0 := math.Max(0, math.Min(fy-ch/2, imgH-ch))
+	r := image.Rect(int(x0+0.5), int(y0+0.5), int(x0+cw+0.5), int(y0+ch+0.5))
+	return r.Add(b.Min)
+}
+
+// entropyCropRect returns the region of m to scale to fill w by h pixels that
+// has the most detail.  Starting from all of m, slices are trimmed from
+// whichever edge has the lower entropy until the region has the aspect ratio
+// of w by h.
+func entropyCropRect(m image.Image, w, h int) image.Rectangle {
+	b := m.Bounds()
+	imgW, imgH := float64(b.Dx()), float64(b.Dy())
+
+	scale := math.Max(float64(w)/imgW, float64(h)/imgH)
+	cw := int(math.Min(float64(w)/scale+0.5, imgW))
+	ch := int(math.Min(float64(h)/scale+0.5, imgH))
+
+	gray := imaging.Grayscale(m)
+	r := gray.Bounds()
+	for r.Dx() > cw {
+		slice := (r.Dx() - cw + 7) / 8
+		left := image.Rect(r.Min.X, r.Min.Y, r.Min.X+slice, r.Max.Y)
+		right := image.Rect(r.Max.X-slice, r.Min.Y, r.Max.X, r.Max.Y)
+		if entropy(gray, left) < entropy(gray, right) {
+			r.Min.X += slice
+		} else {
+			r.Max.X -= slice
+		}
+	}
+	for r.Dy() > ch {
+		slice := (r.Dy() - ch + 7) / 8
+		top := image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+slice)
+		bottom := image.Rect(r.Min.X, r.Max.Y-slice, r.Max.X, r.Max.Y)
+		if entropy(gray, top) < entropy(gray, bottom) {
+			r.Min.Y += slice
+		} else {
+			r.Max.Y -= slice
+		}
+	}
+	return r.Add(b.Min)
+}
+
+// entropy returns the Shannon entropy of the histogram of the region r of the
+// grayscale image m.
+func entropy(m *image.NRGBA, r image.Rectangle) float64 {
+	var hist [256]int
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		i := m.PixOffset(r.Min.X, y)
+		for x := r.Min.X; x < r.Max.X; x++ {
+			hist[m.Pix[i]]++
+			i += 4
+		}
+	}
+
+	n := float64(r.Dx() * r.Dy())
+	var e float64
+	for _, c := range hist {
+		if c > 0 {
+			p := float64(c) / n
+			e -= p * math.Log2(p)
+		}
+	}
+	return e
+}
+
+// adjustExposure changes the exposure of m by stops, doubling the linear
+// light of the image for every stop.
+func adjustExposure(m image.Image, stops float64) *image.NRGBA {
+	f := math.Pow(2, stops)
+	var lut [256]uint8
+	for i := range lut {
+		lut[i] = uint8(math.Floor(linearToSRGB(sRGBToLinear(float64(i)/255)*f)*255 + 0.5))
+	}
+	return imaging.AdjustFunc(m, func(c color.NRGBA) color.NRGBA {
+		return color.NRGBA{lut[c.R], lut[c.G], lut[c.B], c.A}
+	})
+}
+
+// sRGBToLinear converts an sRGB component between 0 and 1 to linear light.
+func sRGBToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// linearToSRGB converts linear light to an sRGB component, clamped to the
+// range from 0 to 1.
+func linearToSRGB(v float64) float64 {
+	if v >= 1 {
+		return 1
+	}
+	if v <= 0.0031308 {
+		return math.Max(0, v*12.92)
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// adjustSaturation changes the saturation of m by percentage, from -100 for
+// grayscale to 100 for double the saturation.
+func adjustSaturation(m image.Image, percentage float64) *image.NRGBA {
+	f := 1 + percentage/100
+	return imaging.AdjustFunc(m, func(c color.NRGBA) color.NRGBA {
+		r, g, b := float64(c.R), float64(c.G), float64(c.B)
+		y := luma(c)
+		return color.NRGBA{clampUint8(y + (r-y)*f), clampUint8(y + (g-y)*f), clampUint8(y + (b-y)*f), c.A}
+	})
+}
+
+// adjustHue rotates the hues of m by degrees, using the hue rotation matrix
+// of the CSS hue-rotate filter.
+func adjustHue(m image.Image, degrees float64) *image.NRGBA {
+	sin, cos := math.Sincos(degrees * math.Pi / 180)
+	mat := [9]float64{
+		0.213 + cos*0.787 - sin*0.213, 0.715 - cos*0.715 - sin*0.715, 0.072 - cos*0.072 + sin*0.928,
+		0.213 - cos*0.213 + sin*0.143, 0.715 + cos*0.285 + sin*0.140, 0.072 - cos*0.072 - sin*0.283,
+		0.213 - cos*0.213 - sin*0.787, 0.715 - cos*0.715 + sin*0.715, 0.072 + cos*0.928 + sin*0.072,
+	}
+	return imaging.AdjustFunc(m, func(c color.NRGBA) color.NRGBA {
+		r, g, b := float64(c.R), float64(c.G), float64(c.B)
+		return color.NRGBA{
+			clampUint8(mat[0]*r + mat[1]*g + mat[2]*b),
+			clampUint8(mat[3]*r + mat[4]*g + mat[5]*b),
+			clampUint8(mat[6]*r + mat[7]*g + mat[8]*b),
+			c.A,
+		}
+	})
+}
+
+// luma returns the brightness of c from 0 to 255.
+func luma(c color.NRGBA) float64 {
+	return 0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B)
+}
+
+// sepia applies a sepia tone to m, blended with the original colors when
+// amount is below 100.
+func sepia(m image.Image, amount float64) *image.NRGBA {
+	f := amount / 100
+	return imaging.AdjustFunc(m, func(c color.NRGBA) color.NRGBA {
+		r, g, b := float64(c.R), float64(c.G), float64(c.B)
+		sr := 0.393*r + 0.769*g + 0.189*b
+		sg := 0.349*r + 0.686*g + 0.168*b
+		sb := 0.272*r + 0.534*g + 0.131*b
+		return color.NRGBA{clampUint8(r + (sr-r)*f), clampUint8(g + (sg-g)*f), clampUint8(b + (sb-b)*f), c.A}
+	})
+}
+
+// duotone maps the brightness of m to the colors between shadow, for black,
+// and highlight, for white.  The alpha of the colors multiplies the alpha of
+// m.
+func duotone(m image.Image, shadow, highlight color.NRGBA) *image.NRGBA {
+	lerp := func(a, b uint8, t float64) float64 {
+		return float64(a) + (float64(b)-float64(a))*t
+	}
+	return imaging.AdjustFunc(m, func(c color.NRGBA) color.NRGBA {
+		t := luma(c) / 255
+		return color.NRGBA{
+			clampUint8(lerp(shadow.R, highlight.R, t)),
+			clampUint8(lerp(shadow.G, highlight.G, t)),
+			clampUint8(lerp(shadow.B, highlight.B, t)),
+			clampUint8(lerp(shadow.A, highlight.A, t) * float64(c.A) / 255),
+		}
+	})
+}
+
+// pixelate replaces each size by size block of m, starting from the top left
+// corner, with the average color of the block.
+func pixelate(m image.Image, size int) *image.NRGBA {
+	src := imaging.Clone(m)
+	b := src.Bounds()
+	dst := image.NewNRGBA(b)
+	for y0 := b.Min.Y; y0 < b.Max.Y; y0 += size {
+		for x0 := b.Min.X; x0 < b.Max.X; x0 += size {
+			block := image.Rect(x0, y0, x0+size, y0+size).Intersect(b)
+
+			// average colors weighted by alpha, so transparent pixels
+			// do not darken the block
+			var r, g, bl, a float64
+			for y := block.Min.Y; y < block.Max.Y; y++ {
+				i := src.PixOffset(block.Min.X, y)
+				for x := block.Min.X; x < block.Max.X; x++ {
+					pa := float64(src.Pix[i+3])
+					r += float64(src.Pix[i]) * pa
+					g += float64(src.Pix[i+1]) * pa
+					bl += float64(src.Pix[i+2]) * pa
+					a += pa
+					i += 4
+				}
+			}
+
+			var c color.NRGBA
+			if a > 0 {
+				n := float64(block.Dx() * block.Dy())
+				c = color.NRGBA{clampUint8(r / a), clampUint8(g / a), clampUint8(bl / a), clampUint8(a / n)}
+			}
+			draw.Draw(dst, block, &image.Uniform{c}, image.ZP, draw.Src)
+		}
+	}
+	return dst
+}
+
+// clampUint8 rounds v to the nearest integer from 0 to 255.
+func clampUint8(v float64) uint8 {
+	return uint8(math.Max(0, math.Min(255, math.Floor(v+0.5))))
+}
+
+// unsharpMask sharpens m by adding amount percent of the difference between
+// m and a copy blurred with the standard deviation radius, to the color
+// channels that differ from the blurred copy by more than threshold levels.
+func unsharpMask(m image.Image, amount, radius, threshold float64) *image.NRGBA {
+	src := imaging.Clone(m)
+	blurred := imaging.Blur(src, radius)
+	dst := image.NewNRGBA(src.Rect)
+	for i, v := range src.Pix {
+		if i%4 == 3 {
+			dst.Pix[i] = v
+			continue
+		}
+		diff := float64(v) - float64(blurred.Pix[i])
+		if math.Abs(diff) <= threshold {
+			dst.Pix[i] = v
+			continue
+		}
+		dst.Pix[i] = clampUint8(float64(v) + diff*amount/100)
+	}
+	return dst
+}
+
+// pad centers m on a w by h canvas filled with the background bg, which is a
+// color as 8 hexadecimal digits, or "blur" for a blurred copy of m enlarged to
+// fill the canvas.
+func pad(m image.Image, w, h int, bg string) *image.NRGBA {
+	var canvas *image.NRGBA
+	if bg == backgroundBlur {
+		// blurring a smaller copy is much faster, and smooth when enlarged
+		const shrink = 8
+		canvas = imaging.Fill(m, (w+shrink-1)/shrink, (h+shrink-1)/shrink, imaging.Center, imaging.Linear)
+		canvas = imaging.Resize(imaging.Blur(canvas, 2), w, h, imaging.Linear)
+	} else {
+		canvas = imaging.New(w, h, backgroundColor(bg))
+	}
+	return imaging.OverlayCenter(canvas, m, 1)
+}
+
+// drawMark composites the watermark image mark onto m as described by opt.
+// m is returned unchanged if mark is nil.
+func drawMark(m, mark image.Image, opt Mark) image.Image {
+	if mark == nil {
+		return m
+	}
+
+	b := m.Bounds()
+	if opt.Scale > 0 {
+		w := int(opt.Scale*float64(b.Dx()) + 0.5)
+		if w < 1 {
+			w = 1
+		}
+		mark = imaging.Resize(mark, w, 0, imaging.Lanczos)
+	}
+
+	pos := opt.Pos
+	if pos == "" {
+		pos = "bottom-right"
+	}
+	mb := mark.Bounds()
+	pt := anchorPoint(b, mb.Dx(), mb.Dy(), pos, edgePadding(opt.Pad, b))
+
+	alpha := 1.0
+	if opt.Alpha > 0 {
+		alpha = opt.Alpha / 100
+	}
+	return imaging.Overlay(m, mark, pt, alpha)
+}
+
+// applyMask makes the parts of m outside the mask of opt transparent, with
+// mask as the mask image if opt has one.  If bg is a color, the transparent
+// parts are filled with it.
+func applyMask(m, mask image.Image, opt Options, bg string) image.Image {
+	if !opt.masked() {
+		return m
+	}
+
+	dst := imaging.Clone(m)
+	w, h := dst.Bounds().Dx(), dst.Bounds().Dy()
+
+	var maskAlpha *image.NRGBA
+	var maskOpaque bool
+	if mask != nil {
+		if o, ok := mask.(interface {
+			Opaque() bool
+		}); ok {
+			maskOpaque = o.Opaque()
+		}
+		maskAlpha = imaging.Resize(mask, w, h, imaging.Linear)
+	}
+
+	radius := opt.CornerRadius
+	if radius < 1 {
+		radius *= math.Min(float64(w), float64(h))
+	}
+	radius = math.Min(radius, math.Min(float64(w), float64(h))/2)
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			// coverage of the pixel by the mask, measured at its center
+			px, py := float64(x)+0.5, float64(y)+0.5
+			a := 1.0
+			if opt.Mask == maskEllipse {
+				a *= ellipseCoverage(px, py, float64(w), float64(h))
+			}
+			if radius > 0 {
+				a *= roundedRectCoverage(px, py, float64(w), float64(h), radius)
+			}
+			if maskAlpha != nil {
+				c := maskAlpha.NRGBAAt(x, y)
+				if maskOpaque {
+					a *= luma(c) / 255
+				} else {
+					a *= float64(c.A) / 255
+				}
+			}
+
+			i := dst.PixOffset(x, y) + 3
+			dst.Pix[i] = clampUint8(float64(dst.Pix[i]) * a)
+		}
+	}
+
+	if c, ok := parseHexColor(bg); ok {
+		return imaging.Overlay(imaging.New(w, h, c), dst, image.ZP, 1)
+	}
+	return dst
+}
+
+// drawBorder draws the border of opt around m, either over its edges or
+// outside them.  m is returned unchanged if opt has no border.
+func drawBorder(m image.Image, opt Options) image.Image {
+	if opt.BorderWidth <= 0 {
+		return m
+	}
+
+	bw := opt.BorderWidth
+	var dst *image.NRGBA
+	if opt.BorderOutside {
+		b := m.Bounds()
+		dst = imaging.New(b.Dx()+2*bw, b.Dy()+2*bw, color.NRGBA{})
+		dst = imaging.Paste(dst, m, image.Pt(bw, bw))
+	} else {
+		dst = imaging.Clone(m)
+	}
+
+	c, ok := parseHexColor(opt.BorderColor)
+	if !ok {
+		c, _ = parseHexColor(defaultBorderColor)
+	}
+	w, h := float64(dst.Bounds().Dx()), float64(dst.Bounds().Dy())
+	fbw := float64(bw)
+	radius := math.Min(opt.BorderRadius, math.Min(w, h)/2)
+	innerRadius := math.Max(0, radius-fbw)
+
+	for y := 0; y < dst.Bounds().Dy(); y++ {
+		for x := 0; x < dst.Bounds().Dx(); x++ {
+			// coverage of the pixel by the outer and the inner edge of the
+			// border, measured at its center
+			px, py := float64(x)+0.5, float64(y)+0.5
+			outer := 1.0
+			if radius > 0 {
+				outer = roundedRectCoverage(px, py, w, h, radius)
+			}
+			inner := roundedRectCoverage(px-fbw, py-fbw, w-2*fbw, h-2*fbw, innerRadius)
+			if outer == 1 && inner == 1 {
+				continue
+			}
+
+			// draw the border over the pixel, and clear it outside the border
+			i := dst.PixOffset(x, y)
+			p := dst.Pix[i : i+4 : i+4]
+			srcA := float64(c.A) / 255 * math.Max(0, outer-inner)
+			dstA := float64(p[3]) / 255 * outer
+			a := srcA + dstA*(1-srcA)
+			if a > 0 {
+				for j, v := range []uint8{c.R, c.G, c.B} {
+					p[j] = clampUint8((float64(v)*srcA + float64(p[j])*dstA*(1-srcA)) / a)
+				}
+			}
+			p[3] = clampUint8(a * 255)
+		}
+	}
+	return dst
+}
+
+// ellipseCoverage returns how much of the pixel centered at x, y is inside
+// the ellipse inscribed in a w by h rectangle, from 0 to 1.  It approximates
+// the distance to the ellipse to smooth its edge over one pixel.
+func ellipseCoverage(x, y, w, h float64) float64 {
+	a, b := w/2, h/2
+	dx, dy := x-a, y-b
+	f := dx*dx/(a*a) + dy*dy/(b*b) - 1
+	grad := 2 * math.Hypot(dx/(a*a), dy/(b*b))
+	if grad == 0 {
+		return 1
+	}
+	return math.Max(0, math.Min(1, 0.5-f/grad))
+}
+
+// roundedRectCoverage returns how much of the pixel centered at x, y is
+// inside a w by h rectangle with corners rounded by radius, from 0 to 1.
+func roundedRectCoverage(x, y, w, h, radius float64) float64 {
+	// signed distance from the edge, negative inside
+	qx := math.Abs(x-w/2) - (w/2 - radius)
+	qy := math.Abs(y-h/2) - (h/2 - radius)
+	d := math.Hypot(math.Max(qx, 0), math.Max(qy, 0)) + math.Min(math.Max(qx, qy), 0) - radius
+	return math.Max(0, math.Min(1, 0.5-d))
+}
+
+// backgroundColor returns the color of the background bg, which is white if
+// bg is not a color.
+func backgroundColor(bg string) color.NRGBA {
+	if c, ok := parseHexColor(bg); ok {
+		return c
+	}
+	return color.NRGBA{0xff, 0xff, 0xff, 0xff}
+}
+
+// parseHexColor returns the color of s, which is 8 hexadecimal digits in RGBA
+// order.
+func parseHexColor(s string) (color.NRGBA, bool) {
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil || len(s) != 8 {
+		return color.NRGBA{}, false
+	}
+	return color.NRGBA{uint8(v >> 24), uint8(v >> 16), uint8(v >> 8), uint8(v)}, true
 }
 
 // read EXIF orientation tag from r and adjust opt to orient image correctly.
@@ -262,6 +1471,15 @@ func transformImage(m image.Image, opt Options) image.Image {
 	// size of the original image.
 	rect := cropParams(m, opt)
 	w, h, resize := resizeParams(m, opt)
+	fx, fy := focalPoint(m, rect, opt)
+
+	// padded images are the requested size even if the image is smaller
+	var padW, padH int
+	if opt.FitMode == fitFill {
+		padW, padH = requestedSize(opt, m.Bounds().Dx(), m.Bounds().Dy())
+		padW, padH = limitSize(m, opt, padW, padH)
+		padW, padH = capSize(opt, padW, padH)
+	}
 
 	// crop if needed
 	if !m.Bounds().Eq(rect) {
@@ -269,26 +1487,97 @@ func transformImage(m image.Image, opt Options) image.Image {
 	}
 	// resize if needed
 	if resize {
-		if opt.Fit {
-			m = imaging.Fit(m, w, h, resampleFilter)
-		} else {
-			if w == 0 || h == 0 {
-				m = imaging.Resize(m, w, h, resampleFilter)
-			} else {
-				m = imaging.Thumbnail(m, w, h, resampleFilter)
-			}
+		filter := resizeFilter(opt)
+
+		switch {
+		case w == 0 || h == 0:
+			m = imaging.Resize(m, w, h, filter)
+		case opt.FitMode == fitClip || opt.FitMode == fitMax || opt.FitMode == fitFill:
+			w, h = fitSize(m, w, h)
+			m = imaging.Resize(m, w, h, filter)
+		case opt.FitMode == fitScale:
+			m = imaging.Resize(m, w, h, filter)
+		case opt.CropMode == cropEntropy:
+			m = imaging.Crop(m, entropyCropRect(m, w, h))
+			m = imaging.Resize(m, w, h, filter)
+		case opt.CropMode != "" || opt.Focal || opt.FocalZoom > 1:
+			m = imaging.Crop(m, focalCropRect(m, w, h, fx, fy, opt.FocalZoom, opt.scaleUp()))
+			m = imaging.Resize(m, w, h, filter)
+		default:
+			m = imaging.Thumbnail(m, w, h, filter)
 		}
 	}
 
+	// adjust colors
+	if opt.Exposure != 0 {
+		m = adjustExposure(m, opt.Exposure)
+	}
+	if opt.Brightness != 0 {
+		m = imaging.AdjustBrightness(m, opt.Brightness)
+	}
+	if opt.Contrast != 0 {
+		m = imaging.AdjustContrast(m, opt.Contrast)
+	}
+	if opt.Gamma > 0 && opt.Gamma != 1 {
+		m = imaging.AdjustGamma(m, opt.Gamma)
+	}
+	if opt.Saturation != 0 {
+		m = adjustSaturation(m, opt.Saturation)
+	}
+	if opt.Hue != 0 {
+		m = adjustHue(m, opt.Hue)
+	}
+
+	// effects
+	if opt.Mono == monoGray {
+		m = imaging.Grayscale(m)
+	} else if tint, ok := parseHexColor(opt.Mono); ok {
+		m = duotone(m, color.NRGBA{0, 0, 0, tint.A}, tint)
+	}
+	if opt.Sepia > 0 {
+		m = sepia(m, opt.Sepia)
+	}
+	shadow, ok1 := parseHexColor(opt.DuotoneShadow)
+	highlight, ok2 := parseHexColor(opt.DuotoneHighlight)
+	if ok1 && ok2 {
+		m = duotone(m, shadow, highlight)
+	}
+	if opt.Invert {
+		m = imaging.Invert(m)
+	}
+	if opt.Pixelate > 1 {
+		m = pixelate(m, opt.Pixelate)
+	}
+
+	// blur and sharpen
+	if opt.Blur > 0 {
+		m = imaging.Blur(m, opt.Blur)
+	}
+	if opt.Sharpen > 0 {
+		m = unsharpMask(m, opt.Sharpen, 1, 0)
+	}
+	if opt.UnsharpAmount > 0 {
+		m = unsharpMask(m, opt.UnsharpAmount, opt.UnsharpRadius, opt.UnsharpThreshold)
+	}
+
+	// pad if needed
+	if padW > 0 && padH > 0 && !m.Bounds().Size().Eq(image.Pt(padW, padH)) {
+		m = pad(m, padW, padH, opt.Background)
+	}
+
 	// rotate
-	rotate := float64(opt.Rotate) - math.Floor(float64(opt.Rotate)/360)*360
+	rotate := opt.Rotate - math.Floor(opt.Rotate/360)*360
 	switch rotate {
+	case 0:
 	case 90:
 		m = imaging.Rotate90(m)
 	case 180:
 		m = imaging.Rotate180(m)
 	case 270:
 		m = imaging.Rotate270(m)
+	default:
+		bg, _ := parseHexColor(opt.Background)
+		m = imaging.Rotate(m, rotate, bg)
 	}
 
 	// flip
@@ -10,10 +10,14 @@ import (
 	"image/jpeg"
 	"image/png"
 	"io"
+	"net/http"
+	"net/url"
 	"reflect"
 	"testing"
 
 	"github.com/disintegration/imaging"
+
+	libjpeg "github.com/richiefi/imageproxy/third_party/jpeg"
 )
 
 var (
@@ -21,6 +25,7 @@ var (
 	green  = color.NRGBA{0, 255, 0, 255}
 	blue   = color.NRGBA{0, 0, 255, 255}
 	yellow = color.NRGBA{255, 255, 0, 255}
+	white  = color.NRGBA{255, 255, 255, 255}
 )
 
 // newImage creates a new NRGBA image with the specified dimensions and pixel
@@ -52,6 +57,40 @@ func TestResizeParams(t *testing.T) {
 		{Options{Width: 100, Height: 200, ScaleUp: true}, 100, 200, true},
 		{Options{Width: 64}, 0, 0, false},
 		{Options{Height: 128}, 0, 0, false},
+
+		// aspect ratios
+		{Options{Width: 32, AspectRatio: 2}, 32, 16, true},
+		{Options{Height: 64, AspectRatio: 0.5}, 32, 64, true},
+		{Options{Width: 32, Height: 32, AspectRatio: 2}, 32, 32, true},
+		{Options{AspectRatio: 1}, 64, 64, true},
+		{Options{AspectRatio: 0.25}, 32, 128, true},
+		{Options{AspectRatio: 0.5}, 0, 0, false},
+		{Options{Width: 64, AspectRatio: 0.25}, 32, 128, true},
+		{Options{Width: 64, AspectRatio: 0.25, ScaleUp: true}, 64, 256, true},
+
+		// size limits
+		{Options{Width: 0.5, MaxWidth: 16}, 16, 0, true},
+		{Options{Height: 100, MaxWidth: 16}, 0, 32, true},
+		{Options{Width: 32, Height: 32, MinHeight: 48}, 48, 48, true},
+		{Options{MinWidth: 128}, 0, 0, false},
+		{Options{Width: 16, MinWidth: 32}, 32, 0, true},
+		{Options{Width: 32, MinWidth: 128}, 0, 0, false},
+		{Options{MinWidth: 128, ScaleUp: true}, 128, 0, true},
+		{Options{MinWidth: 128, MaxHeight: 128}, 0, 0, false},
+		{Options{MaxHeight: 64}, 32, 0, true},
+		{Options{CropWidth: 32, CropHeight: 32, MaxHeight: 16}, 16, 0, true},
+		{Options{MaxHeight: 64, Rotate: 90}, 0, 0, false},
+		{Options{MaxWidth: 64, Rotate: 90}, 32, 0, true},
+		{Options{MaxWidth: 74, BorderWidth: 5, BorderOutside: true}, 0, 0, false},
+		{Options{MaxWidth: 42, BorderWidth: 5, BorderOutside: true}, 32, 0, true},
+		{Options{MaxWidth: 42, BorderWidth: 5}, 42, 0, true},
+
+		// hard size limit
+		{Options{MinWidth: 200000, ScaleUp: true}, 16384, 0, true},
+		{Options{Width: 200000, Height: 100000, ScaleUp: true}, 16384, 8192, true},
+		{Options{Width: 200000, Height: 100000, ScaleUp: true, BorderWidth: 8, BorderOutside: true}, 16368, 8184, true},
+		{Options{Width: 16384, Height: 16384, ScaleUp: true, Rotate: 45}, 11585, 11585, true},
+		{Options{Width: 16384, Height: 8192, ScaleUp: true, Rotate: 90}, 16384, 8192, true},
 	}
 	for _, tt := range tests {
 		w, h, resize := resizeParams(src, tt.opt)
@@ -61,6 +100,474 @@ func TestResizeParams(t *testing.T) {
 	}
 }
 
+func TestTransform_SizeLimits(t *testing.T) {
+	buf := new(bytes.Buffer)
+	png.Encode(buf, newImage(64, 128, red))
+
+	tests := []struct {
+		opt  Options
+		size image.Point
+	}{
+		{Options{MaxWidth: 50, Rotate: 90}, image.Pt(50, 25)},
+		{Options{MaxHeight: 100, BorderWidth: 10, BorderOutside: true}, image.Pt(60, 100)},
+		{Options{MaxWidth: 50, Rotate: 45}, image.Pt(50, 50)},
+		{Options{MaxWidth: 50, MaxHeight: 50, Rotate: 30, BorderWidth: 4, BorderOutside: true}, image.Pt(43, 50)},
+	}
+	for _, tt := range tests {
+		out, err := Transform(buf.Bytes(), tt.opt)
+		if err != nil {
+			t.Fatalf("Transform(%v) returned error: %v", tt.opt, err)
+		}
+		m, _, err := image.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("error decoding transformed image: %v", err)
+		}
+		if got := m.Bounds().Size(); got != tt.size {
+			t.Errorf("Transform(%v) returned size %v, want %v", tt.opt, got, tt.size)
+		}
+	}
+}
+
+func TestApplyDPR(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 64, 128))
+	tests := []struct {
+		opt  Options
+		want Options
+		dpr  float64
+	}{
+		{emptyOptions, emptyOptions, 0},
+		{Options{Width: 16}, Options{Width: 16}, 0},
+		{Options{Width: 16, DPR: 2}, Options{Width: 32}, 2},
+		{Options{Width: 16, Height: 16, DPR: 1.5}, Options{Width: 24, Height: 24}, 1.5},
+		{Options{Width: 0.5, DPR: 2}, Options{Width: 0.5}, 2},
+
+		// source too small for the full ratio
+		{Options{Width: 16, Height: 16, DPR: 5}, Options{Width: 64, Height: 64}, 4},
+		{Options{Width: 16, Height: 16, DPR: 5, ScaleUp: true}, Options{Width: 80, Height: 80, ScaleUp: true}, 5},
+		{Options{Width: 128, DPR: 2}, Options{Width: 64}, 0.5},
+
+		// crop values in pixels
+		{Options{CropX: 8, CropY: 0.5, CropWidth: 16, CropHeight: 16, DPR: 2}, Options{CropX: 16, CropY: 0.5, CropWidth: 32, CropHeight: 32}, 2},
+		{Options{CropX: -8, CropWidth: 8, Width: 8, DPR: 2}, Options{CropX: -16, CropWidth: 16, Width: 16}, 2},
+		{Options{CropWidth: 16, Width: 16, DPR: 3}, Options{CropWidth: 48, Width: 48}, 3},
+		{Options{CropX: 8, CropWidth: 16, Width: 16, DPR: 3}, Options{CropX: 24, CropWidth: 48, Width: 40}, 2.5},
+
+		// dimensions derived from the aspect ratio
+		{Options{Width: 16, AspectRatio: 0.25, DPR: 3}, Options{Width: 32, AspectRatio: 0.25}, 2},
+		{Options{Height: 16, AspectRatio: 2, DPR: 5}, Options{Height: 32, AspectRatio: 2}, 2},
+	}
+	for _, tt := range tests {
+		got, dpr := applyDPR(src, tt.opt)
+		if got != tt.want || dpr != tt.dpr {
+			t.Errorf("applyDPR(%v) returned (%v, %v), want (%v, %v)", tt.opt, got, dpr, tt.want, tt.dpr)
+		}
+	}
+}
+
+func TestFocalCropRect(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 200, 100))
+	tests := []struct {
+		w, h           int
+		fx, fy, zoom   float64
+		scaleUp        bool
+		x0, y0, x1, y1 int
+	}{
+		// centered
+		{50, 50, 100, 50, 0, false, 50, 0, 150, 100},
+		{100, 25, 100, 50, 0, false, 0, 25, 200, 75},
+
+		// off center, limited by the image edges
+		{50, 50, 150, 50, 0, false, 100, 0, 200, 100},
+		{50, 50, 190, 50, 0, false, 100, 0, 200, 100},
+		{50, 50, 10, 50, 0, false, 0, 0, 100, 100},
+
+		// zoom
+		{50, 50, 150, 50, 2, false, 125, 25, 175, 75},
+		{50, 50, 150, 50, 4, false, 125, 25, 175, 75},
+		{50, 50, 150, 50, 4, true, 138, 38, 163, 63},
+		{25, 25, 150, 50, 2, false, 125, 25, 175, 75},
+		{25, 25, 150, 50, 8, false, 138, 38, 163, 63},
+		{25, 25, 150, 50, 8, true, 144, 44, 156, 56},
+	}
+	for _, tt := range tests {
+		want := image.Rect(tt.x0, tt.y0, tt.x1, tt.y1)
+		got := focalCropRect(src, tt.w, tt.h, tt.fx, tt.fy, tt.zoom, tt.scaleUp)
+		if !got.Eq(want) {
+			t.Errorf("focalCropRect(%d, %d, %v, %v, %v, %v) returned %v, want %v", tt.w, tt.h, tt.fx, tt.fy, tt.zoom, tt.scaleUp, got, want)
+		}
+	}
+}
+
+func TestTransformImage_FitModes(t *testing.T) {
+	src := newImage(40, 20, red)
+	tests := []struct {
+		opt  Options
+		w, h int
+	}{
+		{Options{Width: 20, Height: 20, FitMode: "clip"}, 20, 10},
+		{Options{Width: 80, Height: 80, FitMode: "clip"}, 40, 20},
+		{Options{Width: 80, Height: 80, FitMode: "clip", ScaleUp: true}, 80, 40},
+		{Options{Width: 20, Height: 20, FitMode: "crop"}, 20, 20},
+		{Options{Width: 80, Height: 80, FitMode: "crop"}, 40, 20},
+		{Options{Width: 80, Height: 80, FitMode: "crop", ScaleUp: true}, 80, 80},
+		{Options{Width: 20, Height: 40, FitMode: "scale"}, 20, 20},
+		{Options{Width: 20, Height: 40, FitMode: "scale", ScaleUp: true}, 20, 40},
+		{Options{Width: 20, Height: 20, FitMode: "max"}, 20, 10},
+		{Options{Width: 80, Height: 80, FitMode: "max", ScaleUp: true}, 40, 20},
+		{Options{Width: 20, Height: 20, FitMode: "min"}, 20, 20},
+		{Options{Width: 80, Height: 80, FitMode: "min"}, 20, 20},
+		{Options{Width: 80, Height: 80, FitMode: "min", ScaleUp: true}, 20, 20},
+		{Options{Width: 20, Height: 20, FitMode: "fill"}, 20, 20},
+		{Options{Width: 80, Height: 80, FitMode: "fill"}, 80, 80},
+		{Options{Width: 80, Height: 80, FitMode: "fill", ScaleUp: true}, 80, 80},
+		{Options{Width: 80, FitMode: "clip", ScaleUp: true}, 80, 40},
+		{Options{Width: 20, AspectRatio: 1}, 20, 20},
+		{Options{Height: 10, AspectRatio: 1}, 10, 10},
+		{Options{AspectRatio: 1}, 20, 20},
+		{Options{Width: 20, AspectRatio: 1, FitMode: "clip"}, 20, 10},
+		{Options{Width: 20, AspectRatio: 1, FitMode: "fill"}, 20, 20},
+		{Options{Width: 80, AspectRatio: 1, FitMode: "fill"}, 80, 80},
+	}
+
+	for _, tt := range tests {
+		b := transformImage(src, tt.opt).Bounds()
+		if b.Dx() != tt.w || b.Dy() != tt.h {
+			t.Errorf("transformImage(%v) returned %vx%v image, want %vx%v", tt.opt, b.Dx(), b.Dy(), tt.w, tt.h)
+		}
+	}
+
+	// fill scales the image up inside the canvas only if allowed
+	for _, tt := range []struct {
+		scaleUp bool
+		want    color.Color
+	}{
+		{false, white},
+		{true, red},
+	} {
+		m := transformImage(src, Options{Width: 80, Height: 80, FitMode: "fill", ScaleUp: tt.scaleUp})
+		if got := m.At(0, 30); got != tt.want {
+			t.Errorf("fill with ScaleUp %v returned %v at (0, 30), want %v", tt.scaleUp, got, tt.want)
+		}
+	}
+
+	// the canvas is limited to the largest size images are resized to
+	m := transformImage(src, Options{Width: 200000, Height: 5, FitMode: "fill"})
+	if got, want := m.Bounds().Size(), image.Pt(16384, 1); got != want {
+		t.Errorf("fill to 200000x5 returned size %v, want %v", got, want)
+	}
+}
+
+func TestTransformImage_FocalPointQuery(t *testing.T) {
+	src := newImage(4, 2, red, red, blue, blue, red, red, blue, blue)
+
+	// a focal point crops around it rather than fitting the image
+	for _, tt := range []struct {
+		query string
+		want  image.Image
+	}{
+		{"size=2", newImage(2, 1, red, blue)},
+		{"size=2&fp-x=0&fp-y=0", newImage(2, 2, red, red, red, red)},
+		{"size=2&fp-x=1", newImage(2, 2, blue, blue, blue, blue)},
+	} {
+		form, _ := url.ParseQuery(tt.query)
+		got := transformImage(src, ParseFormValues(form, emptyOptions))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("transformImage(%q) returned %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestTransformImage_ArbitraryRotation(t *testing.T) {
+	src := newImage(40, 20, red)
+	tests := []struct {
+		opt    Options
+		corner color.Color
+	}{
+		{Options{Rotate: 45}, color.NRGBA{}},
+		{Options{Rotate: -315, Background: "0000ffff"}, blue},
+		{Options{Rotate: 30.5, Background: "00ff0080"}, color.NRGBA{0, 255, 0, 128}},
+	}
+
+	for _, tt := range tests {
+		m := transformImage(src, tt.opt)
+		b := m.Bounds()
+		if b.Dx() <= 40 || b.Dy() <= 20 {
+			t.Errorf("transformImage(%v) returned %v, want the canvas expanded", tt.opt, b)
+		}
+		if got := m.At(b.Min.X, b.Min.Y); got != tt.corner {
+			t.Errorf("transformImage(%v) returned corner %v, want %v", tt.opt, got, tt.corner)
+		}
+		if got := m.At(b.Dx()/2, b.Dy()/2); got != red {
+			t.Errorf("transformImage(%v) returned center %v, want %v", tt.opt, got, red)
+		}
+	}
+}
+
+func TestTransform_RotationBackground(t *testing.T) {
+	buf := new(bytes.Buffer)
+	png.Encode(buf, newImage(40, 20, red))
+
+	tests := []struct {
+		opt    Options
+		opaque bool
+	}{
+		{Options{Rotate: 45}, false},
+		{Options{Rotate: 45, Format: "jpeg"}, true},
+	}
+
+	for _, tt := range tests {
+		out, err := Transform(buf.Bytes(), tt.opt)
+		if err != nil {
+			t.Fatalf("Transform(%v) returned error: %v", tt.opt, err)
+		}
+		m, _, err := image.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("error decoding transformed image: %v", err)
+		}
+		if _, _, _, a := m.At(0, 0).RGBA(); (a == 0xffff) != tt.opaque {
+			t.Errorf("Transform(%v) returned corner %v, want opaque %v", tt.opt, m.At(0, 0), tt.opaque)
+		}
+	}
+
+	// jpeg sources keep transparent backgrounds as png
+	buf.Reset()
+	jpeg.Encode(buf, newImage(40, 20, red), nil)
+	for _, tt := range []struct {
+		opt    Options
+		format string
+	}{
+		{Options{Rotate: 45}, "jpeg"},
+		{Options{Rotate: 45, Background: "00000000"}, "png"},
+		{Options{Width: 40, Height: 40, FitMode: "fill", Background: "ffffff80"}, "png"},
+		{Options{Width: 40, Height: 40, FitMode: "fill", Background: "ffffffff"}, "jpeg"},
+	} {
+		out, err := Transform(buf.Bytes(), tt.opt)
+		if err != nil {
+			t.Fatalf("Transform(%v) returned error: %v", tt.opt, err)
+		}
+		m, format, err := image.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("error decoding transformed image: %v", err)
+		}
+		if format != tt.format {
+			t.Errorf("Transform(%v) of a jpeg returned format %v, want %v", tt.opt, format, tt.format)
+		}
+		if _, _, _, a := m.At(0, 0).RGBA(); (a == 0xffff) != (tt.format == "jpeg") {
+			t.Errorf("Transform(%v) of a jpeg returned corner %v", tt.opt, m.At(0, 0))
+		}
+	}
+}
+
+func TestApplyMask(t *testing.T) {
+	transparent := color.NRGBA{255, 0, 0, 0}
+	src := newImage(20, 10, red)
+
+	tests := []struct {
+		opt  Options
+		mask image.Image
+		bg   string
+		x, y int
+		want color.NRGBA
+	}{
+		{Options{Mask: "ellipse"}, nil, "", 0, 0, transparent},
+		{Options{Mask: "ellipse"}, nil, "", 10, 5, red},
+		{Options{Mask: "ellipse"}, nil, "", 1, 5, red},
+		{Options{Mask: "ellipse"}, nil, "", 10, 0, red},
+		{Options{CornerRadius: 4}, nil, "", 0, 0, transparent},
+		{Options{CornerRadius: 4}, nil, "", 4, 0, red},
+		{Options{CornerRadius: 0.4}, nil, "", 19, 9, transparent},
+		{Options{CornerRadius: 0.4}, nil, "", 10, 9, red},
+		{Options{Mask: "ellipse"}, nil, "0000ffff", 0, 0, blue},
+		{Options{Mask: "ellipse"}, nil, "0000ffff", 10, 5, red},
+
+		// transparent and opaque mask images
+		{Options{Mask: "http://example.com/mask.png"}, newImage(2, 2, color.NRGBA{0, 0, 0, 0}), "", 5, 5, transparent},
+		{Options{Mask: "http://example.com/mask.png"}, newImage(2, 2, color.NRGBA{0, 0, 0, 255}), "", 5, 5, transparent},
+		{Options{Mask: "http://example.com/mask.png"}, newImage(2, 2, white), "", 5, 5, red},
+	}
+
+	for _, tt := range tests {
+		got := applyMask(src, tt.mask, tt.opt, tt.bg).(*image.NRGBA)
+		if c := got.NRGBAAt(tt.x, tt.y); c.A != tt.want.A || (c.A != 0 && c != tt.want) {
+			t.Errorf("applyMask(%v, bg %q) returned %v at %v,%v, want %v", tt.opt, tt.bg, c, tt.x, tt.y, tt.want)
+		}
+	}
+
+	if got := applyMask(src, nil, emptyOptions, ""); got != src {
+		t.Errorf("applyMask without mask changed the image")
+	}
+}
+
+func TestDrawBorder(t *testing.T) {
+	transparent := color.NRGBA{0, 0, 0, 0}
+	src := newImage(10, 8, red)
+
+	tests := []struct {
+		opt  Options
+		w, h int
+		x, y int
+		want color.NRGBA
+	}{
+		{Options{BorderWidth: 2, BorderColor: "0000ffff"}, 10, 8, 0, 0, blue},
+		{Options{BorderWidth: 2, BorderColor: "0000ffff"}, 10, 8, 1, 4, blue},
+		{Options{BorderWidth: 2, BorderColor: "0000ffff"}, 10, 8, 2, 4, red},
+		{Options{BorderWidth: 2, BorderColor: "0000ffff", BorderOutside: true}, 14, 12, 1, 1, blue},
+		{Options{BorderWidth: 2, BorderColor: "0000ffff", BorderOutside: true}, 14, 12, 2, 2, red},
+		{Options{BorderWidth: 2, BorderColor: "0000ffff", BorderOutside: true}, 14, 12, 11, 9, red},
+		{Options{BorderWidth: 2, BorderColor: "0000ff80"}, 10, 8, 0, 4, color.NRGBA{127, 0, 128, 255}},
+		{Options{BorderWidth: 2, BorderColor: "0000ff80", BorderOutside: true}, 14, 12, 0, 4, color.NRGBA{0, 0, 255, 128}},
+		{Options{BorderWidth: 2, BorderColor: "0000ffff", BorderRadius: 4}, 10, 8, 0, 0, transparent},
+		{Options{BorderWidth: 2, BorderColor: "0000ffff", BorderRadius: 4}, 10, 8, 4, 0, blue},
+		{Options{BorderWidth: 2, BorderColor: "0000ffff", BorderRadius: 4}, 10, 8, 1, 2, blue},
+	}
+
+	for _, tt := range tests {
+		got := drawBorder(src, tt.opt).(*image.NRGBA)
+		if b := got.Bounds(); b.Dx() != tt.w || b.Dy() != tt.h {
+			t.Errorf("drawBorder(%v) returned size %vx%v, want %vx%v", tt.opt, b.Dx(), b.Dy(), tt.w, tt.h)
+		}
+		if c := got.NRGBAAt(tt.x, tt.y); c.A != tt.want.A || (c.A != 0 && c != tt.want) {
+			t.Errorf("drawBorder(%v) returned %v at %v,%v, want %v", tt.opt, c, tt.x, tt.y, tt.want)
+		}
+	}
+
+	if got := drawBorder(src, emptyOptions); got != src {
+		t.Errorf("drawBorder without border changed the image")
+	}
+}
+
+func TestTransform_MaskFormat(t *testing.T) {
+	buf := new(bytes.Buffer)
+	jpeg.Encode(buf, newImage(20, 20, red), nil)
+
+	tests := []struct {
+		opt    Options
+		format string
+		opaque bool
+	}{
+		{Options{Mask: "ellipse"}, "png", false},
+		{Options{CornerRadius: 5, Format: "jpeg"}, "png", false},
+		{Options{CornerRadius: 5, Format: "jpeg", Background: "0000ffff"}, "jpeg", true},
+		{Options{CornerRadius: 5, Format: "jpeg", Background: "0000ff80"}, "png", false},
+		{Options{CornerRadius: 5, Format: "webp"}, "webp", false},
+		{Options{BorderWidth: 2, BorderRadius: 5}, "png", false},
+		{Options{BorderWidth: 2}, "jpeg", true},
+	}
+
+	for _, tt := range tests {
+		out, err := Transform(buf.Bytes(), tt.opt)
+		if err != nil {
+			t.Fatalf("Transform(%v) returned error: %v", tt.opt, err)
+		}
+		m, format, err := image.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("error decoding transformed image: %v", err)
+		}
+		if format != tt.format {
+			t.Errorf("Transform(%v) returned format %v, want %v", tt.opt, format, tt.format)
+		}
+		if _, _, _, a := m.At(0, 0).RGBA(); (a == 0xffff) != tt.opaque {
+			t.Errorf("Transform(%v) returned corner %v, want opaque %v", tt.opt, m.At(0, 0), tt.opaque)
+		}
+	}
+}
+
+func TestPad(t *testing.T) {
+	src := newImage(2, 2, red)
+
+	got := pad(src, 8, 4, "00ff0080")
+	if c := got.NRGBAAt(0, 0); c != (color.NRGBA{0, 255, 0, 128}) {
+		t.Errorf("pad with color returned background %v", c)
+	}
+	if c := got.NRGBAAt(4, 2); c != red {
+		t.Errorf("pad with color returned center %v, want %v", c, red)
+	}
+
+	// blurring an image of a single color does not change it
+	got = pad(src, 8, 4, "blur")
+	if want := newImage(8, 4, red); !reflect.DeepEqual(got, want) {
+		t.Errorf("pad with blur returned %v, want %v", got, want)
+	}
+}
+
+func TestDrawMark(t *testing.T) {
+	src := newImage(8, 4, red)
+	mark := newImage(2, 2, blue)
+
+	tests := []struct {
+		opt  Mark
+		x, y int // top left corner of the watermark
+		want color.NRGBA
+	}{
+		{Mark{}, 6, 2, blue},
+		{Mark{Pos: "top-left"}, 0, 0, blue},
+		{Mark{Pos: "center"}, 3, 1, blue},
+		{Mark{Pos: "top", Pad: 1}, 3, 1, blue},
+		{Mark{Pos: "bottom-right", Pad: 0.25}, 5, 1, blue},
+		{Mark{Pos: "top-left", Alpha: 50}, 0, 0, color.NRGBA{127, 0, 127, 255}},
+	}
+
+	for _, tt := range tests {
+		got := drawMark(src, mark, tt.opt).(*image.NRGBA)
+		if c := got.NRGBAAt(tt.x, tt.y); c != tt.want {
+			t.Errorf("drawMark(%#v) returned %v at watermark corner %v,%v, want %v", tt.opt, c, tt.x, tt.y, tt.want)
+		}
+		if c := got.NRGBAAt(tt.x+2, tt.y+2); tt.x+2 < 8 && tt.y+2 < 4 && c != red {
+			t.Errorf("drawMark(%#v) returned %v outside the watermark, want %v", tt.opt, c, red)
+		}
+	}
+
+	// watermarks are scaled relative to the output width
+	got := drawMark(src, mark, Mark{Pos: "top-left", Scale: 0.5}).(*image.NRGBA)
+	if c := got.NRGBAAt(3, 3); c != blue {
+		t.Errorf("drawMark with scale returned %v, want %v", c, blue)
+	}
+
+	if got := drawMark(src, nil, Mark{}); got != src {
+		t.Errorf("drawMark without watermark changed the image")
+	}
+}
+
+func TestTrimRect(t *testing.T) {
+	transparent := color.NRGBA{0, 0, 0, 0}
+	nearWhite := color.NRGBA{250, 250, 250, 255}
+
+	// a 4 by 3 image with a border around a red center pixel
+	framed := func(border color.NRGBA) image.Image {
+		m := newImage(4, 3, border).(*image.NRGBA)
+		m.SetNRGBA(1, 1, red)
+		m.SetNRGBA(2, 1, blue)
+		return m
+	}
+
+	tests := []struct {
+		src            image.Image
+		opt            Options
+		x0, y0, x1, y1 int
+	}{
+		{framed(white), emptyOptions, 0, 0, 4, 3},
+		{framed(white), Options{Trim: "auto"}, 1, 1, 3, 2},
+		{framed(white), Options{Trim: "ffffffff"}, 1, 1, 3, 2},
+		{framed(white), Options{Trim: "000000ff"}, 0, 0, 4, 3},
+		{framed(transparent), Options{Trim: "auto"}, 1, 1, 3, 2},
+		{framed(transparent), Options{Trim: "ffffff00"}, 1, 1, 3, 2},
+		{newImage(2, 2, white, nearWhite, red, white), Options{Trim: "auto"}, 0, 0, 2, 2},
+		{newImage(2, 2, white, nearWhite, red, white), Options{Trim: "auto", TrimTolerance: 5}, 0, 1, 1, 2},
+		{newImage(2, 2, white), Options{Trim: "auto"}, 0, 0, 2, 2},
+	}
+	for _, tt := range tests {
+		want := image.Rect(tt.x0, tt.y0, tt.x1, tt.y1)
+		if got := trimRect(tt.src, tt.opt); !got.Eq(want) {
+			t.Errorf("trimRect(%v) returned %v, want %v", tt.opt, got, want)
+		}
+	}
+
+	// crops apply to the trimmed part of the image
+	if got, want := cropParams(framed(white), Options{Trim: "auto", CropX: 1}), image.Rect(2, 1, 3, 2); !got.Eq(want) {
+		t.Errorf("cropParams with trim returned %v, want %v", got, want)
+	}
+}
+
 func TestCropParams(t *testing.T) {
 	src := image.NewNRGBA(image.Rect(0, 0, 64, 128))
 	tests := []struct {
@@ -150,6 +657,346 @@ func TestTransform(t *testing.T) {
 	}
 }
 
+func TestTransform_WebP(t *testing.T) {
+	src := newImage(2, 2, red, green, blue, yellow)
+
+	buf := new(bytes.Buffer)
+	png.Encode(buf, src)
+
+	for _, opt := range []Options{
+		{Format: "webp"},
+		{Format: "webp", Quality: 50},
+		{Format: "webp", Lossless: true},
+	} {
+		out, err := Transform(buf.Bytes(), opt)
+		if err != nil {
+			t.Errorf("Transform(%v) returned error: %v", opt, err)
+			continue
+		}
+		m, format, err := image.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Errorf("error decoding transformed image: %v", err)
+			continue
+		}
+		if format != "webp" {
+			t.Errorf("Transform(%v) returned %s image, want webp", opt, format)
+		}
+		if opt.Lossless {
+			got := newImage(2, 2, m.At(0, 0), m.At(1, 0), m.At(0, 1), m.At(1, 1))
+			if !reflect.DeepEqual(got, src) {
+				t.Errorf("Transform(%v) returned image %#v, want %#v", opt, got, src)
+			}
+		}
+	}
+}
+
+func TestEncodeWithin(t *testing.T) {
+	// a noisy image that does not compress well
+	src := image.NewNRGBA(image.Rect(0, 0, 128, 128))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i * i * 7919 >> 3)
+	}
+
+	for name, encode := range map[string]func(image.Image, int) ([]byte, error){"jpeg": jpegEncoder(emptyOptions), "webp": encodeWebP} {
+		full, err := encode(src, 95)
+		if err != nil {
+			t.Fatalf("%s encoder returned error: %v", name, err)
+		}
+
+		for _, tt := range []struct {
+			maxBytes int
+			quality  int // expected quality, 0 for any lower than 95
+			shrunk   bool
+		}{
+			{len(full), 95, false},
+			{len(full) / 2, 0, false},
+			{1500, 0, true},
+		} {
+			b, q, err := encodeWithin(src, 95, tt.maxBytes, resampleFilter, encode)
+			if err != nil {
+				t.Errorf("encodeWithin(%d, %s) returned error: %v", tt.maxBytes, name, err)
+				continue
+			}
+			if len(b) > tt.maxBytes {
+				t.Errorf("encodeWithin(%d, %s) returned %d bytes", tt.maxBytes, name, len(b))
+			}
+			if tt.quality != 0 && q != tt.quality || tt.quality == 0 && (q >= 95 || q < minBudgetQuality) {
+				t.Errorf("encodeWithin(%d, %s) used quality %d, want %d", tt.maxBytes, name, q, tt.quality)
+			}
+			m, _, err := image.Decode(bytes.NewReader(b))
+			if err != nil {
+				t.Errorf("error decoding encodeWithin(%d, %s) output: %v", tt.maxBytes, name, err)
+				continue
+			}
+			if shrunk := m.Bounds().Dx() < 128; shrunk != tt.shrunk {
+				t.Errorf("encodeWithin(%d, %s) returned %v image, want shrunk %v", tt.maxBytes, name, m.Bounds(), tt.shrunk)
+			}
+		}
+	}
+
+	// images are shrunk with the given filter, which keeps the black and
+	// white pixels of a checkerboard apart for nearest neighbor
+	checkers := image.NewGray(image.Rect(0, 0, 8, 8))
+	for i := range checkers.Pix {
+		if (i%8+i/8)%2 == 0 {
+			checkers.Pix[i] = 255
+		}
+	}
+	var shrunk image.Image
+	pixels := func(m image.Image, quality int) ([]byte, error) {
+		shrunk = m
+		return make([]byte, m.Bounds().Dx()*m.Bounds().Dy()), nil
+	}
+	for _, tt := range []struct {
+		filter imaging.ResampleFilter
+		gray   bool
+	}{
+		{imaging.NearestNeighbor, false},
+		{imaging.Box, true},
+	} {
+		encodeWithin(checkers, 95, 16, tt.filter, pixels)
+		gray := false
+		for _, g := range grays(shrunk) {
+			gray = gray || g != 0 && g != 255
+		}
+		if gray != tt.gray {
+			t.Errorf("encodeWithin shrunk the checkerboard to %v, want gray %v", grays(shrunk), tt.gray)
+		}
+	}
+}
+
+func TestJPEGEncoder(t *testing.T) {
+	src := newImage(37, 21, red)
+
+	for _, tt := range []struct {
+		opt         Options
+		ratio       image.YCbCrSubsampleRatio
+		progressive bool
+	}{
+		{Options{Subsampling: "444"}, image.YCbCrSubsampleRatio444, true},
+		{Options{Subsampling: "422"}, image.YCbCrSubsampleRatio422, true},
+		{Options{Subsampling: "420", Baseline: true}, image.YCbCrSubsampleRatio420, false},
+		{Options{Baseline: true, NoOptimize: true}, image.YCbCrSubsampleRatio444, false},
+	} {
+		b, err := jpegEncoder(tt.opt)(src, 90)
+		if err != nil {
+			t.Errorf("jpegEncoder(%v) returned error: %v", tt.opt, err)
+			continue
+		}
+		m, _, err := image.Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Errorf("error decoding jpegEncoder(%v) output: %v", tt.opt, err)
+			continue
+		}
+		if got := m.(*image.YCbCr).SubsampleRatio; got != tt.ratio {
+			t.Errorf("jpegEncoder(%v) subsampled %v, want %v", tt.opt, got, tt.ratio)
+		}
+		if got := bytes.Contains(b, []byte{0xff, 0xc2}); got != tt.progressive {
+			t.Errorf("jpegEncoder(%v) returned progressive %v, want %v", tt.opt, got, tt.progressive)
+		}
+		if !m.Bounds().Eq(src.Bounds()) {
+			t.Errorf("jpegEncoder(%v) returned %v image, want %v", tt.opt, m.Bounds(), src.Bounds())
+		}
+		if c := color.NRGBAModel.Convert(m.At(36, 20)).(color.NRGBA); c.R < 240 || c.G > 15 || c.B > 15 {
+			t.Errorf("jpegEncoder(%v) returned %v at the corner, want red", tt.opt, c)
+		}
+	}
+}
+
+func TestJPEGEncoder_MozJPEG(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://localhost/http://example.com/foo.jpg?jpeg-quant=flat", nil)
+	_, err := NewRequest(req, nil)
+	if !libjpeg.ExtensionsSupported {
+		if err == nil {
+			t.Errorf("NewRequest with jpeg-quant did not return an error without mozjpeg")
+		}
+		return
+	}
+	if err != nil {
+		t.Errorf("NewRequest with jpeg-quant returned error: %v", err)
+	}
+
+	// a noisy image, which the options change the encoding of
+	src := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i * i * 7919 >> 3)
+	}
+	encode := func(opt Options) []byte {
+		b, err := jpegEncoder(opt)(src, 75)
+		if err != nil {
+			t.Fatalf("jpegEncoder(%v) returned error: %v", opt, err)
+		}
+		return b
+	}
+	def := encode(emptyOptions)
+	for _, opt := range []Options{{NoTrellis: true}, {JPEGQuant: "flat"}, {JPEGQuant: "annex-k"}} {
+		if bytes.Equal(encode(opt), def) {
+			t.Errorf("jpegEncoder(%v) returned the default encoding", opt)
+		}
+	}
+	if !bytes.Equal(encode(Options{JPEGQuant: "imagemagick"}), def) {
+		t.Errorf("jpegEncoder with the imagemagick preset differs from the default encoding")
+	}
+}
+
+func TestEncodePNG(t *testing.T) {
+	// a noisy image that has too many colors for a palette
+	noise := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for i := range noise.Pix {
+		noise.Pix[i] = uint8(i * i * 7919 >> 3)
+	}
+	flat := newImage(32, 32, red)
+
+	tests := []struct {
+		src      image.Image
+		opt      Options
+		paletted bool
+	}{
+		{flat, emptyOptions, false},
+		{flat, Options{PNGOptimize: true}, true},
+		{noise, Options{PNGOptimize: true}, false},
+		{noise, Options{Colors: 16}, true},
+		{noise, Options{Colors: 16, Dither: true, PNGLevel: "fast"}, true},
+		{noise, Options{PNGLevel: "none"}, false},
+	}
+	for _, tt := range tests {
+		b, err := encodePNG(tt.src, tt.opt)
+		if err != nil {
+			t.Errorf("encodePNG(%v) returned error: %v", tt.opt, err)
+			continue
+		}
+		m, err := png.Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Errorf("error decoding encodePNG(%v) output: %v", tt.opt, err)
+			continue
+		}
+		if _, paletted := m.(*image.Paletted); paletted != tt.paletted {
+			t.Errorf("encodePNG(%v) returned %T image, want paletted %v", tt.opt, m, tt.paletted)
+		}
+	}
+
+	fast, _ := encodePNG(noise, Options{PNGLevel: "none"})
+	best, _ := encodePNG(noise, emptyOptions)
+	if len(fast) <= len(best) {
+		t.Errorf("encodePNG without compression returned %d bytes, want more than %d", len(fast), len(best))
+	}
+}
+
+func TestTransform_AutoFormat(t *testing.T) {
+	transparent := color.NRGBA{0, 0, 0, 0}
+
+	encodeGIF := func(w io.Writer, m image.Image) error { return gif.Encode(w, m, nil) }
+	tests := []struct {
+		src        image.Image
+		encode     func(io.Writer, image.Image) error
+		acceptWebP bool
+		format     string // expected output format
+	}{
+		{newImage(2, 2, red, green, blue, yellow), png.Encode, false, "jpeg"},
+		{newImage(2, 2, red, green, blue, transparent), png.Encode, false, "png"},
+		{newImage(2, 2, red, green, blue, yellow), encodeGIF, false, "gif"},
+		{newImage(2, 2, red, green, blue, transparent), png.Encode, true, "webp"},
+		{newImage(2, 2, red, green, blue, yellow), encodeGIF, true, "gif"},
+	}
+
+	for _, tt := range tests {
+		buf := new(bytes.Buffer)
+		tt.encode(buf, tt.src)
+
+		out, err := Transform(buf.Bytes(), Options{Format: "auto", AcceptWebP: tt.acceptWebP})
+		if err != nil {
+			t.Errorf("Transform returned error: %v", err)
+			continue
+		}
+		if _, format, err := image.DecodeConfig(bytes.NewReader(out)); err != nil {
+			t.Errorf("error decoding transformed image: %v", err)
+		} else if format != tt.format {
+			t.Errorf("Transform returned %s image, want %s", format, tt.format)
+		}
+	}
+}
+
+func TestTransform_GIFFrames(t *testing.T) {
+	palette := color.Palette{color.Black, color.Gray{128}, color.White}
+	frames := []*image.Paletted{
+		image.NewPaletted(image.Rect(0, 0, 4, 1), palette),
+		image.NewPaletted(image.Rect(0, 0, 4, 1), palette),
+	}
+	copy(frames[0].Pix, []uint8{0, 0, 2, 2})
+	copy(frames[1].Pix, []uint8{2, 2, 0, 0})
+
+	buf := new(bytes.Buffer)
+	gif.EncodeAll(buf, &gif.GIF{Image: frames, Delay: []int{10, 10}})
+
+	out, err := Transform(buf.Bytes(), Options{Blur: 1})
+	if err != nil {
+		t.Fatalf("Transform returned error: %v", err)
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("error decoding transformed gif: %v", err)
+	}
+	if len(g.Image) != len(frames) {
+		t.Fatalf("transformed gif has %d frames, want %d", len(g.Image), len(frames))
+	}
+	for i, frame := range g.Image {
+		if reflect.DeepEqual(frame.Pix, frames[i].Pix) {
+			t.Errorf("frame %d was not blurred: %v", i, frame.Pix)
+		}
+	}
+
+	// effects are applied the same way to every frame
+	out, err = Transform(buf.Bytes(), Options{Invert: true})
+	if err != nil {
+		t.Fatalf("Transform returned error: %v", err)
+	}
+	g, err = gif.DecodeAll(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("error decoding transformed gif: %v", err)
+	}
+	for i, want := range [][]uint8{{2, 2, 0, 0}, {0, 0, 2, 2}} {
+		if got := g.Image[i].Pix; !reflect.DeepEqual(got, want) {
+			t.Errorf("inverted frame %d is %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestTransform_GIFTrim(t *testing.T) {
+	// white borders around content that grows in the second frame
+	palette := color.Palette{color.White, color.Black}
+	frames := []*image.Paletted{
+		image.NewPaletted(image.Rect(0, 0, 4, 3), palette),
+		image.NewPaletted(image.Rect(0, 0, 4, 3), palette),
+	}
+	frames[0].SetColorIndex(1, 1, 1)
+	frames[1].SetColorIndex(1, 1, 1)
+	frames[1].SetColorIndex(2, 1, 1)
+
+	buf := new(bytes.Buffer)
+	gif.EncodeAll(buf, &gif.GIF{Image: frames, Delay: []int{10, 10}})
+
+	// every frame is trimmed like the first
+	for _, format := range []string{"gif", "apng", "webp"} {
+		opt := Options{Trim: "auto", Format: format}
+		out, err := Transform(buf.Bytes(), opt)
+		if err != nil {
+			t.Errorf("Transform(%v) returned error: %v", opt, err)
+			continue
+		}
+		if format == "gif" {
+			g, err := gif.DecodeAll(bytes.NewReader(out))
+			if err != nil {
+				t.Fatalf("error decoding transformed gif: %v", err)
+			}
+			for i, frame := range g.Image {
+				if got, want := frame.Bounds(), image.Rect(0, 0, 1, 1); got != want {
+					t.Errorf("trimmed frame %d has bounds %v, want %v", i, got, want)
+				}
+			}
+		}
+	}
+}
+
 // Test that each of the eight EXIF orientations is applied to the transformed
 // image appropriately.
 func TestTransform_EXIF(t *testing.T) {
@@ -240,7 +1087,7 @@ func TestTransformImage(t *testing.T) {
 		{ref, emptyOptions, ref},
 
 		// rotations
-		{ref, Options{Rotate: 45}, ref}, // invalid rotation is a noop
+		{ref, Options{Rotate: 360}, ref}, // full rotation is a noop
 		{ref, Options{Rotate: 360}, ref},
 		{ref, Options{Rotate: 90}, newImage(2, 2, green, yellow, red, blue)},
 		{ref, Options{Rotate: 180}, newImage(2, 2, yellow, blue, green, red)},
@@ -318,7 +1165,7 @@ func TestTransformImage(t *testing.T) {
 		},
 		{ // resize in two dimensions, fit option prevents cropping
 			newImage(4, 2, red, red, blue, blue, red, red, blue, blue),
-			Options{Width: 2, Height: 2, Fit: true},
+			Options{Width: 2, Height: 2, FitMode: "clip"},
 			newImage(2, 1, red, blue),
 		},
 		{ // scale image explicitly
@@ -326,11 +1173,179 @@ func TestTransformImage(t *testing.T) {
 			Options{Width: 2, Height: 1},
 			newImage(2, 1, red, blue),
 		},
+		{ // resize in two dimensions, cropping around the focal point
+			newImage(4, 2, red, red, blue, blue, red, red, blue, blue),
+			Options{Width: 2, Height: 2, Focal: true, FocalX: 0.9, FocalY: 0.5},
+			newImage(2, 2, blue, blue, blue, blue),
+		},
+		{ // the top left corner is a focal point too
+			newImage(4, 2, red, red, blue, blue, red, red, blue, blue),
+			Options{Width: 2, Height: 2, Focal: true},
+			newImage(2, 2, red, red, red, red),
+		},
+		{ // zoom in on the focal point, crop first
+			cropRef,
+			Options{Width: 1, Height: 1, Focal: true, FocalX: 0.75, FocalY: 0.25, FocalZoom: 2, CropWidth: 4},
+			newImage(1, 1, green),
+		},
+		{ // trim a white border, then crop and resize the content
+			newImage(6, 4, white, white, white, white, white, white,
+				white, red, red, green, green, white,
+				white, blue, blue, yellow, yellow, white,
+				white, white, white, white, white, white),
+			Options{Trim: "auto", CropX: 0.5, Width: 2},
+			newImage(2, 2, green, green, yellow, yellow),
+		},
+		{ // resize in two dimensions, anchored to an edge
+			newImage(4, 2, red, red, blue, blue, red, red, blue, blue),
+			Options{Width: 2, Height: 2, CropMode: "left"},
+			newImage(2, 2, red, red, red, red),
+		},
+		{ // anchor overrides the focal point on its axis
+			cropRef,
+			Options{Width: 2, Height: 1, Focal: true, FocalX: 0.9, FocalY: 0.1, CropMode: "bottom"},
+			newImage(2, 1, blue, yellow),
+		},
+		{ // resize in two dimensions, keeping the detailed part
+			newImage(4, 2, red, red, blue, green, red, red, green, blue),
+			Options{Width: 2, Height: 2, CropMode: "entropy"},
+			newImage(2, 2, blue, green, green, blue),
+		},
+
+		// resampling filters
+		{ // nearest neighbor keeps pixel colors
+			newImage(4, 1, red, red, blue, blue),
+			Options{Width: 2, Filter: "nearest"},
+			newImage(2, 1, red, blue),
+		},
+		{ // linear blends neighboring pixels when scaling up
+			newImage(2, 1, red, blue),
+			Options{Width: 4, Height: 1, FitMode: "scale", Filter: "linear", ScaleUp: true},
+			newImage(4, 1, red, color.NRGBA{191, 0, 64, 255}, color.NRGBA{64, 0, 191, 255}, blue),
+		},
+
+		// color adjustments
+		{
+			newImage(2, 1, color.NRGBA{100, 100, 100, 255}, color.NRGBA{200, 200, 200, 128}),
+			Options{Brightness: 10},
+			newImage(2, 1, color.NRGBA{126, 126, 126, 255}, color.NRGBA{226, 226, 226, 128}),
+		},
+		{
+			newImage(2, 1, color.NRGBA{64, 64, 64, 255}, color.NRGBA{192, 192, 192, 255}),
+			Options{Contrast: -100},
+			newImage(2, 1, color.NRGBA{128, 128, 128, 255}, color.NRGBA{128, 128, 128, 255}),
+		},
+		{ // gamma above 1 lightens
+			newImage(1, 1, color.NRGBA{64, 64, 64, 255}),
+			Options{Gamma: 2},
+			newImage(1, 1, color.NRGBA{128, 128, 128, 255}),
+		},
+		{ // one stop doubles the linear light
+			newImage(2, 1, color.NRGBA{0, 100, 255, 255}, color.NRGBA{188, 188, 188, 255}),
+			Options{Exposure: 1},
+			newImage(2, 1, color.NRGBA{0, 138, 255, 255}, color.NRGBA{255, 255, 255, 255}),
+		},
+		{
+			newImage(1, 1, red),
+			Options{Saturation: -100},
+			newImage(1, 1, color.NRGBA{76, 76, 76, 255}),
+		},
+		{ // rotating hues keeps grays
+			newImage(2, 1, color.NRGBA{255, 0, 0, 255}, color.NRGBA{100, 100, 100, 255}),
+			Options{Hue: 180},
+			newImage(2, 1, color.NRGBA{0, 109, 109, 255}, color.NRGBA{100, 100, 100, 255}),
+		},
+
+		// effects
+		{
+			newImage(2, 1, red, color.NRGBA{100, 100, 100, 128}),
+			Options{Mono: "gray"},
+			newImage(2, 1, color.NRGBA{76, 76, 76, 255}, color.NRGBA{100, 100, 100, 128}),
+		},
+		{ // tint the grayscale image
+			newImage(2, 1, color.NRGBA{0, 0, 0, 255}, color.NRGBA{255, 255, 255, 255}),
+			Options{Mono: "ff800080"},
+			newImage(2, 1, color.NRGBA{0, 0, 0, 128}, color.NRGBA{255, 128, 0, 128}),
+		},
+		{
+			newImage(1, 1, color.NRGBA{100, 100, 100, 255}),
+			Options{Sepia: 100},
+			newImage(1, 1, color.NRGBA{135, 120, 94, 255}),
+		},
+		{ // partial sepia blends with the original
+			newImage(1, 1, color.NRGBA{100, 100, 100, 255}),
+			Options{Sepia: 50},
+			newImage(1, 1, color.NRGBA{118, 110, 97, 255}),
+		},
+		{
+			newImage(3, 1, color.NRGBA{0, 0, 0, 255}, color.NRGBA{255, 255, 255, 255}, color.NRGBA{255, 255, 255, 0}),
+			Options{DuotoneShadow: "0000ffff", DuotoneHighlight: "ffff00ff"},
+			newImage(3, 1, blue, yellow, color.NRGBA{255, 255, 0, 0}),
+		},
+		{
+			newImage(2, 1, red, color.NRGBA{0, 255, 255, 128}),
+			Options{Invert: true},
+			newImage(2, 1, color.NRGBA{0, 255, 255, 255}, color.NRGBA{255, 0, 0, 128}),
+		},
+		{ // blocks start at the top left corner
+			newImage(3, 2, red, blue, green, red, blue, green),
+			Options{Pixelate: 2},
+			newImage(3, 2, color.NRGBA{128, 0, 128, 255}, color.NRGBA{128, 0, 128, 255}, green, color.NRGBA{128, 0, 128, 255}, color.NRGBA{128, 0, 128, 255}, green),
+		},
+		{ // transparent pixels do not darken blocks
+			newImage(2, 1, red, color.NRGBA{0, 0, 0, 0}),
+			Options{Pixelate: 2},
+			newImage(2, 1, color.NRGBA{255, 0, 0, 128}, color.NRGBA{255, 0, 0, 128}),
+		},
+		{ // effects in order: mono, then invert
+			newImage(1, 1, red),
+			Options{Mono: "gray", Invert: true},
+			newImage(1, 1, color.NRGBA{179, 179, 179, 255}),
+		},
+
+		// blur and sharpen
+		{ // blurring spreads colors to neighboring pixels
+			newImage(3, 1, red, blue, red),
+			Options{Blur: 10},
+			newImage(3, 1, color.NRGBA{170, 0, 85, 255}, color.NRGBA{170, 0, 85, 255}, color.NRGBA{170, 0, 85, 255}),
+		},
+		{ // sharpening a single color does not change it
+			newImage(3, 1, red),
+			Options{Sharpen: 100},
+			newImage(3, 1, red),
+		},
+		{ // sharpening increases contrast
+			newImage(3, 1, color.NRGBA{64, 64, 64, 255}, color.NRGBA{128, 128, 128, 255}, color.NRGBA{64, 64, 64, 255}),
+			Options{UnsharpAmount: 100, UnsharpRadius: 1},
+			newImage(3, 1, color.NRGBA{42, 42, 42, 255}, color.NRGBA{163, 163, 163, 255}, color.NRGBA{42, 42, 42, 255}),
+		},
+		{ // differences below the threshold are not sharpened
+			newImage(3, 1, color.NRGBA{64, 64, 64, 255}, color.NRGBA{128, 128, 128, 255}, color.NRGBA{64, 64, 64, 255}),
+			Options{UnsharpAmount: 100, UnsharpRadius: 1, UnsharpThreshold: 100},
+			newImage(3, 1, color.NRGBA{64, 64, 64, 255}, color.NRGBA{128, 128, 128, 255}, color.NRGBA{64, 64, 64, 255}),
+		},
+
+		// padding
+		{ // pad to the requested size, larger than the image
+			newImage(4, 2, red, red, blue, blue, red, red, blue, blue),
+			Options{Width: 4, Height: 4, FitMode: "fill", Background: "0000ffff"},
+			newImage(4, 4, blue, blue, blue, blue, red, red, blue, blue, red, red, blue, blue, blue, blue, blue, blue),
+		},
+		{ // fit, then pad with white by default
+			newImage(4, 2, red, red, blue, blue, red, red, blue, blue),
+			Options{Width: 4, Height: 1, FitMode: "fill"},
+			newImage(4, 1, white, red, blue, white),
+		},
+		{ // pad without a height resizes like fit
+			newImage(4, 2, red, red, blue, blue, red, red, blue, blue),
+			Options{Width: 2, FitMode: "fill"},
+			newImage(2, 1, red, blue),
+		},
 
 		// combinations of options
 		{
 			newImage(4, 2, red, red, blue, blue, red, red, blue, blue),
-			Options{Width: 2, Height: 1, Fit: true, FlipHorizontal: true, Rotate: 90},
+			Options{Width: 2, Height: 1, FitMode: "clip", FlipHorizontal: true, Rotate: 90},
 			newImage(1, 2, blue, red),
 		},
 